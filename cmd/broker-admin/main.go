@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/admin"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/redact"
+)
+
+const usage = `Usage: redislabs-broker-admin -c config.yml [-s state-root] [-format table|json] [-yes] <command>
+
+Commands:
+  list               List the instances of the state
+  show <id>          Show an instance and the status of its database
+  export [file]      Write the state, credentials included, to the file or the standard output
+  import <file>      Replace the instances and bindings of the state with the exported ones
+  forget <id>        Remove an instance and its bindings from the state, keeping its database
+  delete <id>        Delete the database of an instance and remove the instance
+  adopt -plan <plan-id> -org <guid> -space <guid> <id> <uid>
+                     Register the database with the UID as an instance of the plan
+  reencrypt          Seal the passwords with the first state encryption key
+`
+
+var (
+	brokerConfigPath string
+	brokerStateRoot  string
+	format           string
+	yes              bool
+)
+
+func init() {
+	flag.StringVar(&brokerConfigPath, "c", "", "Configuration File")
+	flag.StringVar(&brokerStateRoot, "s", os.Getenv("HOME"), "State Root Folder")
+	flag.StringVar(&format, "format", admin.FormatTable, "Output format: table or json")
+	flag.BoolVar(&yes, "yes", false, "Do not ask for confirmation")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+
+	flag.Parse()
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if brokerConfigPath == "" || flag.NArg() == 0 {
+		flag.Usage()
+		return fmt.Errorf("no config file or command specified")
+	}
+
+	logger := lager.NewLogger("redislabs-broker-admin")
+	redactor := redact.New()
+	logger.RegisterSink(redact.NewSink(lager.NewWriterSink(os.Stderr, lager.ERROR), redactor))
+
+	conf, err := config.LoadFromFile(brokerConfigPath)
+	if err != nil {
+		return err
+	}
+	redactor.Add(conf.Logging.RedactKeys...)
+
+	localPersisterPath := path.Join(brokerStateRoot, ".redislabs-broker", "state.json")
+	persister, err := persisters.Open(conf.State, localPersisterPath, logger)
+	if err != nil {
+		return fmt.Errorf("failed to open the broker state: %s", err)
+	}
+	a := admin.New(apiclient.New(conf, logger, nil), persister, conf, logger)
+	ctx := context.Background()
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch {
+	case command == "list" && len(args) == 0:
+		instances, err := a.Instances()
+		if err != nil {
+			return err
+		}
+		return admin.WriteInstances(os.Stdout, instances, format)
+
+	case command == "show" && len(args) == 1:
+		status, err := a.Instance(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		return admin.WriteStatus(os.Stdout, status, format)
+
+	case command == "export" && len(args) == 0:
+		return a.Export(os.Stdout)
+
+	case command == "export" && len(args) == 1:
+		file, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return a.Export(file)
+
+	case command == "import" && len(args) == 1:
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err = confirm("Replace every instance of the state with the ones of " + args[0] + "?"); err != nil {
+			return err
+		}
+		return a.Import(file)
+
+	case command == "forget" && len(args) == 1:
+		if err = confirm("Remove the instance " + args[0] + " from the state, keeping its database?"); err != nil {
+			return err
+		}
+		return a.Forget(args[0])
+
+	case command == "delete" && len(args) == 1:
+		if err = confirm("Delete the database of the instance " + args[0] + " along with its data?"); err != nil {
+			return err
+		}
+		return a.Delete(ctx, args[0])
+
+	case command == "adopt":
+		return adopt(ctx, a, args)
+
+	case command == "reencrypt" && len(args) == 0:
+		sealed, err := persisters.Reencrypt(persister)
+		if err != nil {
+			return err
+		}
+		if sealed == 0 {
+			fmt.Println("Every password is already sealed with the first key")
+			return nil
+		}
+		fmt.Printf("Sealed %d passwords with the first key\n", sealed)
+		return nil
+	}
+	flag.Usage()
+	return fmt.Errorf("unknown command or wrong arguments: %s", command)
+}
+
+// adopt registers a database created without the broker as an instance.
+func adopt(ctx context.Context, a *admin.Admin, args []string) error {
+	flags := flag.NewFlagSet("adopt", flag.ExitOnError)
+	details := persisters.InstanceDetails{}
+	flags.StringVar(&details.PlanID, "plan", "", "ID of the plan the database suits")
+	flags.StringVar(&details.OrganizationGUID, "org", "", "GUID of the organization of the instance")
+	flags.StringVar(&details.SpaceGUID, "space", "", "GUID of the space of the instance")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flag.Usage()
+		return fmt.Errorf("adopt takes an instance ID and a database UID")
+	}
+	UID, err := strconv.Atoi(flags.Arg(1))
+	if err != nil {
+		return fmt.Errorf("invalid database UID %q", flags.Arg(1))
+	}
+	instance, err := a.Adopt(ctx, flags.Arg(0), UID, details)
+	if err != nil {
+		return err
+	}
+	return admin.WriteInstances(os.Stdout, []persisters.ServiceInstance{instance}, format)
+}
+
+// confirm fails unless -yes is given or the operator agrees.
+func confirm(question string) error {
+	if yes || admin.Confirm(os.Stdin, os.Stdout, question) {
+		return nil
+	}
+	return fmt.Errorf("nothing has been changed")
+}
@@ -1,27 +1,45 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"path"
+	"time"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/admin"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/audit"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/health"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/instancebinders"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/instancecreators"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/metering"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/metrics"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/recovery"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/redact"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/usage"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/webhooks"
 	"github.com/pivotal-cf/brokerapi"
-	"github.com/pivotal-golang/lager"
+	"github.com/pivotal-cf/brokerapi/auth"
 )
 
 var (
 	localPersisterPath string
+	meteringStorePath  string
+	auditFilePath      string
+	webhookQueuePath   string
 	brokerStateRoot    string
 	brokerConfigPath   string
 )
 
+const dateLayout = "2006-01-02"
+
 func init() {
 	flag.StringVar(&brokerConfigPath, "c", "", "Configuration File")
 	flag.StringVar(&brokerStateRoot, "s", os.Getenv("HOME"), "State Root Folder")
@@ -29,12 +47,20 @@ func init() {
 	flag.Parse()
 
 	localPersisterPath = path.Join(brokerStateRoot, ".redislabs-broker", "state.json")
+	meteringStorePath = path.Join(brokerStateRoot, ".redislabs-broker", "metering")
+	auditFilePath = path.Join(brokerStateRoot, ".redislabs-broker", "audit.log")
+	webhookQueuePath = path.Join(brokerStateRoot, ".redislabs-broker", "webhooks.json")
 }
 
 func main() {
 	brokerLogger := lager.NewLogger("redislabs-service-broker")
-	brokerLogger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.DEBUG))
-	brokerLogger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.ERROR))
+	// Every sink masks the secrets, the config may add more key names.
+	redactor := redact.New()
+	if flag.NArg() == 0 {
+		// Commands print their results to the standard output.
+		brokerLogger.RegisterSink(redact.NewSink(lager.NewWriterSink(os.Stdout, lager.DEBUG), redactor))
+	}
+	brokerLogger.RegisterSink(redact.NewSink(lager.NewWriterSink(os.Stderr, lager.ERROR), redactor))
 
 	if brokerConfigPath == "" {
 		brokerLogger.Error("No config file specified", nil)
@@ -50,11 +76,89 @@ func main() {
 		})
 		return
 	}
+	redactor.Add(conf.Logging.RedactKeys...)
+	if err = conf.Validate(); err != nil {
+		brokerLogger.Error("The config is invalid", err)
+		switch flag.Arg(0) {
+		case "", "migrate", "metering":
+		default:
+			// The commands talking to the cluster need valid credentials.
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if flag.NArg() == 0 {
+			// Keep running so that /readyz can report the problem, the
+			// unvalidated credentials guard nothing else.
+			serveHealth(conf, brokerLogger)
+			return
+		}
+	}
+
+	if flag.Arg(0) == "migrate" {
+		if err = migrateState(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	statePersister, err := persisters.Open(conf.State, localPersisterPath, brokerLogger)
+	if err != nil {
+		brokerLogger.Error("Failed to open the broker state", err)
+		os.Exit(1)
+	}
+	if flag.NArg() == 0 && len(conf.State.Encryption.Keys) > 0 {
+		// Only the broker seals the stored passwords with the current
+		// key on start, the commands leave the state as it is.
+		sealed, err := persisters.Reencrypt(statePersister)
+		if err != nil {
+			brokerLogger.Error("Failed to re-encrypt the broker state", err)
+			os.Exit(1)
+		}
+		if sealed > 0 {
+			brokerLogger.Info("Re-encrypted the broker state", lager.Data{
+				"passwords": sealed,
+			})
+		}
+	}
+	persister := metrics.InstrumentPersister(statePersister)
+	api := apiclient.New(conf, brokerLogger, metrics.ObserveClusterRequest)
+	reporter := usage.NewReporter(api, persister, conf, brokerLogger)
+	meteringStore := metering.NewFileStore(meteringStorePath, conf.Metering.Retention)
+
+	switch flag.Arg(0) {
+	case "":
+	case "usage":
+		if err = printUsage(reporter, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	case "recover":
+		if err = recoverState(api, persister, conf, flag.Args()[1:], brokerLogger); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	case "metering":
+		if err = exportMetering(meteringStore, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	default:
+		brokerLogger.Error("Unknown command", nil, lager.Data{
+			"command": flag.Arg(0),
+		})
+		return
+	}
+
+	sampler := metering.NewSampler(api, persister, meteringStore, conf.Metering.Interval, brokerLogger)
+	go sampler.Run(context.Background())
 
 	serviceBroker := redislabs.NewServiceBroker(
-		instancecreators.NewDefault(conf, brokerLogger),
+		instancecreators.NewDefaultWithClient(api, conf, brokerLogger),
 		instancebinders.NewDefault(conf, brokerLogger),
-		persisters.NewLocalPersister(localPersisterPath),
+		persister,
 		conf,
 		brokerLogger,
 	)
@@ -64,8 +168,43 @@ func main() {
 		Password: conf.ServiceBroker.Auth.Password,
 	}
 
-	brokerAPI := brokerapi.New(serviceBroker, brokerLogger, credentials)
-	http.Handle("/", brokerAPI)
+	if conf.Metrics.Port != 0 {
+		go serveMetrics(conf.Metrics.Port, persister, brokerLogger)
+	}
+
+	if conf.Audit.File != "" {
+		auditFilePath = conf.Audit.File
+	}
+	auditSink, err := audit.NewFileSink(auditFilePath)
+	if err != nil {
+		brokerLogger.Error("Failed to open the audit log", err, lager.Data{
+			"path": auditFilePath,
+		})
+		return
+	}
+	auditedBroker := audit.NewBroker(serviceBroker, auditSink, redactor, brokerLogger)
+
+	webhookQueue, err := webhooks.OpenQueue(webhookQueuePath)
+	if err != nil {
+		brokerLogger.Error("Failed to load the webhook queue", err, lager.Data{
+			"path": webhookQueuePath,
+		})
+		return
+	}
+	dispatcher := webhooks.NewDispatcher(conf.Webhooks, webhookQueue, brokerLogger)
+	go dispatcher.Run(context.Background())
+	notifyingBroker := webhooks.NewBroker(auditedBroker, dispatcher, brokerLogger)
+
+	brokerAPI := brokerapi.New(metrics.InstrumentBroker(notifyingBroker), brokerLogger, credentials)
+	http.Handle("/", audit.Middleware(brokerAPI))
+	http.Handle("/healthz", health.LivenessHandler())
+	http.Handle("/readyz", health.ReadinessHandler([]health.Check{
+		health.ConfigCheck(conf),
+		health.PersisterCheck(persister),
+		health.ClusterCheck(api),
+	}, brokerLogger))
+	adminAuth := auth.NewWrapper(credentials.Username, credentials.Password)
+	http.Handle("/admin/usage", adminAuth.Wrap(usage.NewHandler(reporter, brokerLogger)))
 	brokerLogger.Info("Listening for requests", lager.Data{
 		"port": conf.ServiceBroker.Port,
 	})
@@ -74,3 +213,136 @@ func main() {
 		brokerLogger.Error("Failed to start the server", err)
 	}
 }
+
+// serveHealth serves the health endpoints only, the broker API and the
+// admin endpoints are not mounted.
+func serveHealth(conf config.Config, logger lager.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", health.LivenessHandler())
+	mux.Handle("/readyz", health.ReadinessHandler([]health.Check{
+		health.ConfigCheck(conf),
+	}, logger))
+	logger.Info("Serving the health endpoints only", lager.Data{
+		"port": conf.ServiceBroker.Port,
+	})
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", conf.ServiceBroker.Port), mux); err != nil {
+		logger.Error("Failed to start the server", err)
+	}
+}
+
+// serveMetrics serves the Prometheus metrics without authentication on
+// a port of their own.
+func serveMetrics(port int, persister persisters.StatePersister, logger lager.Logger) {
+	metrics.Default.Register(metrics.InstancesByPlan(persister))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(metrics.Default))
+	logger.Info("Serving metrics", lager.Data{
+		"port": port,
+	})
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux); err != nil {
+		logger.Error("Failed to start the metrics server", err)
+	}
+}
+
+// migrateState upgrades the state file to the current schema version, or
+// prints the upgraded state without changing the file with -dry-run.
+func migrateState(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Print the migrated state instead of saving it")
+	flags.Parse(args)
+
+	from, to, err := persisters.MigrateFile(localPersisterPath, *dryRun, os.Stdout)
+	if err != nil {
+		return err
+	}
+	switch {
+	case *dryRun:
+	case from == to:
+		fmt.Printf("The state is already at schema version %d\n", to)
+	default:
+		fmt.Printf("The state has been migrated from schema version %d to %d\n", from, to)
+	}
+	return nil
+}
+
+// printUsage prints the cluster usage report to the standard output.
+func printUsage(reporter *usage.Reporter, args []string) error {
+	flags := flag.NewFlagSet("usage", flag.ExitOnError)
+	format := flags.String("format", usage.FormatTable, "Output format: table or json")
+	flags.Parse(args)
+
+	report, err := reporter.Report(context.Background())
+	if err != nil {
+		return err
+	}
+	return usage.Write(os.Stdout, report, *format)
+}
+
+// recoverState rebuilds the instances from the databases of the cluster
+// and adds the ones the state does not know once the operator agrees.
+func recoverState(api apiclient.Client, persister persisters.StatePersister, conf config.Config, args []string, logger lager.Logger) error {
+	flags := flag.NewFlagSet("recover", flag.ExitOnError)
+	yes := flags.Bool("yes", false, "Write the state without asking for confirmation")
+	flags.Parse(args)
+
+	result, err := recovery.Rebuild(context.Background(), api, conf, logger)
+	if err != nil {
+		return err
+	}
+	for _, skipped := range result.Skipped {
+		fmt.Printf("Skipping database %d %q: %s\n", skipped.UID, skipped.Name, skipped.Reason)
+	}
+	for _, instance := range result.Instances {
+		plan := instance.PlanID
+		if plan == "" {
+			plan = "unknown plan"
+		}
+		fmt.Printf("Instance %s: database %d, %s\n", instance.ID, instance.Credentials.UID, plan)
+	}
+	if len(result.Instances) == 0 {
+		fmt.Println("No instance to recover")
+		return nil
+	}
+	if !*yes {
+		question := fmt.Sprintf("Add the %d instances to the state?", len(result.Instances))
+		if !admin.Confirm(os.Stdin, os.Stdout, question) {
+			return fmt.Errorf("the state has not been changed")
+		}
+	}
+	added, err := recovery.Apply(persister, result.Instances)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added %d instances, %d were already known\n", added, len(result.Instances)-added)
+	return nil
+}
+
+// exportMetering prints the memory-hours of every organization space, or
+// of every organization, within the given date range to the standard
+// output.
+func exportMetering(store metering.Store, args []string) error {
+	flags := flag.NewFlagSet("metering", flag.ExitOnError)
+	from := flags.String("from", "", "First day of the range, YYYY-MM-DD (UTC)")
+	to := flags.String("to", "", "Day after the range, YYYY-MM-DD (UTC)")
+	format := flags.String("format", metering.FormatCSV, "Output format: csv or json")
+	by := flags.String("by", metering.BySpace, "Sum up per space or per organization")
+	flags.Parse(args)
+
+	fromDate, err := time.Parse(dateLayout, *from)
+	if err != nil {
+		return fmt.Errorf("invalid -from date: %s", err)
+	}
+	toDate, err := time.Parse(dateLayout, *to)
+	if err != nil {
+		return fmt.Errorf("invalid -to date: %s", err)
+	}
+	records, err := store.Records(fromDate, toDate)
+	if err != nil {
+		return err
+	}
+	usages, err := metering.Summarize(records, *by)
+	if err != nil {
+		return err
+	}
+	return metering.Export(os.Stdout, usages, *by, *format)
+}
@@ -0,0 +1,254 @@
+package admin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/instancecreators"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/recovery"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var (
+	ErrInstanceNotFound = errors.New("the state has no such instance")
+	ErrInvalidState     = errors.New("the imported state is invalid")
+	ErrInstanceExists   = errors.New("the state has an instance with this ID already")
+	ErrDatabaseAdopted  = errors.New("the database belongs to an instance already")
+	ErrPlanNotFound     = errors.New("the config has no such plan")
+	ErrDetailsMissing   = errors.New("the instance ID, organization and space are required")
+)
+
+type (
+	// Admin works on the broker state and the cluster on behalf of an
+	// operator, instead of editing the state by hand.
+	Admin struct {
+		api       apiclient.Client
+		persister persisters.StatePersister
+		conf      config.Config
+		logger    lager.Logger
+	}
+
+	// InstanceStatus is an instance of the state along with its database
+	// as the cluster reports it now.
+	InstanceStatus struct {
+		Instance persisters.ServiceInstance `json:"instance"`
+		// Database is missing if the cluster cannot tell about it, the
+		// reason is given by ClusterError.
+		Database     *apiclient.Database `json:"database,omitempty"`
+		ClusterError string              `json:"cluster_error,omitempty"`
+	}
+)
+
+func New(api apiclient.Client, persister persisters.StatePersister, conf config.Config, logger lager.Logger) *Admin {
+	return &Admin{
+		api:       api,
+		persister: persister,
+		conf:      conf,
+		logger:    logger,
+	}
+}
+
+// Instances returns the instances of the state.
+func (a *Admin) Instances() ([]persisters.ServiceInstance, error) {
+	state, err := a.persister.Load()
+	if err != nil {
+		return nil, err
+	}
+	return state.AvailableInstances, nil
+}
+
+// Instance returns the instance with the status of its database. Failing
+// to reach the cluster is reported in the status rather than as an error.
+func (a *Admin) Instance(ctx context.Context, instanceID string) (InstanceStatus, error) {
+	instance, err := a.find(instanceID)
+	if err != nil {
+		return InstanceStatus{}, err
+	}
+	status := InstanceStatus{Instance: instance}
+	database, err := a.api.GetDatabase(ctx, instance.Credentials.UID)
+	if err != nil {
+		status.ClusterError = err.Error()
+		return status, nil
+	}
+	status.Database = &database
+	return status, nil
+}
+
+// Export writes the state as JSON, credentials included.
+func (a *Admin) Export(w io.Writer) error {
+	state, err := a.persister.Load()
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(state)
+}
+
+// Import replaces the instances and bindings of the state with the ones
+// of an exported state, migrated to the current schema version first.
+func (a *Admin) Import(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if data, _, err = persisters.Migrate(data); err != nil {
+		return err
+	}
+	imported := persisters.State{}
+	if err = json.Unmarshal(data, &imported); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, instance := range imported.AvailableInstances {
+		if instance.ID == "" || seen[instance.ID] {
+			return ErrInvalidState
+		}
+		seen[instance.ID] = true
+	}
+	return a.persister.Update(func(state *persisters.State) error {
+		state.AvailableInstances = imported.AvailableInstances
+		state.Bindings = imported.Bindings
+		return nil
+	})
+}
+
+// Forget removes the instance and its bindings from the state and leaves
+// its database in the cluster.
+func (a *Admin) Forget(instanceID string) error {
+	return a.persister.Update(func(state *persisters.State) error {
+		left := []persisters.ServiceInstance{}
+		for _, instance := range state.AvailableInstances {
+			if instance.ID != instanceID {
+				left = append(left, instance)
+			}
+		}
+		if len(left) == len(state.AvailableInstances) {
+			return ErrInstanceNotFound
+		}
+		state.AvailableInstances = left
+		bindings := []persisters.ServiceBinding{}
+		for _, binding := range state.Bindings {
+			if binding.InstanceID != instanceID {
+				bindings = append(bindings, binding)
+			}
+		}
+		state.Bindings = bindings
+		return nil
+	})
+}
+
+// Delete deletes the database of the instance and removes the instance
+// from the state, the way a deprovisioning does. An instance whose
+// database is already gone is removed as well.
+func (a *Admin) Delete(ctx context.Context, instanceID string) error {
+	if _, err := a.find(instanceID); err != nil {
+		return err
+	}
+	creator := instancecreators.NewDefaultWithClient(a.api, a.conf, a.logger)
+	err := creator.Destroy(ctx, instanceID, a.persister)
+	if err == brokerapi.ErrInstanceDoesNotExist {
+		a.logger.Info("The database of the instance was already gone", lager.Data{
+			"instance-id": instanceID,
+		})
+		return nil
+	}
+	return err
+}
+
+// Adopt registers a database created without the broker as an instance
+// of the plan, so that it can be bound, updated and deprovisioned like the
+// ones the broker creates. The database has to have the plan settings.
+func (a *Admin) Adopt(ctx context.Context, instanceID string, UID int, details persisters.InstanceDetails) (persisters.ServiceInstance, error) {
+	if instanceID == "" || details.OrganizationGUID == "" || details.SpaceGUID == "" {
+		return persisters.ServiceInstance{}, ErrDetailsMissing
+	}
+	plan, found := a.plan(details.PlanID)
+	if !found {
+		return persisters.ServiceInstance{}, ErrPlanNotFound
+	}
+	database, err := a.api.GetDatabase(ctx, UID)
+	if err != nil {
+		return persisters.ServiceInstance{}, err
+	}
+	if database.Type != "" && database.Type != "redis" {
+		return persisters.ServiceInstance{}, fmt.Errorf("the database is of type %s, the plan creates redis ones", database.Type)
+	}
+	if database.Status != "active" {
+		return persisters.ServiceInstance{}, fmt.Errorf("the database is %s, not active", database.Status)
+	}
+	if mismatch := recovery.Mismatch(database, plan.ServiceInstanceConfig); mismatch != "" {
+		return persisters.ServiceInstance{}, fmt.Errorf("the database does not suit plan %s: %s", plan.ID, mismatch)
+	}
+	credentials, err := recovery.Credentials(database)
+	if err != nil {
+		return persisters.ServiceInstance{}, err
+	}
+
+	adopted := persisters.ServiceInstance{
+		ID:              instanceID,
+		Credentials:     credentials,
+		InstanceDetails: details,
+	}
+	err = a.persister.Update(func(state *persisters.State) error {
+		for _, instance := range state.AvailableInstances {
+			if instance.ID == instanceID {
+				return ErrInstanceExists
+			}
+			if instance.Credentials.UID == UID {
+				return ErrDatabaseAdopted
+			}
+		}
+		state.AvailableInstances = append(state.AvailableInstances, adopted)
+		return nil
+	})
+	if err != nil {
+		return persisters.ServiceInstance{}, err
+	}
+	a.logger.Info("Adopted a database", lager.Data{
+		"instance-id": instanceID,
+		"UID":         UID,
+		"plan-id":     plan.ID,
+	})
+	return adopted, nil
+}
+
+func (a *Admin) plan(planID string) (config.ServicePlanConfig, bool) {
+	for _, plan := range a.conf.ServiceBroker.Plans {
+		if plan.ID == planID {
+			return plan, true
+		}
+	}
+	return config.ServicePlanConfig{}, false
+}
+
+func (a *Admin) find(instanceID string) (persisters.ServiceInstance, error) {
+	instances, err := a.Instances()
+	if err != nil {
+		return persisters.ServiceInstance{}, err
+	}
+	for _, instance := range instances {
+		if instance.ID == instanceID {
+			return instance, nil
+		}
+	}
+	return persisters.ServiceInstance{}, ErrInstanceNotFound
+}
+
+// Confirm asks the question and tells whether the answer is yes.
+func Confirm(in io.Reader, out io.Writer, question string) bool {
+	fmt.Fprintf(out, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
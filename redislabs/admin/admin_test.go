@@ -0,0 +1,319 @@
+package admin_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/admin"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient/fakes"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+	brokerconfig "github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/redact"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Admin", func() {
+	var (
+		api         *fakes.FakeClient
+		persister   persisters.StatePersister
+		tmpStateDir string
+		a           *admin.Admin
+		ctx         = context.Background()
+		logger      = lager.NewLogger("test")
+	)
+
+	instance := func(id string, UID int) persisters.ServiceInstance {
+		return persisters.ServiceInstance{
+			ID: id,
+			Credentials: cluster.InstanceCredentials{
+				UID:      UID,
+				Port:     12000 + UID,
+				IPList:   []string{"10.0.0.1"},
+				Password: "secret",
+			},
+			InstanceDetails: persisters.InstanceDetails{
+				PlanID:           "small-id",
+				OrganizationGUID: "org",
+				SpaceGUID:        "space",
+			},
+		}
+	}
+
+	load := func() []persisters.ServiceInstance {
+		state, err := persister.Load()
+		Expect(err).NotTo(HaveOccurred())
+		return state.AvailableInstances
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpStateDir, err = ioutil.TempDir("", "redislabs-admin-test")
+		Expect(err).NotTo(HaveOccurred())
+		persister = persisters.NewLocalPersister(path.Join(tmpStateDir, "state.json"))
+		Expect(persister.Save(&persisters.State{
+			AvailableInstances: []persisters.ServiceInstance{
+				instance("a", 1),
+				instance("b", 2),
+			},
+		})).To(Succeed())
+
+		api = &fakes.FakeClient{
+			Databases: map[int]apiclient.Database{
+				1: {UID: 1, Name: "cf-a", Status: "active", MemorySize: 100, ShardsCount: 1, Password: "secret"},
+			},
+			WatchResult: apiclient.WatchResult{Outcome: apiclient.DatabaseDeleted},
+		}
+		conf := brokerconfig.Config{
+			ServiceBroker: brokerconfig.ServiceBrokerConfig{
+				Plans: []brokerconfig.ServicePlanConfig{{
+					ID: "small-id",
+					ServiceInstanceConfig: brokerconfig.ServiceInstanceConfig{
+						MemoryLimit: 100,
+					},
+				}},
+			},
+		}
+		a = admin.New(api, persister, conf, logger)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpStateDir)
+	})
+
+	Describe("Showing an instance", func() {
+		It("Reports the database of the instance", func() {
+			status, err := a.Instance(ctx, "a")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.Instance).To(Equal(instance("a", 1)))
+			Expect(status.Database).NotTo(BeNil())
+			Expect(status.Database.Status).To(Equal("active"))
+			Expect(status.ClusterError).To(BeEmpty())
+		})
+
+		It("Reports why the cluster cannot tell about the database", func() {
+			status, err := a.Instance(ctx, "b")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.Database).To(BeNil())
+			Expect(status.ClusterError).NotTo(BeEmpty())
+		})
+
+		It("Fails for an unknown instance", func() {
+			_, err := a.Instance(ctx, "unknown")
+			Expect(err).To(Equal(admin.ErrInstanceNotFound))
+		})
+	})
+
+	Describe("Exporting and importing the state", func() {
+		It("Brings back the exported instances", func() {
+			var exported bytes.Buffer
+			Expect(a.Export(&exported)).To(Succeed())
+			Expect(a.Forget("a")).To(Succeed())
+
+			Expect(a.Import(&exported)).To(Succeed())
+			Expect(load()).To(Equal([]persisters.ServiceInstance{instance("a", 1), instance("b", 2)}))
+		})
+
+		It("Refuses a state with duplicate instance IDs", func() {
+			imported := `{"AvailableInstances": [{"ID": "c"}, {"ID": "c"}]}`
+			Expect(a.Import(strings.NewReader(imported))).To(Equal(admin.ErrInvalidState))
+			Expect(load()).To(HaveLen(2))
+		})
+
+		It("Refuses a state of a newer schema version", func() {
+			imported := `{"AvailableInstances": [], "schema_version": 1000}`
+			Expect(a.Import(strings.NewReader(imported))).NotTo(Succeed())
+			Expect(load()).To(HaveLen(2))
+		})
+	})
+
+	Describe("Forgetting an instance", func() {
+		It("Removes the instance and keeps its database", func() {
+			Expect(a.Forget("a")).To(Succeed())
+			Expect(load()).To(Equal([]persisters.ServiceInstance{instance("b", 2)}))
+			Expect(api.DeletedUIDs).To(BeEmpty())
+		})
+
+		It("Fails for an unknown instance", func() {
+			Expect(a.Forget("unknown")).To(Equal(admin.ErrInstanceNotFound))
+		})
+	})
+
+	Describe("Deleting an instance", func() {
+		It("Deletes the database and removes the instance", func() {
+			Expect(a.Delete(ctx, "a")).To(Succeed())
+			Expect(api.DeletedUIDs).To(Equal([]int{1}))
+			Expect(load()).To(Equal([]persisters.ServiceInstance{instance("b", 2)}))
+		})
+
+		It("Removes an instance whose database is already gone", func() {
+			api.DeleteError = &apiclient.Error{StatusCode: 404, Code: "db_not_exist"}
+			Expect(a.Delete(ctx, "b")).To(Succeed())
+			Expect(load()).To(Equal([]persisters.ServiceInstance{instance("a", 1)}))
+		})
+
+		It("Keeps the instance if the database cannot be deleted", func() {
+			api.DeleteError = &apiclient.Error{StatusCode: 500}
+			Expect(a.Delete(ctx, "a")).NotTo(Succeed())
+			Expect(load()).To(HaveLen(2))
+		})
+
+		It("Fails for an unknown instance", func() {
+			Expect(a.Delete(ctx, "unknown")).To(Equal(admin.ErrInstanceNotFound))
+			Expect(api.DeletedUIDs).To(BeEmpty())
+		})
+	})
+
+	Describe("Adopting a database", func() {
+		details := persisters.InstanceDetails{
+			PlanID:           "small-id",
+			OrganizationGUID: "org",
+			SpaceGUID:        "space",
+		}
+
+		BeforeEach(func() {
+			api.Databases[5] = apiclient.Database{
+				UID:         5,
+				Name:        "created-by-hand",
+				Type:        "redis",
+				Status:      "active",
+				MemorySize:  100,
+				ShardsCount: 1,
+				DNSAddress:  "redis-12005.cluster.local:12005",
+				IPList:      []string{"10.0.0.5"},
+				Password:    "secret",
+			}
+		})
+
+		It("Registers the database as an instance of the plan", func() {
+			adopted, err := a.Adopt(ctx, "c", 5, details)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(adopted).To(Equal(persisters.ServiceInstance{
+				ID: "c",
+				Credentials: cluster.InstanceCredentials{
+					UID:      5,
+					Port:     12005,
+					IPList:   []string{"10.0.0.5"},
+					Password: "secret",
+				},
+				InstanceDetails: details,
+			}))
+			Expect(load()).To(Equal([]persisters.ServiceInstance{instance("a", 1), instance("b", 2), adopted}))
+		})
+
+		It("Deletes the database of an adopted instance like any other", func() {
+			_, err := a.Adopt(ctx, "c", 5, details)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(a.Delete(ctx, "c")).To(Succeed())
+			Expect(api.DeletedUIDs).To(Equal([]int{5}))
+			Expect(load()).To(HaveLen(2))
+		})
+
+		It("Refuses a database whose settings differ from the plan", func() {
+			database := api.Databases[5]
+			database.ShardsCount = 2
+			api.Databases[5] = database
+			_, err := a.Adopt(ctx, "c", 5, details)
+			Expect(err).To(MatchError(ContainSubstring("2 shards")))
+			Expect(load()).To(HaveLen(2))
+		})
+
+		It("Refuses a database that is not active", func() {
+			database := api.Databases[5]
+			database.Status = "pending"
+			api.Databases[5] = database
+			_, err := a.Adopt(ctx, "c", 5, details)
+			Expect(err).To(MatchError(ContainSubstring("pending")))
+		})
+
+		It("Refuses a database of an instance", func() {
+			database := api.Databases[5]
+			database.UID = 1
+			api.Databases[1] = database
+			_, err := a.Adopt(ctx, "c", 1, details)
+			Expect(err).To(Equal(admin.ErrDatabaseAdopted))
+			Expect(load()).To(HaveLen(2))
+		})
+
+		It("Refuses an instance ID of the state", func() {
+			_, err := a.Adopt(ctx, "a", 5, details)
+			Expect(err).To(Equal(admin.ErrInstanceExists))
+		})
+
+		It("Refuses an unknown plan", func() {
+			unknown := details
+			unknown.PlanID = "unknown"
+			_, err := a.Adopt(ctx, "c", 5, unknown)
+			Expect(err).To(Equal(admin.ErrPlanNotFound))
+		})
+
+		It("Requires the organization and space", func() {
+			_, err := a.Adopt(ctx, "c", 5, persisters.InstanceDetails{PlanID: "small-id"})
+			Expect(err).To(Equal(admin.ErrDetailsMissing))
+		})
+
+		It("Fails for an unknown database", func() {
+			_, err := a.Adopt(ctx, "c", 6, details)
+			Expect(apiclient.IsNotFound(err)).To(BeTrue())
+		})
+	})
+
+	Describe("Writing the instances", func() {
+		It("Writes a table without the passwords", func() {
+			var out bytes.Buffer
+			Expect(admin.WriteInstances(&out, load(), admin.FormatTable)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("INSTANCE"))
+			Expect(out.String()).To(MatchRegexp(`a\s+small-id\s+org\s+space\s+1\n`))
+			Expect(out.String()).NotTo(ContainSubstring("secret"))
+		})
+
+		It("Writes JSON without the passwords", func() {
+			var out bytes.Buffer
+			Expect(admin.WriteInstances(&out, load(), admin.FormatJSON)).To(Succeed())
+			instances := []persisters.ServiceInstance{}
+			Expect(json.Unmarshal(out.Bytes(), &instances)).To(Succeed())
+			Expect(instances).To(HaveLen(2))
+			Expect(instances[0].Credentials.Password).To(Equal(redact.Mask))
+		})
+
+		It("Writes the status without the passwords", func() {
+			status, err := a.Instance(ctx, "a")
+			Expect(err).NotTo(HaveOccurred())
+			for _, format := range []string{admin.FormatTable, admin.FormatJSON} {
+				var out bytes.Buffer
+				Expect(admin.WriteStatus(&out, status, format)).To(Succeed())
+				Expect(out.String()).To(ContainSubstring("active"))
+				Expect(out.String()).NotTo(ContainSubstring("secret"))
+			}
+			Expect(status.Instance.Credentials.Password).To(Equal("secret"))
+		})
+
+		It("Refuses an unknown format", func() {
+			Expect(admin.WriteInstances(ioutil.Discard, nil, "xml")).NotTo(Succeed())
+		})
+	})
+
+	Describe("Asking for confirmation", func() {
+		It("Takes yes for an answer", func() {
+			var out bytes.Buffer
+			Expect(admin.Confirm(strings.NewReader("yes\n"), &out, "Delete?")).To(BeTrue())
+			Expect(out.String()).To(Equal("Delete? [y/N] "))
+			Expect(admin.Confirm(strings.NewReader("Y\n"), &out, "Delete?")).To(BeTrue())
+		})
+
+		It("Takes anything else for a no", func() {
+			Expect(admin.Confirm(strings.NewReader("\n"), ioutil.Discard, "Delete?")).To(BeFalse())
+			Expect(admin.Confirm(strings.NewReader("nope\n"), ioutil.Discard, "Delete?")).To(BeFalse())
+			Expect(admin.Confirm(strings.NewReader(""), ioutil.Discard, "Delete?")).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,90 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/redact"
+)
+
+// Output formats of the instances.
+const (
+	FormatJSON  = "json"
+	FormatTable = "table"
+)
+
+// WriteInstances writes the instances in the given format, without
+// their passwords.
+func WriteInstances(w io.Writer, instances []persisters.ServiceInstance, format string) error {
+	masked := []persisters.ServiceInstance{}
+	for _, instance := range instances {
+		masked = append(masked, maskInstance(instance))
+	}
+	switch format {
+	case FormatJSON:
+		return writeJSON(w, masked)
+	case FormatTable:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "INSTANCE\tPLAN\tORGANIZATION\tSPACE\tUID")
+		for _, instance := range masked {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", instance.ID, instance.PlanID, instance.OrganizationGUID, instance.SpaceGUID, instance.Credentials.UID)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+// WriteStatus writes the instance status in the given format, without
+// the passwords.
+func WriteStatus(w io.Writer, status InstanceStatus, format string) error {
+	status.Instance = maskInstance(status.Instance)
+	if status.Database != nil {
+		database := *status.Database
+		if database.Password != "" {
+			database.Password = redact.Mask
+		}
+		status.Database = &database
+	}
+	switch format {
+	case FormatJSON:
+		return writeJSON(w, status)
+	case FormatTable:
+		instance := status.Instance
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "Instance:\t%s\n", instance.ID)
+		fmt.Fprintf(tw, "Plan:\t%s\n", instance.PlanID)
+		fmt.Fprintf(tw, "Organization:\t%s\n", instance.OrganizationGUID)
+		fmt.Fprintf(tw, "Space:\t%s\n", instance.SpaceGUID)
+		fmt.Fprintf(tw, "UID:\t%d\n", instance.Credentials.UID)
+		fmt.Fprintf(tw, "Endpoint:\t%s:%d\n", strings.Join(instance.Credentials.IPList, ","), instance.Credentials.Port)
+		if status.Database == nil {
+			fmt.Fprintf(tw, "Cluster:\t%s\n", status.ClusterError)
+			return tw.Flush()
+		}
+		database := status.Database
+		fmt.Fprintf(tw, "Database:\t%s\n", database.Name)
+		fmt.Fprintf(tw, "Status:\t%s\n", database.Status)
+		fmt.Fprintf(tw, "Memory:\t%d\n", database.MemorySize)
+		fmt.Fprintf(tw, "Shards:\t%d\n", database.ShardsCount)
+		fmt.Fprintf(tw, "Replication:\t%t\n", database.Replication)
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+func maskInstance(instance persisters.ServiceInstance) persisters.ServiceInstance {
+	if instance.Credentials.Password != "" {
+		instance.Credentials.Password = redact.Mask
+	}
+	return instance
+}
+
+func writeJSON(w io.Writer, value interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
@@ -0,0 +1,115 @@
+package apiclient
+
+import (
+	"context"
+	"fmt"
+)
+
+type (
+	User struct {
+		UID        int    `json:"uid,omitempty"`
+		Name       string `json:"name,omitempty"`
+		Email      string `json:"email,omitempty"`
+		Role       string `json:"role,omitempty"`
+		RoleUIDs   []int  `json:"role_uids,omitempty"`
+		AuthMethod string `json:"auth_method,omitempty"`
+		// Password is only sent to the cluster, it is never returned.
+		Password string `json:"password,omitempty"`
+	}
+
+	Role struct {
+		UID        int    `json:"uid,omitempty"`
+		Name       string `json:"name,omitempty"`
+		Management string `json:"management,omitempty"`
+	}
+
+	RedisACL struct {
+		UID  int    `json:"uid,omitempty"`
+		Name string `json:"name,omitempty"`
+		ACL  string `json:"acl,omitempty"`
+	}
+)
+
+func (c *apiClient) ListUsers(ctx context.Context) ([]User, error) {
+	users := []User{}
+	err := c.do(ctx, "GET", "/v1/users", nil, &users)
+	return users, err
+}
+
+func (c *apiClient) GetUser(ctx context.Context, UID int) (User, error) {
+	user := User{}
+	err := c.do(ctx, "GET", fmt.Sprintf("/v1/users/%d", UID), nil, &user)
+	return user, err
+}
+
+func (c *apiClient) CreateUser(ctx context.Context, user User) (User, error) {
+	created := User{}
+	err := c.do(ctx, "POST", "/v1/users", user, &created)
+	return created, err
+}
+
+func (c *apiClient) UpdateUser(ctx context.Context, UID int, user User) (User, error) {
+	updated := User{}
+	err := c.do(ctx, "PUT", fmt.Sprintf("/v1/users/%d", UID), user, &updated)
+	return updated, err
+}
+
+func (c *apiClient) DeleteUser(ctx context.Context, UID int) error {
+	return c.do(ctx, "DELETE", fmt.Sprintf("/v1/users/%d", UID), nil, nil)
+}
+
+func (c *apiClient) ListRoles(ctx context.Context) ([]Role, error) {
+	roles := []Role{}
+	err := c.do(ctx, "GET", "/v1/roles", nil, &roles)
+	return roles, err
+}
+
+func (c *apiClient) GetRole(ctx context.Context, UID int) (Role, error) {
+	role := Role{}
+	err := c.do(ctx, "GET", fmt.Sprintf("/v1/roles/%d", UID), nil, &role)
+	return role, err
+}
+
+func (c *apiClient) CreateRole(ctx context.Context, role Role) (Role, error) {
+	created := Role{}
+	err := c.do(ctx, "POST", "/v1/roles", role, &created)
+	return created, err
+}
+
+func (c *apiClient) UpdateRole(ctx context.Context, UID int, role Role) (Role, error) {
+	updated := Role{}
+	err := c.do(ctx, "PUT", fmt.Sprintf("/v1/roles/%d", UID), role, &updated)
+	return updated, err
+}
+
+func (c *apiClient) DeleteRole(ctx context.Context, UID int) error {
+	return c.do(ctx, "DELETE", fmt.Sprintf("/v1/roles/%d", UID), nil, nil)
+}
+
+func (c *apiClient) ListRedisACLs(ctx context.Context) ([]RedisACL, error) {
+	acls := []RedisACL{}
+	err := c.do(ctx, "GET", "/v1/redis_acls", nil, &acls)
+	return acls, err
+}
+
+func (c *apiClient) GetRedisACL(ctx context.Context, UID int) (RedisACL, error) {
+	acl := RedisACL{}
+	err := c.do(ctx, "GET", fmt.Sprintf("/v1/redis_acls/%d", UID), nil, &acl)
+	return acl, err
+}
+
+func (c *apiClient) CreateRedisACL(ctx context.Context, acl RedisACL) (RedisACL, error) {
+	created := RedisACL{}
+	err := c.do(ctx, "POST", "/v1/redis_acls", acl, &created)
+	return created, err
+}
+
+func (c *apiClient) UpdateRedisACL(ctx context.Context, UID int, acl RedisACL) (RedisACL, error) {
+	updated := RedisACL{}
+	err := c.do(ctx, "PUT", fmt.Sprintf("/v1/redis_acls/%d", UID), acl, &updated)
+	return updated, err
+}
+
+func (c *apiClient) DeleteRedisACL(ctx context.Context, UID int) error {
+	return c.do(ctx, "DELETE", fmt.Sprintf("/v1/redis_acls/%d", UID), nil, nil)
+}
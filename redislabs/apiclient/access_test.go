@@ -0,0 +1,193 @@
+package apiclient_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	brokerconfig "github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Access control", func() {
+	var (
+		proxy    testing.HTTPProxy
+		api      accessAPI
+		requests []request
+		ctx      = context.Background()
+		logger   = lager.NewLogger("test")
+	)
+
+	BeforeEach(func() {
+		proxy = testing.NewHTTPProxy()
+		requests = nil
+		api = apiclient.New(brokerconfig.Config{
+			Cluster: brokerconfig.ClusterConfig{
+				Address: proxy.URL(),
+			},
+		}, logger, nil)
+	})
+
+	AfterEach(func() {
+		proxy.Close()
+	})
+
+	Describe("Users", func() {
+		It("Lists and gets the users", func() {
+			proxy.RegisterEndpoints([]testing.Endpoint{
+				{URL: "/v1/users", Response: []map[string]interface{}{
+					{"uid": 1, "name": "admin", "role": "admin"},
+					{"uid": 3, "name": "viewer", "role": "db_viewer", "role_uids": []int{2}},
+				}},
+				{URL: "/v1/users/3", Response: map[string]interface{}{"uid": 3, "name": "viewer", "role": "db_viewer"}},
+			})
+			users, err := api.ListUsers(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(users).To(Equal([]apiclient.User{
+				{UID: 1, Name: "admin", Role: "admin"},
+				{UID: 3, Name: "viewer", Role: "db_viewer", RoleUIDs: []int{2}},
+			}))
+
+			user, err := api.GetUser(ctx, 3)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user).To(Equal(apiclient.User{UID: 3, Name: "viewer", Role: "db_viewer"}))
+		})
+
+		It("Updates only the fields that are set", func() {
+			proxy.RegisterEndpointHandler("/v1/users/3", recordRequest(&requests, map[string]interface{}{"uid": 3, "role": "db_member"}))
+			user, err := api.UpdateUser(ctx, 3, apiclient.User{Role: "db_member"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.Role).To(Equal("db_member"))
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].Method).To(Equal("PUT"))
+			Expect(requests[0].Body).To(MatchJSON(`{"role": "db_member"}`))
+		})
+
+		It("Deletes a user", func() {
+			proxy.RegisterEndpointHandler("/v1/users/3", recordRequest(&requests, nil))
+			Expect(api.DeleteUser(ctx, 3)).To(Succeed())
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].Method).To(Equal("DELETE"))
+		})
+	})
+
+	Describe("Roles", func() {
+		It("Creates, updates and deletes a role", func() {
+			proxy.RegisterEndpointHandler("/v1/roles", recordRequest(&requests, map[string]interface{}{"uid": 5, "name": "ops", "management": "db_viewer"}))
+			proxy.RegisterEndpointHandler("/v1/roles/5", recordRequest(&requests, map[string]interface{}{"uid": 5, "name": "ops", "management": "db_member"}))
+
+			role, err := api.CreateRole(ctx, apiclient.Role{Name: "ops", Management: "db_viewer"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(role.UID).To(Equal(5))
+			role, err = api.UpdateRole(ctx, 5, apiclient.Role{Management: "db_member"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(role.Management).To(Equal("db_member"))
+			Expect(api.DeleteRole(ctx, 5)).To(Succeed())
+
+			Expect(requests).To(HaveLen(3))
+			Expect(requests[0].Method).To(Equal("POST"))
+			Expect(requests[0].Body).To(MatchJSON(`{"name": "ops", "management": "db_viewer"}`))
+			Expect(requests[1].Method).To(Equal("PUT"))
+			Expect(requests[1].Body).To(MatchJSON(`{"management": "db_member"}`))
+			Expect(requests[2].Method).To(Equal("DELETE"))
+		})
+
+		It("Gets the roles", func() {
+			proxy.RegisterEndpoints([]testing.Endpoint{
+				{URL: "/v1/roles", Response: []map[string]interface{}{{"uid": 5, "name": "ops"}}},
+				{URL: "/v1/roles/5", Response: map[string]interface{}{"uid": 5, "name": "ops"}},
+			})
+			roles, err := api.ListRoles(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(roles).To(Equal([]apiclient.Role{{UID: 5, Name: "ops"}}))
+			role, err := api.GetRole(ctx, 5)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(role).To(Equal(apiclient.Role{UID: 5, Name: "ops"}))
+		})
+	})
+
+	Describe("Redis ACLs", func() {
+		It("Creates, updates and deletes an ACL", func() {
+			proxy.RegisterEndpointHandler("/v1/redis_acls", recordRequest(&requests, map[string]interface{}{"uid": 9, "name": "read-only", "acl": "+@read ~*"}))
+			proxy.RegisterEndpointHandler("/v1/redis_acls/9", recordRequest(&requests, map[string]interface{}{"uid": 9, "name": "read-only", "acl": "+@read ~cache:*"}))
+
+			acl, err := api.CreateRedisACL(ctx, apiclient.RedisACL{Name: "read-only", ACL: "+@read ~*"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acl.UID).To(Equal(9))
+			acl, err = api.UpdateRedisACL(ctx, 9, apiclient.RedisACL{ACL: "+@read ~cache:*"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acl.ACL).To(Equal("+@read ~cache:*"))
+			Expect(api.DeleteRedisACL(ctx, 9)).To(Succeed())
+
+			Expect(requests).To(HaveLen(3))
+			Expect(requests[0].Method).To(Equal("POST"))
+			Expect(requests[0].Body).To(MatchJSON(`{"name": "read-only", "acl": "+@read ~*"}`))
+			Expect(requests[1].Method).To(Equal("PUT"))
+			Expect(requests[1].Body).To(MatchJSON(`{"acl": "+@read ~cache:*"}`))
+			Expect(requests[2].Method).To(Equal("DELETE"))
+		})
+
+		It("Reports a missing ACL as not found", func() {
+			proxy.RegisterEndpointHandler("/v1/redis_acls/9", func(w http.ResponseWriter, r *http.Request) interface{} {
+				w.WriteHeader(http.StatusNotFound)
+				return map[string]interface{}{"error_code": "redis_acl_not_found", "description": "Redis ACL not found"}
+			})
+			_, err := api.GetRedisACL(ctx, 9)
+			Expect(apiclient.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("Lists the ACLs", func() {
+			proxy.RegisterEndpoints([]testing.Endpoint{
+				{URL: "/v1/redis_acls", Response: []map[string]interface{}{{"uid": 1, "name": "Full Access", "acl": "+@all ~*"}}},
+			})
+			acls, err := api.ListRedisACLs(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acls).To(Equal([]apiclient.RedisACL{{UID: 1, Name: "Full Access", ACL: "+@all ~*"}}))
+		})
+	})
+})
+
+type (
+	// accessAPI is the part of the API client the access control specs use.
+	accessAPI interface {
+		ListUsers(ctx context.Context) ([]apiclient.User, error)
+		GetUser(ctx context.Context, UID int) (apiclient.User, error)
+		UpdateUser(ctx context.Context, UID int, user apiclient.User) (apiclient.User, error)
+		DeleteUser(ctx context.Context, UID int) error
+		ListRoles(ctx context.Context) ([]apiclient.Role, error)
+		GetRole(ctx context.Context, UID int) (apiclient.Role, error)
+		CreateRole(ctx context.Context, role apiclient.Role) (apiclient.Role, error)
+		UpdateRole(ctx context.Context, UID int, role apiclient.Role) (apiclient.Role, error)
+		DeleteRole(ctx context.Context, UID int) error
+		ListRedisACLs(ctx context.Context) ([]apiclient.RedisACL, error)
+		GetRedisACL(ctx context.Context, UID int) (apiclient.RedisACL, error)
+		CreateRedisACL(ctx context.Context, acl apiclient.RedisACL) (apiclient.RedisACL, error)
+		UpdateRedisACL(ctx context.Context, UID int, acl apiclient.RedisACL) (apiclient.RedisACL, error)
+		DeleteRedisACL(ctx context.Context, UID int) error
+	}
+
+	// request is an API call the proxy has received.
+	request struct {
+		Method string
+		Body   []byte
+	}
+)
+
+// recordRequest returns a proxy handler appending the calls to requests
+// and replying with the response.
+func recordRequest(requests *[]request, response interface{}) func(w http.ResponseWriter, r *http.Request) interface{} {
+	return func(w http.ResponseWriter, r *http.Request) interface{} {
+		body, err := ioutil.ReadAll(r.Body)
+		Expect(err).NotTo(HaveOccurred())
+		if len(body) == 0 {
+			body = nil
+		}
+		*requests = append(*requests, request{Method: r.Method, Body: body})
+		return response
+	}
+}
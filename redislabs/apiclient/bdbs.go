@@ -0,0 +1,193 @@
+package apiclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"code.cloudfoundry.org/lager"
+)
+
+type (
+	// Database is a bdb object as the cluster reports it.
+	Database struct {
+		UID              int              `json:"uid"`
+		Name             string           `json:"name"`
+		Type             string           `json:"type"`
+		Status           string           `json:"status"`
+		Version          string           `json:"version"`
+		MemorySize       int64            `json:"memory_size"`
+		Replication      bool             `json:"replication"`
+		ShardsCount      int              `json:"shards_count"`
+		Sharding         bool             `json:"sharding"`
+		DataPersistence  string           `json:"data_persistence"`
+		SnapshotPolicy   []SnapshotPolicy `json:"snapshot_policy"`
+		Password         string           `json:"authentication_redis_pass"`
+		Port             int              `json:"port"`
+		IPList           []string         `json:"endpoint_ip"`
+		DNSAddress       string           `json:"dns_address_master"`
+		Modules          []DatabaseModule `json:"module_list"`
+		ImplicitShardKey bool             `json:"implicit_shard_key"`
+		ShardKeyRegex    []ShardKeyRegex  `json:"shard_key_regex"`
+	}
+
+	SnapshotPolicy struct {
+		Writes int `json:"writes"`
+		Secs   int `json:"secs"`
+	}
+
+	ShardKeyRegex struct {
+		Regex string `json:"regex"`
+	}
+
+	DatabaseModule struct {
+		Name    string `json:"module_name"`
+		Args    string `json:"module_args"`
+		Version string `json:"semantic_version,omitempty"`
+	}
+
+	// DatabaseSettings are sent on database creation and update. Only the
+	// fields that are set are sent, so an update does not reset the rest
+	// of the database configuration.
+	DatabaseSettings struct {
+		Name             string           `json:"name,omitempty"`
+		MemorySize       int64            `json:"memory_size,omitempty"`
+		Replication      *bool            `json:"replication,omitempty"`
+		ShardsCount      int64            `json:"shards_count,omitempty"`
+		Sharding         *bool            `json:"sharding,omitempty"`
+		ImplicitShardKey *bool            `json:"implicit_shard_key,omitempty"`
+		ShardKeyRegex    []ShardKeyRegex  `json:"shard_key_regex,omitempty"`
+		DataPersistence  string           `json:"data_persistence,omitempty"`
+		SnapshotPolicy   []SnapshotPolicy `json:"snapshot_policy,omitempty"`
+		Password         string           `json:"authentication_redis_pass,omitempty"`
+		// Extra contains any other parameters described in the cluster API
+		// docs. They take precedence over the fields above.
+		Extra map[string]interface{} `json:"-"`
+	}
+
+	// DatabaseStats are the last known metrics of a database.
+	DatabaseStats struct {
+		UsedMemory    float64 `json:"used_memory"`
+		Keys          float64 `json:"no_of_keys"`
+		TotalRequests float64 `json:"total_req"`
+		Connections   float64 `json:"conns"`
+		STime         string  `json:"stime"`
+		ETime         string  `json:"etime"`
+	}
+)
+
+// Bool returns a pointer to the given value for the optional settings.
+func Bool(value bool) *bool {
+	return &value
+}
+
+func (s DatabaseSettings) MarshalJSON() ([]byte, error) {
+	type settings DatabaseSettings // drops the MarshalJSON method
+	bytes, err := json.Marshal(settings(s))
+	if err != nil || len(s.Extra) == 0 {
+		return bytes, err
+	}
+	all := map[string]interface{}{}
+	if err = json.Unmarshal(bytes, &all); err != nil {
+		return nil, err
+	}
+	for param, value := range s.Extra {
+		all[param] = value
+	}
+	return json.Marshal(all)
+}
+
+func (c *apiClient) ListDatabases(ctx context.Context) ([]Database, error) {
+	databases := []Database{}
+	err := c.do(ctx, "GET", "/v1/bdbs", nil, &databases)
+	return databases, err
+}
+
+func (c *apiClient) GetDatabase(ctx context.Context, UID int) (Database, error) {
+	database := Database{}
+	err := c.do(ctx, "GET", fmt.Sprintf("/v1/bdbs/%d", UID), nil, &database)
+	return database, err
+}
+
+// CreateDatabase sends a database creation request and watches the database
+// until it becomes active. The outcome is sent to the returned channel.
+// Watching stops when the given context is done.
+func (c *apiClient) CreateDatabase(ctx context.Context, settings DatabaseSettings) (<-chan WatchResult, error) {
+	c.logger.Info("Sending a database creation request", lager.Data{
+		"settings": settings,
+	})
+	database := Database{}
+	if err := c.do(ctx, "POST", "/v1/bdbs", settings, &database); err != nil {
+		c.logger.Error("Failed to create a database", err)
+		return nil, err
+	}
+
+	c.logger.Info("Database creation has been scheduled", lager.Data{
+		"UID": database.UID,
+	})
+	return c.watch(ctx, database.UID, WaitForActive, &database), nil
+}
+
+func (c *apiClient) UpdateDatabase(ctx context.Context, UID int, settings DatabaseSettings) error {
+	c.logger.Info("Sending a database update request", lager.Data{
+		"UID":      UID,
+		"settings": settings,
+	})
+	if err := c.do(ctx, "PUT", fmt.Sprintf("/v1/bdbs/%d", UID), settings, nil); err != nil {
+		c.logger.Error("Failed to update the database", err, lager.Data{
+			"UID": UID,
+		})
+		return err
+	}
+
+	c.logger.Info("The database update has been scheduled", lager.Data{
+		"UID": UID,
+	})
+	return nil
+}
+
+func (c *apiClient) DeleteDatabase(ctx context.Context, UID int) error {
+	if err := c.do(ctx, "DELETE", fmt.Sprintf("/v1/bdbs/%d", UID), nil, nil); err != nil {
+		c.logger.Error("Failed to delete the database", err, lager.Data{
+			"UID": UID,
+		})
+		return err
+	}
+
+	c.logger.Info("The database removal has been scheduled", lager.Data{
+		"UID": UID,
+	})
+	return nil
+}
+
+// DatabaseAction invokes one of the database actions, eg export, import
+// or recover. The params are sent as the request body unless they are nil.
+func (c *apiClient) DatabaseAction(ctx context.Context, UID int, action string, params interface{}) error {
+	return c.do(ctx, "POST", fmt.Sprintf("/v1/bdbs/%d/actions/%s", UID, action), params, nil)
+}
+
+func (c *apiClient) GetDatabaseStats(ctx context.Context, UID int) (DatabaseStats, error) {
+	stats := map[string]DatabaseStats{}
+	if err := c.do(ctx, "GET", fmt.Sprintf("/v1/bdbs/stats/last/%d", UID), nil, &stats); err != nil {
+		return DatabaseStats{}, err
+	}
+	return stats[fmt.Sprintf("%d", UID)], nil
+}
+
+// GetDatabasesStats returns the stats of every database keyed by the
+// database UID.
+func (c *apiClient) GetDatabasesStats(ctx context.Context) (map[int]DatabaseStats, error) {
+	stats := map[string]DatabaseStats{}
+	if err := c.do(ctx, "GET", "/v1/bdbs/stats/last", nil, &stats); err != nil {
+		return nil, err
+	}
+	statsByUID := map[int]DatabaseStats{}
+	for key, s := range stats {
+		var UID int
+		if _, err := fmt.Sscanf(key, "%d", &UID); err != nil {
+			return nil, fmt.Errorf("unexpected database UID %q in the database stats", key)
+		}
+		statsByUID[UID] = s
+	}
+	return statsByUID, nil
+}
@@ -1,6 +1,7 @@
 package apiclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,166 +10,124 @@ import (
 	"strings"
 	"time"
 
-	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+	"code.cloudfoundry.org/lager"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/httpclient"
-	"github.com/pivotal-golang/lager"
 )
 
 type (
-	apiClient struct {
-		conf   config.Config
-		logger lager.Logger
-	}
+	// Client is the part of the cluster API the broker depends on.
+	Client interface {
+		CreateDatabase(ctx context.Context, settings DatabaseSettings) (<-chan WatchResult, error)
+		UpdateDatabase(ctx context.Context, UID int, settings DatabaseSettings) error
+		DeleteDatabase(ctx context.Context, UID int) error
+		WatchDatabase(ctx context.Context, UID int, target WatchTarget) <-chan WatchResult
+		GetDatabase(ctx context.Context, UID int) (Database, error)
+		ListDatabases(ctx context.Context) ([]Database, error)
+		GetDatabasesStats(ctx context.Context) (map[int]DatabaseStats, error)
+		ListNodes(ctx context.Context) ([]Node, error)
+		GetNodesStats(ctx context.Context) (map[int]NodeStats, error)
+		GetClusterInfo(ctx context.Context) (ClusterInfo, error)
+	}
+
+	// Observer is told about every API call once it has completed, the
+	// error being nil if the call has succeeded. The duration includes
+	// the retries.
+	Observer func(verb string, path string, duration time.Duration, err error)
 
-	errorResponse struct {
-		ErrorMessage string `json:"description"`
-		ErrorCode    string `json:"error_code"`
-	}
-
-	statusResponse struct {
-		UID        int      `json:"uid"`
-		Password   string   `json:"authentication_redis_pass"`
-		IPList     []string `json:"endpoint_ip"`
-		DNSAddress string   `json:"dns_address_master"`
-		Status     string   `json:"status"`
+	apiClient struct {
+		conf     config.Config
+		logger   lager.Logger
+		observer Observer
 	}
 )
 
 var (
+	// Defaults used unless the cluster timeouts are configured.
 	DatabasePollingInterval = 500 // milliseconds
+	RequestTimeout          = 30  // seconds
 )
 
-func New(conf config.Config, logger lager.Logger) *apiClient {
+// New returns a client of the cluster REST API. Besides the Client
+// interface it covers databases, the cluster, nodes, users, roles,
+// Redis ACLs, modules and CRDBs. The observer may be nil.
+func New(conf config.Config, logger lager.Logger, observer Observer) *apiClient {
 	return &apiClient{
-		conf:   conf,
-		logger: logger,
+		conf:     conf,
+		logger:   logger,
+		observer: observer,
 	}
 }
 
-func (c *apiClient) CreateDatabase(settings map[string]interface{}) (chan cluster.InstanceCredentials, error) {
-	bytes, err := json.Marshal(settings)
-	if err != nil {
-		return nil, err
+// do performs a single API call. The request body is serialized from in
+// unless it is nil, and a successful response is deserialized into out
+// unless it is nil. Failures reported by the cluster are returned as *Error.
+func (c *apiClient) do(ctx context.Context, verb string, path string, in interface{}, out interface{}) error {
+	var payload httpclient.HTTPPayload
+	if in != nil {
+		bytes, err := json.Marshal(in)
+		if err != nil {
+			c.logger.Error("Failed to serialize the request payload", err, lager.Data{
+				"path": path,
+			})
+			return err
+		}
+		payload = httpclient.HTTPPayload(bytes)
 	}
 
-	httpClient := c.httpClient()
-	c.logger.Info("Sending a database creation request", lager.Data{
-		"settings": settings,
-	})
-	res, err := httpClient.Post("/v1/bdbs", httpclient.HTTPPayload(bytes))
-	if err != nil {
-		c.logger.Error("Failed to perform a database creation request", err)
-		return nil, err
-	}
+	ctx, cancel := c.withRequestTimeout(ctx)
+	defer cancel()
 
-	if res.StatusCode != 200 {
-		payload, err := c.parseErrorResponse(res)
-		if err != nil {
-			return nil, err
-		}
-		err = fmt.Errorf(payload.ErrorMessage)
-		c.logger.Error("Failed to create a database", err)
-		return nil, err
-	}
-
-	c.logger.Info("Database creation has been scheduled")
-	ch := make(chan cluster.InstanceCredentials)
-	go func() {
-		var payload statusResponse
-		for {
-			time.Sleep(time.Duration(DatabasePollingInterval) * time.Millisecond)
-
-			payload, err = c.parseStatusResponse(res)
-			if err != nil {
-				return
-			}
-			if payload.Status == "active" {
-				port, err := c.parsePortFromDNSAddress(payload.DNSAddress)
-				if err != nil {
-					return
-				}
-				ch <- cluster.InstanceCredentials{
-					UID:      payload.UID,
-					Port:     port,
-					IPList:   payload.IPList,
-					Password: payload.Password,
-				}
-				break
-			}
-
-			res, err = httpClient.Get(fmt.Sprintf("/v1/bdbs/%d", payload.UID), httpclient.HTTPParams{})
-			if err != nil {
-				c.logger.Error("Failed to make a polling request", err)
-			}
-		}
-	}()
-	return ch, nil
+	start := time.Now()
+	err := c.request(ctx, verb, path, payload, out)
+	if c.observer != nil {
+		c.observer(verb, path, time.Since(start), err)
+	}
+	return err
 }
 
-func (c *apiClient) UpdateDatabase(UID int, params map[string]interface{}) error {
+// request sends the API call of do and parses the response.
+func (c *apiClient) request(ctx context.Context, verb string, path string, payload httpclient.HTTPPayload, out interface{}) error {
 	httpClient := c.httpClient()
-
-	bytes, err := json.Marshal(params)
-	if err != nil {
-		c.logger.Error("Failed to serialize update parameters", err)
+	var (
+		res *http.Response
+		err error
+	)
+	switch verb {
+	case "GET":
+		res, err = httpClient.Get(ctx, path, httpclient.HTTPParams{})
+	case "POST":
+		res, err = httpClient.Post(ctx, path, payload)
+	case "PUT":
+		res, err = httpClient.Put(ctx, path, payload)
+	case "PATCH":
+		res, err = httpClient.Patch(ctx, path, payload)
+	case "DELETE":
+		res, err = httpClient.Delete(ctx, path)
+	default:
+		return fmt.Errorf("unsupported request method %s", verb)
 	}
-
-	c.logger.Info("Sending a database update request", lager.Data{
-		"UID":        UID,
-		"Parameters": params,
-	})
-	res, err := httpClient.Put(fmt.Sprintf("/v1/bdbs/%d", UID), httpclient.HTTPPayload(bytes))
 	if err != nil {
-		c.logger.Error("Failed to perform an update request", err, lager.Data{
-			"UID": UID,
-		})
 		return err
 	}
+	defer res.Body.Close()
 
-	if res.StatusCode != 200 {
-		payload, err := c.parseErrorResponse(res)
-		if err != nil {
-			return err
-		}
-		err = fmt.Errorf(payload.ErrorMessage)
-		c.logger.Error("Failed to update the database", err, lager.Data{
-			"UID": UID,
-		})
-		return err
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return c.parseErrorResponse(res)
+	}
+	if out == nil {
+		return nil
+	}
+	bytes, err := ioutil.ReadAll(res.Body)
+	if err == nil {
+		err = json.Unmarshal(bytes, out)
 	}
-
-	c.logger.Info("The database update has been scheduled", lager.Data{
-		"UID": UID,
-	})
-	return nil
-}
-
-func (c *apiClient) DeleteDatabase(UID int) error {
-	httpClient := c.httpClient()
-
-	res, err := httpClient.Delete(fmt.Sprintf("/v1/bdbs/%d", UID))
 	if err != nil {
-		c.logger.Error("Failed to perform the database removal request", err, lager.Data{
-			"UID": UID,
+		c.logger.Error("Failed to parse the response payload", err, lager.Data{
+			"path": path,
 		})
-		return err
 	}
-
-	if res.StatusCode != 200 {
-		payload, err := c.parseErrorResponse(res)
-		if err != nil {
-			return err
-		}
-		err = fmt.Errorf(payload.ErrorMessage)
-		c.logger.Error("Failed to delete the database", err)
-		return err
-	}
-
-	c.logger.Info("The database removal has been scheduled", lager.Data{
-		"UID": UID,
-	})
-	return nil
+	return err
 }
 
 func (c *apiClient) httpClient() httpclient.HTTPClient {
@@ -176,37 +135,68 @@ func (c *apiClient) httpClient() httpclient.HTTPClient {
 		c.conf.Cluster.Auth.Username,
 		c.conf.Cluster.Auth.Password,
 		c.conf.Cluster.Address,
+		c.retryPolicy(),
+		c.breakerPolicy(),
 		c.logger,
 	)
 }
 
-func (c *apiClient) parseErrorResponse(res *http.Response) (errorResponse, error) {
-	payload := errorResponse{}
-	bytes, err := ioutil.ReadAll(res.Body)
-	defer res.Body.Close()
-	if err == nil {
-		err = json.Unmarshal(bytes, &payload)
+// withRequestTimeout limits a single API call, retries included.
+func (c *apiClient) withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := c.conf.Cluster.Timeouts.Request
+	if timeout <= 0 {
+		timeout = RequestTimeout
 	}
-	if err != nil {
-		c.logger.Error("Failed to parse the error response payload", err, lager.Data{
-			"response": string(bytes),
-		})
-		err = fmt.Errorf("an unknown server error occurred")
+	return context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+}
+
+func (c *apiClient) pollingInterval() time.Duration {
+	interval := c.conf.Cluster.Timeouts.PollingInterval
+	if interval <= 0 {
+		interval = DatabasePollingInterval
 	}
-	return payload, err
+	return time.Duration(interval) * time.Millisecond
 }
 
-func (c *apiClient) parseStatusResponse(res *http.Response) (statusResponse, error) {
-	payload := statusResponse{}
+func (c *apiClient) retryPolicy() httpclient.RetryPolicy {
+	policy := httpclient.DefaultRetryPolicy
+	conf := c.conf.Cluster.Retry
+	if conf.MaxAttempts > 0 {
+		policy.MaxAttempts = conf.MaxAttempts
+	}
+	if conf.InitialBackoff > 0 {
+		policy.InitialBackoff = time.Duration(conf.InitialBackoff) * time.Millisecond
+	}
+	if conf.MaxBackoff > 0 {
+		policy.MaxBackoff = time.Duration(conf.MaxBackoff) * time.Millisecond
+	}
+	return policy
+}
+
+func (c *apiClient) breakerPolicy() httpclient.BreakerPolicy {
+	policy := httpclient.DefaultBreakerPolicy
+	conf := c.conf.Cluster.CircuitBreaker
+	if conf.FailureThreshold > 0 {
+		policy.FailureThreshold = conf.FailureThreshold
+	}
+	if conf.Cooldown > 0 {
+		policy.Cooldown = time.Duration(conf.Cooldown) * time.Second
+	}
+	return policy
+}
+
+func (c *apiClient) parseErrorResponse(res *http.Response) error {
+	payload := errorResponse{}
 	bytes, err := ioutil.ReadAll(res.Body)
-	defer res.Body.Close()
 	if err == nil {
 		err = json.Unmarshal(bytes, &payload)
 	}
 	if err != nil {
-		c.logger.Error("Failed to parse the status response payload", err)
+		c.logger.Error("Failed to parse the error response payload", err, lager.Data{
+			"response": string(bytes),
+		})
 	}
-	return payload, err
+	return newError(res.StatusCode, payload)
 }
 
 func (c *apiClient) parsePortFromDNSAddress(address string) (int, error) {
@@ -0,0 +1,146 @@
+package apiclient_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	brokerconfig "github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("API client", func() {
+	var (
+		proxy  testing.HTTPProxy
+		config brokerconfig.Config
+		ctx    = context.Background()
+		logger = lager.NewLogger("test")
+	)
+
+	BeforeEach(func() {
+		proxy = testing.NewHTTPProxy()
+		config = brokerconfig.Config{
+			Cluster: brokerconfig.ClusterConfig{
+				Address: proxy.URL(),
+			},
+		}
+	})
+
+	AfterEach(func() {
+		proxy.Close()
+	})
+
+	Describe("Database settings", func() {
+		It("Sends only the fields that are set along with the extra parameters", func() {
+			settings := apiclient.DatabaseSettings{
+				MemorySize:  1024,
+				Replication: apiclient.Bool(false),
+				Extra: map[string]interface{}{
+					"memory_size": 2048,
+					"oss_cluster": true,
+				},
+			}
+			bytes, err := json.Marshal(settings)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bytes).To(MatchJSON(`{"memory_size": 2048, "replication": false, "oss_cluster": true}`))
+		})
+	})
+
+	Describe("Typed calls", func() {
+		It("Lists the databases", func() {
+			proxy.RegisterEndpoints([]testing.Endpoint{{
+				URL: "/v1/bdbs",
+				Response: []map[string]interface{}{
+					{"uid": 1, "name": "cf-1", "memory_size": 1024, "status": "active"},
+					{"uid": 2, "name": "cf-2", "memory_size": 2048, "status": "pending"},
+				},
+			}})
+			databases, err := apiclient.New(config, logger, nil).ListDatabases(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(databases).To(HaveLen(2))
+			Expect(databases[1]).To(Equal(apiclient.Database{
+				UID:        2,
+				Name:       "cf-2",
+				MemorySize: 2048,
+				Status:     "pending",
+			}))
+		})
+
+		It("Reads the stats of every node", func() {
+			proxy.RegisterEndpoints([]testing.Endpoint{{
+				URL: "/v1/nodes/stats/last",
+				Response: map[string]interface{}{
+					"1": map[string]interface{}{"free_memory": 1024.0, "provisional_memory": 512.0},
+				},
+			}})
+			stats, err := apiclient.New(config, logger, nil).GetNodesStats(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stats).To(HaveKey(1))
+			Expect(stats[1].FreeMemory).To(Equal(1024.0))
+			Expect(stats[1].ProvisionalMemory).To(Equal(512.0))
+		})
+
+		It("Sends typed entities", func() {
+			var received map[string]interface{}
+			proxy.RegisterEndpointHandler("/v1/users", func(w http.ResponseWriter, r *http.Request) interface{} {
+				bytes, err := ioutil.ReadAll(r.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(json.Unmarshal(bytes, &received)).To(Succeed())
+				return map[string]interface{}{"uid": 7, "name": "operator"}
+			})
+			user, err := apiclient.New(config, logger, nil).CreateUser(ctx, apiclient.User{
+				Name:     "operator",
+				Role:     "db_viewer",
+				Password: "secret",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(user.UID).To(Equal(7))
+			Expect(received).To(Equal(map[string]interface{}{
+				"name":     "operator",
+				"role":     "db_viewer",
+				"password": "secret",
+			}))
+		})
+	})
+
+	Describe("Cluster failures", func() {
+		BeforeEach(func() {
+			proxy.RegisterEndpointHandler("/v1/bdbs/1", func(w http.ResponseWriter, r *http.Request) interface{} {
+				w.WriteHeader(http.StatusNotFound)
+				return map[string]interface{}{
+					"error_code":  "db_not_exist",
+					"description": "Database does not exist",
+				}
+			})
+		})
+
+		It("Are returned as errors carrying the cluster error code", func() {
+			_, err := apiclient.New(config, logger, nil).GetDatabase(ctx, 1)
+			Expect(err).To(HaveOccurred())
+			apiErr, ok := err.(*apiclient.Error)
+			Expect(ok).To(BeTrue())
+			Expect(apiErr.StatusCode).To(Equal(http.StatusNotFound))
+			Expect(apiErr.Code).To(Equal("db_not_exist"))
+			Expect(apiErr.Error()).To(Equal("Database does not exist"))
+			Expect(apiclient.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("Are reported to the observer", func() {
+			var observed []string
+			observer := func(verb string, path string, duration time.Duration, err error) {
+				observed = append(observed, fmt.Sprintf("%s %s %v", verb, path, apiclient.IsNotFound(err)))
+			}
+			_, err := apiclient.New(config, logger, observer).GetDatabase(ctx, 1)
+			Expect(err).To(HaveOccurred())
+			Expect(observed).To(Equal([]string{"GET /v1/bdbs/1 true"}))
+		})
+	})
+})
@@ -0,0 +1,36 @@
+package apiclient
+
+import "context"
+
+type (
+	ClusterInfo struct {
+		Name        string `json:"name"`
+		CreatedTime string `json:"created_time"`
+		RackAware   bool   `json:"rack_aware"`
+		EmailAlerts bool   `json:"email_alerts"`
+	}
+
+	// ClusterStats are the last known metrics of the whole cluster.
+	// Memory is measured in bytes.
+	ClusterStats struct {
+		FreeMemory        float64 `json:"free_memory"`
+		AvailableMemory   float64 `json:"available_memory"`
+		ProvisionalMemory float64 `json:"provisional_memory"`
+		TotalRequests     float64 `json:"total_req"`
+		Connections       float64 `json:"conns"`
+		STime             string  `json:"stime"`
+		ETime             string  `json:"etime"`
+	}
+)
+
+func (c *apiClient) GetClusterInfo(ctx context.Context) (ClusterInfo, error) {
+	info := ClusterInfo{}
+	err := c.do(ctx, "GET", "/v1/cluster", nil, &info)
+	return info, err
+}
+
+func (c *apiClient) GetClusterStats(ctx context.Context) (ClusterStats, error) {
+	stats := ClusterStats{}
+	err := c.do(ctx, "GET", "/v1/cluster/stats/last", nil, &stats)
+	return stats, err
+}
@@ -0,0 +1,79 @@
+package apiclient
+
+import "context"
+
+type (
+	// CRDB is an Active-Active database spread across several clusters.
+	// Only the fields that are set are sent, so that UpdateCRDB leaves
+	// the other ones as they are.
+	CRDB struct {
+		GUID       string         `json:"guid,omitempty"`
+		Name       string         `json:"name,omitempty"`
+		Encryption *bool          `json:"encryption,omitempty"`
+		Instances  []CRDBInstance `json:"instances,omitempty"`
+		// DefaultDBConfig holds the bdb settings shared by all the instances.
+		DefaultDBConfig *DatabaseSettings `json:"default_db_config,omitempty"`
+	}
+
+	CRDBInstance struct {
+		ID          int         `json:"id,omitempty"`
+		Cluster     CRDBCluster `json:"cluster"`
+		Compression int         `json:"compression,omitempty"`
+	}
+
+	CRDBCluster struct {
+		URL         string          `json:"url"`
+		Name        string          `json:"name"`
+		Credentials *CRDBCredential `json:"credentials,omitempty"`
+	}
+
+	CRDBCredential struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	// CRDBTask tracks an asynchronous CRDB operation.
+	CRDBTask struct {
+		ID       string `json:"id"`
+		Status   string `json:"status"`
+		CRDBGUID string `json:"crdb_guid"`
+	}
+)
+
+func (c *apiClient) ListCRDBs(ctx context.Context) ([]CRDB, error) {
+	crdbs := []CRDB{}
+	err := c.do(ctx, "GET", "/v1/crdbs", nil, &crdbs)
+	return crdbs, err
+}
+
+func (c *apiClient) GetCRDB(ctx context.Context, GUID string) (CRDB, error) {
+	crdb := CRDB{}
+	err := c.do(ctx, "GET", "/v1/crdbs/"+GUID, nil, &crdb)
+	return crdb, err
+}
+
+func (c *apiClient) CreateCRDB(ctx context.Context, crdb CRDB) (CRDBTask, error) {
+	task := CRDBTask{}
+	err := c.do(ctx, "POST", "/v1/crdbs", crdb, &task)
+	return task, err
+}
+
+// UpdateCRDB changes the settings of the CRDB that are set in crdb, the
+// instances are changed by the returned task.
+func (c *apiClient) UpdateCRDB(ctx context.Context, GUID string, crdb CRDB) (CRDBTask, error) {
+	task := CRDBTask{}
+	err := c.do(ctx, "PATCH", "/v1/crdbs/"+GUID, crdb, &task)
+	return task, err
+}
+
+func (c *apiClient) DeleteCRDB(ctx context.Context, GUID string) (CRDBTask, error) {
+	task := CRDBTask{}
+	err := c.do(ctx, "DELETE", "/v1/crdbs/"+GUID, nil, &task)
+	return task, err
+}
+
+func (c *apiClient) GetCRDBTask(ctx context.Context, ID string) (CRDBTask, error) {
+	task := CRDBTask{}
+	err := c.do(ctx, "GET", "/v1/crdb_tasks/"+ID, nil, &task)
+	return task, err
+}
@@ -0,0 +1,134 @@
+package apiclient_test
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	brokerconfig "github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CRDBs", func() {
+	var (
+		proxy    testing.HTTPProxy
+		api      crdbAPI
+		requests []request
+		ctx      = context.Background()
+		logger   = lager.NewLogger("test")
+		task     = map[string]interface{}{"id": "task-1", "status": "queued", "crdb_guid": "crdb-1"}
+	)
+
+	BeforeEach(func() {
+		proxy = testing.NewHTTPProxy()
+		requests = nil
+		api = apiclient.New(brokerconfig.Config{
+			Cluster: brokerconfig.ClusterConfig{
+				Address: proxy.URL(),
+			},
+		}, logger, nil)
+	})
+
+	AfterEach(func() {
+		proxy.Close()
+	})
+
+	It("Creates a CRDB spread across the clusters", func() {
+		proxy.RegisterEndpointHandler("/v1/crdbs", recordRequest(&requests, task))
+		created, err := api.CreateCRDB(ctx, apiclient.CRDB{
+			Name:       "cache",
+			Encryption: apiclient.Bool(true),
+			Instances: []apiclient.CRDBInstance{
+				{Cluster: apiclient.CRDBCluster{URL: "https://east:9443", Name: "east"}},
+				{Cluster: apiclient.CRDBCluster{
+					URL:         "https://west:9443",
+					Name:        "west",
+					Credentials: &apiclient.CRDBCredential{Username: "admin", Password: "secret"},
+				}},
+			},
+			DefaultDBConfig: &apiclient.DatabaseSettings{MemorySize: 1024},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created).To(Equal(apiclient.CRDBTask{ID: "task-1", Status: "queued", CRDBGUID: "crdb-1"}))
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Method).To(Equal("POST"))
+		Expect(requests[0].Body).To(MatchJSON(`{
+			"name": "cache",
+			"encryption": true,
+			"instances": [
+				{"cluster": {"url": "https://east:9443", "name": "east"}},
+				{"cluster": {"url": "https://west:9443", "name": "west", "credentials": {"username": "admin", "password": "secret"}}}
+			],
+			"default_db_config": {"memory_size": 1024}
+		}`))
+	})
+
+	It("Updates only the settings that are set", func() {
+		proxy.RegisterEndpointHandler("/v1/crdbs/crdb-1", recordRequest(&requests, task))
+		_, err := api.UpdateCRDB(ctx, "crdb-1", apiclient.CRDB{
+			DefaultDBConfig: &apiclient.DatabaseSettings{MemorySize: 2048},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Method).To(Equal("PATCH"))
+		Expect(requests[0].Body).To(MatchJSON(`{"default_db_config": {"memory_size": 2048}}`))
+	})
+
+	It("Gets and lists the CRDBs", func() {
+		crdb := map[string]interface{}{
+			"guid":       "crdb-1",
+			"name":       "cache",
+			"encryption": false,
+			"instances": []map[string]interface{}{
+				{"id": 1, "cluster": map[string]interface{}{"url": "https://east:9443", "name": "east"}},
+			},
+		}
+		proxy.RegisterEndpoints([]testing.Endpoint{
+			{URL: "/v1/crdbs", Response: []map[string]interface{}{crdb}},
+			{URL: "/v1/crdbs/crdb-1", Response: crdb},
+		})
+		expected := apiclient.CRDB{
+			GUID:       "crdb-1",
+			Name:       "cache",
+			Encryption: apiclient.Bool(false),
+			Instances: []apiclient.CRDBInstance{
+				{ID: 1, Cluster: apiclient.CRDBCluster{URL: "https://east:9443", Name: "east"}},
+			},
+		}
+		crdbs, err := api.ListCRDBs(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(crdbs).To(Equal([]apiclient.CRDB{expected}))
+		got, err := api.GetCRDB(ctx, "crdb-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(expected))
+	})
+
+	It("Deletes a CRDB and follows the task", func() {
+		proxy.RegisterEndpointHandler("/v1/crdbs/crdb-1", recordRequest(&requests, task))
+		proxy.RegisterEndpoints([]testing.Endpoint{{
+			URL:      "/v1/crdb_tasks/task-1",
+			Response: map[string]interface{}{"id": "task-1", "status": "finished", "crdb_guid": "crdb-1"},
+		}})
+		deleting, err := api.DeleteCRDB(ctx, "crdb-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Method).To(Equal("DELETE"))
+
+		finished, err := api.GetCRDBTask(ctx, deleting.ID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(finished.Status).To(Equal("finished"))
+	})
+})
+
+// crdbAPI is the part of the API client the CRDB specs use.
+type crdbAPI interface {
+	ListCRDBs(ctx context.Context) ([]apiclient.CRDB, error)
+	GetCRDB(ctx context.Context, GUID string) (apiclient.CRDB, error)
+	CreateCRDB(ctx context.Context, crdb apiclient.CRDB) (apiclient.CRDBTask, error)
+	UpdateCRDB(ctx context.Context, GUID string, crdb apiclient.CRDB) (apiclient.CRDBTask, error)
+	DeleteCRDB(ctx context.Context, GUID string) (apiclient.CRDBTask, error)
+	GetCRDBTask(ctx context.Context, ID string) (apiclient.CRDBTask, error)
+}
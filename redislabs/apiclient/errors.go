@@ -0,0 +1,44 @@
+package apiclient
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type errorResponse struct {
+	ErrorMessage string `json:"description"`
+	ErrorCode    string `json:"error_code"`
+}
+
+// Error is a failure reported by the cluster API.
+type Error struct {
+	StatusCode int
+	// Code is the error_code value returned by the cluster, eg db_not_exist.
+	// It is empty if the cluster has not provided one.
+	Code        string
+	Description string
+}
+
+func newError(statusCode int, payload errorResponse) *Error {
+	return &Error{
+		StatusCode:  statusCode,
+		Code:        payload.ErrorCode,
+		Description: payload.ErrorMessage,
+	}
+}
+
+func (e *Error) Error() string {
+	if e.Description != "" {
+		return e.Description
+	}
+	if e.Code != "" {
+		return fmt.Sprintf("the cluster has failed with %s (status %d)", e.Code, e.StatusCode)
+	}
+	return "an unknown server error occurred"
+}
+
+// IsNotFound tells whether the cluster does not know the requested entity.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,130 @@
+package fakes
+
+import (
+	"context"
+	"sync"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+)
+
+// FakeClient implements apiclient.Client without a cluster. Errors and watch
+// results are returned as configured, every call is recorded.
+type FakeClient struct {
+	lock sync.Mutex
+
+	CreatedSettings []apiclient.DatabaseSettings
+	UpdatedUIDs     []int
+	UpdatedSettings []apiclient.DatabaseSettings
+	DeletedUIDs     []int
+	WatchedUIDs     []int
+
+	CreateError error
+	UpdateError error
+	DeleteError error
+
+	// WatchResult is reported by every watch, including the one started
+	// on database creation.
+	WatchResult apiclient.WatchResult
+
+	Databases      map[int]apiclient.Database
+	DatabasesStats map[int]apiclient.DatabaseStats
+	DatabasesError error
+	Nodes          []apiclient.Node
+	NodesStats     map[int]apiclient.NodeStats
+	NodesError     error
+	ClusterInfo    apiclient.ClusterInfo
+	ClusterError   error
+}
+
+func (f *FakeClient) CreateDatabase(ctx context.Context, settings apiclient.DatabaseSettings) (<-chan apiclient.WatchResult, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.CreatedSettings = append(f.CreatedSettings, settings)
+	if f.CreateError != nil {
+		return nil, f.CreateError
+	}
+	return f.result(), nil
+}
+
+func (f *FakeClient) UpdateDatabase(ctx context.Context, UID int, settings apiclient.DatabaseSettings) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.UpdatedUIDs = append(f.UpdatedUIDs, UID)
+	f.UpdatedSettings = append(f.UpdatedSettings, settings)
+	return f.UpdateError
+}
+
+func (f *FakeClient) DeleteDatabase(ctx context.Context, UID int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.DeletedUIDs = append(f.DeletedUIDs, UID)
+	return f.DeleteError
+}
+
+func (f *FakeClient) WatchDatabase(ctx context.Context, UID int, target apiclient.WatchTarget) <-chan apiclient.WatchResult {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.WatchedUIDs = append(f.WatchedUIDs, UID)
+	return f.result()
+}
+
+func (f *FakeClient) result() <-chan apiclient.WatchResult {
+	ch := make(chan apiclient.WatchResult, 1)
+	ch <- f.WatchResult
+	close(ch)
+	return ch
+}
+
+func (f *FakeClient) GetDatabase(ctx context.Context, UID int) (apiclient.Database, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	database, ok := f.Databases[UID]
+	if !ok {
+		return apiclient.Database{}, &apiclient.Error{StatusCode: 404, Code: "db_not_exist"}
+	}
+	return database, nil
+}
+
+func (f *FakeClient) ListNodes(ctx context.Context) ([]apiclient.Node, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.Nodes, f.NodesError
+}
+
+func (f *FakeClient) GetNodesStats(ctx context.Context) (map[int]apiclient.NodeStats, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.NodesStats, f.NodesError
+}
+
+func (f *FakeClient) ListDatabases(ctx context.Context) ([]apiclient.Database, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	databases := []apiclient.Database{}
+	for _, database := range f.Databases {
+		databases = append(databases, database)
+	}
+	return databases, f.DatabasesError
+}
+
+func (f *FakeClient) GetDatabasesStats(ctx context.Context) (map[int]apiclient.DatabaseStats, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.DatabasesStats, f.DatabasesError
+}
+
+func (f *FakeClient) GetClusterInfo(ctx context.Context) (apiclient.ClusterInfo, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.ClusterInfo, f.ClusterError
+}
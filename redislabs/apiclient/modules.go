@@ -0,0 +1,23 @@
+package apiclient
+
+import "context"
+
+type Module struct {
+	UID          string   `json:"uid"`
+	Name         string   `json:"module_name"`
+	DisplayName  string   `json:"display_name"`
+	Version      string   `json:"semantic_version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+func (c *apiClient) ListModules(ctx context.Context) ([]Module, error) {
+	modules := []Module{}
+	err := c.do(ctx, "GET", "/v1/modules", nil, &modules)
+	return modules, err
+}
+
+func (c *apiClient) GetModule(ctx context.Context, UID string) (Module, error) {
+	module := Module{}
+	err := c.do(ctx, "GET", "/v1/modules/"+UID, nil, &module)
+	return module, err
+}
@@ -0,0 +1,72 @@
+package apiclient_test
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	brokerconfig "github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Modules", func() {
+	var (
+		proxy  testing.HTTPProxy
+		api    moduleAPI
+		ctx    = context.Background()
+		logger = lager.NewLogger("test")
+		search = map[string]interface{}{
+			"uid":              "2f1a",
+			"module_name":      "search",
+			"display_name":     "RediSearch 2",
+			"semantic_version": "2.8.4",
+			"capabilities":     []string{"replica_of", "clustering"},
+		}
+	)
+
+	BeforeEach(func() {
+		proxy = testing.NewHTTPProxy()
+		api = apiclient.New(brokerconfig.Config{
+			Cluster: brokerconfig.ClusterConfig{
+				Address: proxy.URL(),
+			},
+		}, logger, nil)
+		proxy.RegisterEndpoints([]testing.Endpoint{
+			{URL: "/v1/modules", Response: []map[string]interface{}{search}},
+			{URL: "/v1/modules/2f1a", Response: search},
+		})
+	})
+
+	AfterEach(func() {
+		proxy.Close()
+	})
+
+	expected := apiclient.Module{
+		UID:          "2f1a",
+		Name:         "search",
+		DisplayName:  "RediSearch 2",
+		Version:      "2.8.4",
+		Capabilities: []string{"replica_of", "clustering"},
+	}
+
+	It("Lists the modules installed in the cluster", func() {
+		modules, err := api.ListModules(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(modules).To(Equal([]apiclient.Module{expected}))
+	})
+
+	It("Gets a module", func() {
+		module, err := api.GetModule(ctx, "2f1a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(module).To(Equal(expected))
+	})
+})
+
+// moduleAPI is the part of the API client the module specs use.
+type moduleAPI interface {
+	ListModules(ctx context.Context) ([]apiclient.Module, error)
+	GetModule(ctx context.Context, UID string) (apiclient.Module, error)
+}
@@ -0,0 +1,61 @@
+package apiclient
+
+import (
+	"context"
+	"fmt"
+)
+
+type (
+	Node struct {
+		UID             int    `json:"uid"`
+		Address         string `json:"addr"`
+		Status          string `json:"status"`
+		TotalMemory     int64  `json:"total_memory"`
+		ShardCount      int    `json:"shard_count"`
+		MaxRedisServers int    `json:"max_redis_servers"`
+		Cores           int    `json:"cores"`
+		RackID          string `json:"rack_id"`
+		SoftwareVersion string `json:"software_version"`
+	}
+
+	// NodeStats are the last known metrics of a node. Memory is measured
+	// in bytes.
+	NodeStats struct {
+		FreeMemory        float64 `json:"free_memory"`
+		AvailableMemory   float64 `json:"available_memory"`
+		ProvisionalMemory float64 `json:"provisional_memory"`
+		TotalRequests     float64 `json:"total_req"`
+		Connections       float64 `json:"conns"`
+		STime             string  `json:"stime"`
+		ETime             string  `json:"etime"`
+	}
+)
+
+func (c *apiClient) ListNodes(ctx context.Context) ([]Node, error) {
+	nodes := []Node{}
+	err := c.do(ctx, "GET", "/v1/nodes", nil, &nodes)
+	return nodes, err
+}
+
+func (c *apiClient) GetNode(ctx context.Context, UID int) (Node, error) {
+	node := Node{}
+	err := c.do(ctx, "GET", fmt.Sprintf("/v1/nodes/%d", UID), nil, &node)
+	return node, err
+}
+
+// GetNodesStats returns the stats of every node keyed by the node UID.
+func (c *apiClient) GetNodesStats(ctx context.Context) (map[int]NodeStats, error) {
+	stats := map[string]NodeStats{}
+	if err := c.do(ctx, "GET", "/v1/nodes/stats/last", nil, &stats); err != nil {
+		return nil, err
+	}
+	statsByUID := map[int]NodeStats{}
+	for key, s := range stats {
+		var UID int
+		if _, err := fmt.Sscanf(key, "%d", &UID); err != nil {
+			return nil, fmt.Errorf("unexpected node UID %q in the node stats", key)
+		}
+		statsByUID[UID] = s
+	}
+	return statsByUID, nil
+}
@@ -0,0 +1,142 @@
+package apiclient
+
+import (
+	"context"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+)
+
+type (
+	// WatchTarget tells the watcher which database state to wait for.
+	WatchTarget int
+
+	// WatchOutcome is the final state of a watched database.
+	WatchOutcome int
+
+	// WatchResult is reported by the watcher exactly once.
+	WatchResult struct {
+		Outcome WatchOutcome
+		// Credentials are set when the database is active.
+		Credentials cluster.InstanceCredentials
+		// Reason describes why the database has failed, or the last
+		// polling failure when the watcher has timed out.
+		Reason string
+		// Err is the context error when the watcher has timed out.
+		Err error
+	}
+)
+
+const (
+	WaitForActive WatchTarget = iota
+	WaitForDeletion
+)
+
+const (
+	DatabaseActive WatchOutcome = iota
+	DatabaseFailed
+	DatabaseTimedOut
+	DatabaseDeleted
+)
+
+// Database statuses reported by the cluster.
+const (
+	statusActive         = "active"
+	statusCreationFailed = "creation-failed"
+)
+
+func (o WatchOutcome) String() string {
+	switch o {
+	case DatabaseActive:
+		return "active"
+	case DatabaseFailed:
+		return "failed"
+	case DatabaseTimedOut:
+		return "timed out"
+	case DatabaseDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// WatchDatabase polls the database status until it reaches the given target,
+// fails, disappears or the context is done. The result is sent to the returned
+// channel which is closed afterwards, so the watcher never outlives the context.
+func (c *apiClient) WatchDatabase(ctx context.Context, UID int, target WatchTarget) <-chan WatchResult {
+	return c.watch(ctx, UID, target, nil)
+}
+
+// watch is WatchDatabase that may start from an already known status
+// instead of polling the cluster right away.
+func (c *apiClient) watch(ctx context.Context, UID int, target WatchTarget, initial *Database) <-chan WatchResult {
+	ch := make(chan WatchResult, 1)
+	logger := c.logger.Session("watch-database", lager.Data{"UID": UID})
+
+	go func() {
+		defer close(ch)
+
+		var lastFailure string
+		status := initial
+		for {
+			if status != nil {
+				if result, done := c.evaluateStatus(*status, target); done {
+					logger.Info("The database has reached a final state", lager.Data{
+						"outcome": result.Outcome.String(),
+					})
+					ch <- result
+					return
+				}
+				select {
+				case <-time.After(c.pollingInterval()):
+				case <-ctx.Done():
+					logger.Info("Stopped watching the database", lager.Data{
+						"reason": ctx.Err().Error(),
+					})
+					ch <- WatchResult{Outcome: DatabaseTimedOut, Reason: lastFailure, Err: ctx.Err()}
+					return
+				}
+			}
+
+			database, err := c.GetDatabase(ctx, UID)
+			switch {
+			case IsNotFound(err):
+				ch <- WatchResult{Outcome: DatabaseDeleted}
+				return
+			case err != nil:
+				logger.Error("Failed to make a polling request", err)
+				lastFailure = err.Error()
+				status = &Database{UID: UID}
+			default:
+				status = &database
+			}
+		}
+	}()
+	return ch
+}
+
+// evaluateStatus tells whether the given status is final for the target.
+func (c *apiClient) evaluateStatus(status Database, target WatchTarget) (WatchResult, bool) {
+	if status.Status == statusCreationFailed {
+		return WatchResult{
+			Outcome: DatabaseFailed,
+			Reason:  "the cluster has failed to create the database",
+		}, true
+	}
+	if target != WaitForActive || status.Status != statusActive {
+		return WatchResult{}, false
+	}
+	port, err := c.parsePortFromDNSAddress(status.DNSAddress)
+	if err != nil {
+		return WatchResult{Outcome: DatabaseFailed, Reason: err.Error()}, true
+	}
+	return WatchResult{
+		Outcome: DatabaseActive,
+		Credentials: cluster.InstanceCredentials{
+			UID:      status.UID,
+			Port:     port,
+			IPList:   status.IPList,
+			Password: status.Password,
+		},
+	}, true
+}
@@ -0,0 +1,152 @@
+package apiclient_test
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+	brokerconfig "github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Database status watcher", func() {
+	var (
+		proxy    testing.HTTPProxy
+		config   brokerconfig.Config
+		statuses []interface{}
+		polls    int
+		ctx      context.Context
+		cancel   context.CancelFunc
+		logger   = lager.NewLogger("test")
+	)
+
+	// Every poll gets the next status from the list, the last one repeats.
+	// A nil status means the cluster does not know the database.
+	BeforeEach(func() {
+		polls = 0
+		proxy = testing.NewHTTPProxy()
+		proxy.RegisterEndpointHandler("/v1/bdbs/1", func(w http.ResponseWriter, r *http.Request) interface{} {
+			status := statuses[polls]
+			if polls < len(statuses)-1 {
+				polls++
+			}
+			if status == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return map[string]interface{}{"error_code": "db_not_exist"}
+			}
+			return status
+		})
+		config = brokerconfig.Config{
+			Cluster: brokerconfig.ClusterConfig{
+				Address: proxy.URL(),
+				Timeouts: brokerconfig.TimeoutsConfig{
+					PollingInterval: 5,
+				},
+			},
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	})
+
+	AfterEach(func() {
+		cancel()
+		proxy.Close()
+	})
+
+	watch := func(target apiclient.WatchTarget) apiclient.WatchResult {
+		ch := apiclient.New(config, logger, nil).WatchDatabase(ctx, 1, target)
+		var result apiclient.WatchResult
+		Eventually(ch).Should(Receive(&result))
+		Eventually(ch).Should(BeClosed())
+		return result
+	}
+
+	Context("Waiting for a database to become active", func() {
+		It("Reports the credentials once the database is active", func() {
+			statuses = []interface{}{
+				map[string]interface{}{"uid": 1, "status": "pending"},
+				map[string]interface{}{
+					"uid":                       1,
+					"status":                    "active",
+					"authentication_redis_pass": "pass",
+					"endpoint_ip":               []string{"10.0.2.4"},
+					"dns_address_master":        "domain.com:11909",
+				},
+			}
+			result := watch(apiclient.WaitForActive)
+			Expect(result.Outcome).To(Equal(apiclient.DatabaseActive))
+			Expect(result.Credentials).To(Equal(cluster.InstanceCredentials{
+				UID:      1,
+				Port:     11909,
+				IPList:   []string{"10.0.2.4"},
+				Password: "pass",
+			}))
+		})
+
+		It("Reports a failed creation", func() {
+			statuses = []interface{}{
+				map[string]interface{}{"uid": 1, "status": "creation-failed"},
+			}
+			result := watch(apiclient.WaitForActive)
+			Expect(result.Outcome).To(Equal(apiclient.DatabaseFailed))
+			Expect(result.Reason).NotTo(BeEmpty())
+		})
+
+		It("Reports an active database without a port as failed", func() {
+			statuses = []interface{}{
+				map[string]interface{}{"uid": 1, "status": "active", "dns_address_master": "domain.com"},
+			}
+			result := watch(apiclient.WaitForActive)
+			Expect(result.Outcome).To(Equal(apiclient.DatabaseFailed))
+		})
+
+		It("Reports a database that has disappeared", func() {
+			statuses = []interface{}{nil}
+			result := watch(apiclient.WaitForActive)
+			Expect(result.Outcome).To(Equal(apiclient.DatabaseDeleted))
+		})
+
+		It("Times out when the database stays pending", func() {
+			statuses = []interface{}{
+				map[string]interface{}{"uid": 1, "status": "pending"},
+			}
+			result := watch(apiclient.WaitForActive)
+			Expect(result.Outcome).To(Equal(apiclient.DatabaseTimedOut))
+			Expect(result.Err).To(Equal(context.DeadlineExceeded))
+		})
+
+		It("Keeps polling after a malformed response and times out with its reason", func() {
+			statuses = []interface{}{"not a status"}
+			result := watch(apiclient.WaitForActive)
+			Expect(result.Outcome).To(Equal(apiclient.DatabaseTimedOut))
+			Expect(result.Reason).NotTo(BeEmpty())
+		})
+
+		It("Stops when the context is cancelled", func() {
+			statuses = []interface{}{
+				map[string]interface{}{"uid": 1, "status": "pending"},
+			}
+			cancel()
+			result := watch(apiclient.WaitForActive)
+			Expect(result.Outcome).To(Equal(apiclient.DatabaseTimedOut))
+			Expect(result.Err).To(Equal(context.Canceled))
+		})
+	})
+
+	Context("Waiting for a database to be removed", func() {
+		It("Reports the removal once the cluster does not know the database", func() {
+			statuses = []interface{}{
+				map[string]interface{}{"uid": 1, "status": "active"},
+				map[string]interface{}{"uid": 1, "status": "delete-pending"},
+				nil,
+			}
+			result := watch(apiclient.WaitForDeletion)
+			Expect(result.Outcome).To(Equal(apiclient.DatabaseDeleted))
+		})
+	})
+})
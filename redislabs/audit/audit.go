@@ -0,0 +1,77 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type (
+	// Record describes a single mutating broker operation.
+	Record struct {
+		Time       time.Time `json:"time"`
+		RequestID  string    `json:"request_id,omitempty"`
+		Identity   *Identity `json:"identity,omitempty"`
+		Operation  string    `json:"operation"`
+		InstanceID string    `json:"instance_id"`
+		BindingID  string    `json:"binding_id,omitempty"`
+		PlanID     string    `json:"plan_id,omitempty"`
+		// Parameters are the ones the user has provided with the secrets
+		// masked.
+		Parameters interface{} `json:"parameters,omitempty"`
+		Outcome    string      `json:"outcome"`
+		Error      string      `json:"error,omitempty"`
+	}
+
+	// Sink keeps the audit records.
+	Sink interface {
+		Write(record Record) error
+	}
+
+	writerSink struct {
+		lock   sync.Mutex
+		writer io.Writer
+	}
+)
+
+// Outcomes of the audited operations.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+var auditFileMask = os.FileMode(0600)
+
+// NewWriterSink writes every record as a JSON line.
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{writer: w}
+}
+
+// NewFileSink appends the records to the file at the given path as JSON
+// lines, creating it if necessary. Existing records are never changed.
+func NewFileSink(path string) (Sink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, auditFileMask)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterSink(file), nil
+}
+
+func (s *writerSink) Write(record Record) error {
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// A single write keeps the line whole in the append-only file.
+	_, err = s.writer.Write(append(bytes, '\n'))
+	return err
+}
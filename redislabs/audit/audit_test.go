@@ -0,0 +1,131 @@
+package audit_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/audit"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/redact"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// base64 of {"user_id":"683ea748-3092-4ff4-b656-39cacc4d5360"}
+const identity = "cloudfoundry eyJ1c2VyX2lkIjoiNjgzZWE3NDgtMzA5Mi00ZmY0LWI2NTYtMzljYWNjNGQ1MzYwIn0="
+
+var _ = Describe("Audit", func() {
+	It("Parses the originating identity", func() {
+		id, err := audit.ParseIdentity(identity)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(id.Platform).To(Equal("cloudfoundry"))
+		Expect(id.UserID).To(Equal("683ea748-3092-4ff4-b656-39cacc4d5360"))
+
+		_, err = audit.ParseIdentity("cloudfoundry not-base64")
+		Expect(err).To(Equal(audit.ErrInvalidIdentity))
+	})
+
+	Describe("Recording the broker operations", func() {
+		var (
+			tmpDir  string
+			logPath string
+			server  *httptest.Server
+			broker  *fakes.FakeServiceBroker
+		)
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "redislabs-audit-test")
+			Expect(err).NotTo(HaveOccurred())
+			logPath = path.Join(tmpDir, "audit.log")
+			sink, err := audit.NewFileSink(logPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			logger := lager.NewLogger("test")
+			broker = &fakes.FakeServiceBroker{InstanceLimit: 3, ServiceID: "service", PlanID: "plan"}
+			audited := audit.NewBroker(broker, sink, redact.New(), logger)
+			api := brokerapi.New(audited, logger, brokerapi.BrokerCredentials{Username: "u", Password: "p"})
+			server = httptest.NewServer(audit.Middleware(api))
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.RemoveAll(tmpDir)
+		})
+
+		send := func(method string, url string, body string) {
+			req, err := http.NewRequest(method, server.URL+url, strings.NewReader(body))
+			Expect(err).NotTo(HaveOccurred())
+			req.SetBasicAuth("u", "p")
+			req.Header.Set(audit.OriginatingIdentityHeader, identity)
+			req.Header.Set(audit.RequestIdentityHeader, "request-1")
+			req.Header.Set("X-Broker-API-Version", "2.14")
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+		}
+
+		records := func() []audit.Record {
+			file, err := os.Open(logPath)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			records := []audit.Record{}
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				record := audit.Record{}
+				Expect(json.Unmarshal(scanner.Bytes(), &record)).To(Succeed())
+				records = append(records, record)
+			}
+			return records
+		}
+
+		It("Attributes a provisioning to the user and masks the secrets", func() {
+			send("PUT", "/v2/service_instances/instance-1", `{
+				"service_id": "service", "plan_id": "plan",
+				"parameters": {"name": "db", "authentication_redis_pass": "hunter2"}
+			}`)
+
+			recorded := records()
+			Expect(recorded).To(HaveLen(1))
+			r := recorded[0]
+			Expect(r.Operation).To(Equal("provision"))
+			Expect(r.InstanceID).To(Equal("instance-1"))
+			Expect(r.PlanID).To(Equal("plan"))
+			Expect(r.RequestID).To(Equal("request-1"))
+			Expect(r.Identity.UserID).To(Equal("683ea748-3092-4ff4-b656-39cacc4d5360"))
+			Expect(r.Outcome).To(Equal(audit.OutcomeSuccess))
+			Expect(r.Parameters).To(Equal(map[string]interface{}{
+				"name":                      "db",
+				"authentication_redis_pass": redact.Mask,
+			}))
+		})
+
+		It("Records failures and appends to the log", func() {
+			send("PUT", "/v2/service_instances/instance-1", `{"service_id": "service", "plan_id": "plan"}`)
+			send("DELETE", "/v2/service_instances/instance-2?service_id=service&plan_id=plan", "")
+
+			recorded := records()
+			Expect(recorded).To(HaveLen(2))
+			Expect(recorded[1].Operation).To(Equal("deprovision"))
+			Expect(recorded[1].Outcome).To(Equal(audit.OutcomeFailure))
+			Expect(recorded[1].Error).To(Equal(brokerapi.ErrInstanceDoesNotExist.Error()))
+		})
+
+		It("Does not record reading operations", func() {
+			send("GET", "/v2/catalog", "")
+			_, err := os.Stat(logPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(records()).To(BeEmpty())
+		})
+	})
+})
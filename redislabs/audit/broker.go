@@ -0,0 +1,123 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/redact"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+type auditedBroker struct {
+	brokerapi.ServiceBroker
+	sink     Sink
+	redactor *redact.Redactor
+	logger   lager.Logger
+}
+
+// NewBroker records every mutating operation of the given broker
+// in the sink.
+func NewBroker(broker brokerapi.ServiceBroker, sink Sink, redactor *redact.Redactor, logger lager.Logger) brokerapi.ServiceBroker {
+	return &auditedBroker{
+		ServiceBroker: broker,
+		sink:          sink,
+		redactor:      redactor,
+		logger:        logger,
+	}
+}
+
+func (b *auditedBroker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	spec, err := b.ServiceBroker.Provision(ctx, instanceID, details, asyncAllowed)
+	b.record(ctx, Record{
+		Operation:  "provision",
+		InstanceID: instanceID,
+		PlanID:     details.PlanID,
+		Parameters: parameters(details.RawParameters),
+	}, err)
+	return spec, err
+}
+
+func (b *auditedBroker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	spec, err := b.ServiceBroker.Update(ctx, instanceID, details, asyncAllowed)
+	b.record(ctx, Record{
+		Operation:  "update",
+		InstanceID: instanceID,
+		PlanID:     details.PlanID,
+		Parameters: parameters(details.RawParameters),
+	}, err)
+	return spec, err
+}
+
+func (b *auditedBroker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	spec, err := b.ServiceBroker.Deprovision(ctx, instanceID, details, asyncAllowed)
+	b.record(ctx, Record{
+		Operation:  "deprovision",
+		InstanceID: instanceID,
+		PlanID:     details.PlanID,
+	}, err)
+	return spec, err
+}
+
+func (b *auditedBroker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails, asyncAllowed bool) (brokerapi.Binding, error) {
+	binding, err := b.ServiceBroker.Bind(ctx, instanceID, bindingID, details, asyncAllowed)
+	b.record(ctx, Record{
+		Operation:  "bind",
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		PlanID:     details.PlanID,
+		Parameters: parameters(details.RawParameters),
+	}, err)
+	return binding, err
+}
+
+func (b *auditedBroker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails, asyncAllowed bool) (brokerapi.UnbindSpec, error) {
+	spec, err := b.ServiceBroker.Unbind(ctx, instanceID, bindingID, details, asyncAllowed)
+	b.record(ctx, Record{
+		Operation:  "unbind",
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		PlanID:     details.PlanID,
+	}, err)
+	return spec, err
+}
+
+// record completes the record from the context and the error and writes
+// it. A failure to write it is logged but does not fail the operation,
+// which has already happened.
+func (b *auditedBroker) record(ctx context.Context, record Record, err error) {
+	identity, requestID := FromContext(ctx)
+	record.Time = time.Now().UTC()
+	record.RequestID = requestID
+	if identity.Platform != "" {
+		record.Identity = &identity
+	}
+	if record.Parameters != nil {
+		record.Parameters = b.redactor.Value(record.Parameters)
+	}
+	record.Outcome = OutcomeSuccess
+	if err != nil {
+		record.Outcome = OutcomeFailure
+		record.Error = err.Error()
+	}
+	if err := b.sink.Write(record); err != nil {
+		b.logger.Error("Failed to write an audit record", err, lager.Data{
+			"operation":   record.Operation,
+			"instance-id": record.InstanceID,
+		})
+	}
+}
+
+// parameters decodes the raw parameters of a request. Empty ones are
+// dropped so that they are left out of the record.
+func parameters(raw json.RawMessage) interface{} {
+	var params map[string]interface{}
+	if len(raw) > 0 && json.Unmarshal(raw, &params) != nil {
+		return "unparseable parameters"
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	return params
+}
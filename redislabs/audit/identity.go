@@ -0,0 +1,80 @@
+package audit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Headers the platform sends along with every broker API request.
+const (
+	OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+	RequestIdentityHeader     = "X-Broker-API-Request-Identity"
+)
+
+var ErrInvalidIdentity = errors.New("the originating identity is not a platform followed by base64-encoded JSON")
+
+// Identity is the platform user on whose behalf the broker is called.
+type Identity struct {
+	Platform string `json:"platform"`
+	// UserID is the user_id property Cloud Foundry sends.
+	UserID string `json:"user_id,omitempty"`
+	// Properties is the decoded value as the platform has sent it.
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+type requestKey struct{}
+
+// request is what the middleware has learned about the caller.
+type request struct {
+	identity Identity
+	id       string
+}
+
+// ParseIdentity parses the value of the originating identity header,
+// a platform name and base64-encoded JSON separated by a space.
+func ParseIdentity(header string) (Identity, error) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return Identity{}, ErrInvalidIdentity
+	}
+	bytes, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Identity{}, ErrInvalidIdentity
+	}
+	identity := Identity{Platform: parts[0]}
+	if err = json.Unmarshal(bytes, &identity.Properties); err != nil {
+		return Identity{}, ErrInvalidIdentity
+	}
+	if userID, ok := identity.Properties["user_id"].(string); ok {
+		identity.UserID = userID
+	}
+	return identity, nil
+}
+
+// Middleware puts the originating identity and the request ID into the
+// request context so that the broker can attribute its operations.
+// A malformed identity is recorded as the platform "unknown".
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{id: r.Header.Get(RequestIdentityHeader)}
+		if header := r.Header.Get(OriginatingIdentityHeader); header != "" {
+			identity, err := ParseIdentity(header)
+			if err != nil {
+				identity = Identity{Platform: "unknown"}
+			}
+			req.identity = identity
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestKey{}, req)))
+	})
+}
+
+// FromContext returns the identity and the request ID the middleware
+// has found, both empty if there are none.
+func FromContext(ctx context.Context) (Identity, string) {
+	req, _ := ctx.Value(requestKey{}).(request)
+	return req.identity, req.id
+}
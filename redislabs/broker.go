@@ -1,29 +1,36 @@
 package redislabs
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math"
 	"strconv"
 
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/passwords"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
 	"github.com/pivotal-cf/brokerapi"
-	"github.com/pivotal-golang/lager"
 )
 
 type ServiceInstanceCreator interface {
-	Create(instanceID string, settings map[string]interface{}, persister persisters.StatePersister) error
-	Update(instanceID string, params map[string]interface{}, persister persisters.StatePersister) error
-	Destroy(instanceID string, persister persisters.StatePersister) error
-	InstanceExists(instanceID string, persister persisters.StatePersister) (bool, error)
+	Create(ctx context.Context, instanceID string, details persisters.InstanceDetails, settings apiclient.DatabaseSettings, persister persisters.StatePersister) error
+	// Update records the non-empty details along with the database update.
+	Update(ctx context.Context, instanceID string, details persisters.InstanceDetails, settings apiclient.DatabaseSettings, persister persisters.StatePersister) error
+	Destroy(ctx context.Context, instanceID string, persister persisters.StatePersister) error
+	// Database returns the database with the UID as the cluster reports it.
+	Database(ctx context.Context, UID int) (apiclient.Database, error)
+	InstanceExists(ctx context.Context, instanceID string, persister persisters.StatePersister) (bool, error)
 }
 
 type ServiceInstanceBinder interface {
-	Bind(instanceID string, bindingID string, persister persisters.StatePersister) (interface{}, error)
-	Unbind(instanceID string, bindingID string, persister persisters.StatePersister) error
-	InstanceExists(instanceID string, persister persisters.StatePersister) (bool, error)
+	Bind(ctx context.Context, instanceID string, bindingID string, persister persisters.StatePersister) (interface{}, error)
+	Unbind(ctx context.Context, instanceID string, bindingID string, persister persisters.StatePersister) error
+	// Binding returns the credentials of a binding made before.
+	Binding(ctx context.Context, instanceID string, bindingID string, persister persisters.StatePersister) (interface{}, error)
+	InstanceExists(ctx context.Context, instanceID string, persister persisters.StatePersister) (bool, error)
 }
 
 type serviceBroker struct {
@@ -55,7 +62,7 @@ func NewServiceBroker(
 	}
 }
 
-func (b *serviceBroker) Services() []brokerapi.Service {
+func (b *serviceBroker) Services(ctx context.Context) ([]brokerapi.Service, error) {
 	planList := []brokerapi.ServicePlan{}
 	for _, p := range b.planDescriptions() {
 		planList = append(planList, *p)
@@ -63,23 +70,25 @@ func (b *serviceBroker) Services() []brokerapi.Service {
 	b.Logger.Info("Serving a catalog request")
 	return []brokerapi.Service{
 		brokerapi.Service{
-			ID:            b.Config.ServiceBroker.ServiceID,
-			Name:          b.Config.ServiceBroker.Name,
-			Description:   b.Config.ServiceBroker.Description,
-			Bindable:      true,
-			Tags:          []string{"redislabs"},
-			Plans:         planList,
-			PlanUpdatable: true,
+			ID:                   b.Config.ServiceBroker.ServiceID,
+			Name:                 b.Config.ServiceBroker.Name,
+			Description:          b.Config.ServiceBroker.Description,
+			Bindable:             true,
+			InstancesRetrievable: true,
+			BindingsRetrievable:  true,
+			Tags:                 []string{"redislabs"},
+			Plans:                planList,
+			PlanUpdatable:        true,
 			Metadata: &brokerapi.ServiceMetadata{
 				DisplayName:         b.Config.ServiceBroker.Metadata.DisplayName,
 				ImageUrl:            b.Config.ServiceBroker.Metadata.Image,
 				ProviderDisplayName: b.Config.ServiceBroker.Metadata.ProviderDisplayName,
 			},
 		},
-	}
+	}, nil
 }
 
-func (b *serviceBroker) Provision(instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+func (b *serviceBroker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
 	if details.ServiceID != b.Config.ServiceBroker.ServiceID {
 		return brokerapi.ProvisionedServiceSpec{IsAsync: false}, ErrServiceDoesNotExist
 	}
@@ -104,84 +113,148 @@ func (b *serviceBroker) Provision(instanceID string, details brokerapi.Provision
 		return brokerapi.ProvisionedServiceSpec{IsAsync: false}, err
 	}
 
-	settings := map[string]interface{}{
-		"name": name,
-	}
-	// Record values coming from the plan.
-	for param, value := range planSettings {
-		settings[param] = value
-	}
+	// Start with the values coming from the plan.
+	settings := planSettings
+	settings.Name = name
 
-	// Record additional values. The name is excluded since we have
-	// set it already.
+	// Record additional values. The name is excluded since it has been
+	// used as the name prefix already.
+	settings.Extra = map[string]interface{}{}
 	for param, value := range provisionParameters {
-		settings[param] = castValue(value)
+		if param == "name" {
+			continue
+		}
+		settings.Extra[param] = castValue(value)
 	}
 
-	if _, ok := settings["authentication_redis_pass"]; !ok {
+	if _, ok := settings.Extra["authentication_redis_pass"]; !ok {
 		password, err := passwords.Generate(RedisPasswordLength)
 		if err != nil {
 			b.Logger.Error("Failed to generate a password", err)
 			return brokerapi.ProvisionedServiceSpec{IsAsync: false}, err
 		}
-		settings["authentication_redis_pass"] = password
+		settings.Password = password
 	}
 
-	return brokerapi.ProvisionedServiceSpec{IsAsync: false}, b.InstanceCreator.Create(instanceID, settings, b.StatePersister)
+	instanceDetails := persisters.InstanceDetails{
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+	}
+	err = b.InstanceCreator.Create(ctx, instanceID, instanceDetails, settings, b.StatePersister)
+	return brokerapi.ProvisionedServiceSpec{IsAsync: false}, translateClusterError(err)
 }
 
-func (b *serviceBroker) Update(instanceID string, updateDetails brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.IsAsync, error) {
+func (b *serviceBroker) Update(ctx context.Context, instanceID string, updateDetails brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
 	if updateDetails.ServiceID != b.Config.ServiceBroker.ServiceID {
-		return false, ErrServiceDoesNotExist
+		return brokerapi.UpdateServiceSpec{}, ErrServiceDoesNotExist
 	}
 
-	settings := b.planSettings()
-	params := map[string]interface{}{}
+	var updateParameters map[string]interface{}
+	if len(updateDetails.RawParameters) > 0 {
+		if err := json.Unmarshal(updateDetails.RawParameters, &updateParameters); err != nil {
+			return brokerapi.UpdateServiceSpec{}, brokerapi.ErrRawParamsInvalid
+		}
+	}
+
+	settings := apiclient.DatabaseSettings{}
+	details := persisters.InstanceDetails{}
 
 	if updateDetails.PlanID != updateDetails.PreviousValues.PlanID {
 		// If there is a request for a plan check whether it exists.
-		plan, ok := settings[updateDetails.PlanID]
+		plan, ok := b.planSettings()[updateDetails.PlanID]
 		if !ok {
-			return brokerapi.IsAsync(false), ErrPlanDoesNotExist
+			return brokerapi.UpdateServiceSpec{}, ErrPlanDoesNotExist
 		}
 		// Record parameters coming from the plan change.
-		for param, value := range plan {
-			params[param] = value
-		}
+		settings = plan
+		details.PlanID = updateDetails.PlanID
 	}
 
 	// Record additional parameters.
-	for param, value := range updateDetails.Parameters {
-		params[param] = castValue(value)
+	settings.Extra = map[string]interface{}{}
+	for param, value := range updateParameters {
+		settings.Extra[param] = castValue(value)
 	}
 
-	return brokerapi.IsAsync(false), b.InstanceCreator.Update(instanceID, params, b.StatePersister)
+	err := b.InstanceCreator.Update(ctx, instanceID, details, settings, b.StatePersister)
+	return brokerapi.UpdateServiceSpec{}, translateClusterError(err)
 }
 
-func (b *serviceBroker) Deprovision(instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.IsAsync, error) {
-	return false, b.InstanceCreator.Destroy(instanceID, b.StatePersister)
+func (b *serviceBroker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	err := b.InstanceCreator.Destroy(ctx, instanceID, b.StatePersister)
+	return brokerapi.DeprovisionServiceSpec{}, translateClusterError(err)
 }
 
-func (b *serviceBroker) Bind(instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+func (b *serviceBroker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails, asyncAllowed bool) (brokerapi.Binding, error) {
 	b.Logger.Info("Looking for the service credentials", lager.Data{
 		"instance-id": instanceID,
 		"binding-id":  bindingID,
 		"details":     details,
 	})
-	creds, err := b.InstanceBinder.Bind(instanceID, bindingID, b.StatePersister)
+	creds, err := b.InstanceBinder.Bind(ctx, instanceID, bindingID, b.StatePersister)
 	return brokerapi.Binding{Credentials: creds}, err
 }
 
 // Redis Labs cluster does not support multitenancy within a single
 // database. Therefore, the only goal of unbinding is to remove
-// credentials from the application environment. Unbind exists as a part
-// of the brokerapi.ServiceBroker interface and does not have to do
-// any specific job in this context.
-func (b *serviceBroker) Unbind(instanceID, bindingID string, details brokerapi.UnbindDetails) error {
-	return nil
+// credentials from the application environment, the broker merely
+// forgets the binding.
+func (b *serviceBroker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails, asyncAllowed bool) (brokerapi.UnbindSpec, error) {
+	return brokerapi.UnbindSpec{}, b.InstanceBinder.Unbind(ctx, instanceID, bindingID, b.StatePersister)
+}
+
+// GetInstance returns the plan of the instance and the settings its
+// database has in the cluster.
+func (b *serviceBroker) GetInstance(ctx context.Context, instanceID string) (brokerapi.GetInstanceDetailsSpec, error) {
+	state, err := b.StatePersister.Load()
+	if err != nil {
+		b.Logger.Error("Failed to load the broker state", err)
+		return brokerapi.GetInstanceDetailsSpec{}, err
+	}
+	var instance *persisters.ServiceInstance
+	for i := range state.AvailableInstances {
+		if state.AvailableInstances[i].ID == instanceID {
+			instance = &state.AvailableInstances[i]
+			break
+		}
+	}
+	if instance == nil {
+		return brokerapi.GetInstanceDetailsSpec{}, ErrInstanceNotFound
+	}
+	database, err := b.InstanceCreator.Database(ctx, instance.Credentials.UID)
+	if err != nil {
+		b.Logger.Error("Failed to get the database of the instance", err, lager.Data{
+			"instance-id": instanceID,
+		})
+		return brokerapi.GetInstanceDetailsSpec{}, translateClusterError(err)
+	}
+	return brokerapi.GetInstanceDetailsSpec{
+		ServiceID: b.Config.ServiceBroker.ServiceID,
+		PlanID:    instance.PlanID,
+		Parameters: map[string]interface{}{
+			"memory_size":      database.MemorySize,
+			"replication":      database.Replication,
+			"shards_count":     database.ShardsCount,
+			"data_persistence": database.DataPersistence,
+		},
+	}, nil
+}
+
+// GetBinding returns the credentials the binding has been given.
+func (b *serviceBroker) GetBinding(ctx context.Context, instanceID, bindingID string) (brokerapi.GetBindingSpec, error) {
+	creds, err := b.InstanceBinder.Binding(ctx, instanceID, bindingID, b.StatePersister)
+	if err == brokerapi.ErrInstanceDoesNotExist || err == brokerapi.ErrBindingDoesNotExist {
+		return brokerapi.GetBindingSpec{}, brokerapi.ErrBindingNotFound
+	}
+	return brokerapi.GetBindingSpec{Credentials: creds}, err
+}
+
+func (b *serviceBroker) LastOperation(ctx context.Context, instanceID string, details brokerapi.PollDetails) (brokerapi.LastOperation, error) {
+	return brokerapi.LastOperation{}, nil
 }
 
-func (b *serviceBroker) LastOperation(instanceID string) (brokerapi.LastOperation, error) {
+func (b *serviceBroker) LastBindingOperation(ctx context.Context, instanceID, bindingID string, details brokerapi.PollDetails) (brokerapi.LastOperation, error) {
 	return brokerapi.LastOperation{}, nil
 }
 
@@ -200,28 +273,28 @@ func (b *serviceBroker) planDescriptions() map[string]*brokerapi.ServicePlan {
 	return plansByID
 }
 
-func (b *serviceBroker) planSettings() map[string]map[string]interface{} {
-	settingsByID := map[string]map[string]interface{}{}
+func (b *serviceBroker) planSettings() map[string]apiclient.DatabaseSettings {
+	settingsByID := map[string]apiclient.DatabaseSettings{}
 	for _, plan := range b.Config.ServiceBroker.Plans {
 		config := plan.ServiceInstanceConfig
-		settings := map[string]interface{}{
-			"memory_size":        config.MemoryLimit,
-			"replication":        config.Replication,
-			"shards_count":       config.ShardCount,
-			"sharding":           config.ShardCount > 1,
-			"implicit_shard_key": config.ShardCount > 1,
-			"data_persistence":   config.Persistence,
+		settings := apiclient.DatabaseSettings{
+			MemorySize:       config.MemoryLimit,
+			Replication:      apiclient.Bool(config.Replication),
+			ShardsCount:      config.ShardCount,
+			Sharding:         apiclient.Bool(config.ShardCount > 1),
+			ImplicitShardKey: apiclient.Bool(config.ShardCount > 1),
+			DataPersistence:  config.Persistence,
 		}
 		if config.ShardCount > 1 {
-			settings["shard_key_regex"] = []map[string]string{
-				{"regex": `.*\{(?<tag>.*)\}.*`},
-				{"regex": `(?<tag>.*)`},
+			settings.ShardKeyRegex = []apiclient.ShardKeyRegex{
+				{Regex: `.*\{(?<tag>.*)\}.*`},
+				{Regex: `(?<tag>.*)`},
 			}
 		}
 		if config.Persistence == "snapshot" {
-			settings["snapshot_policy"] = []map[string]int{{
-				"writes": config.Snapshot.Writes,
-				"secs":   config.Snapshot.Secs,
+			settings.SnapshotPolicy = []apiclient.SnapshotPolicy{{
+				Writes: config.Snapshot.Writes,
+				Secs:   config.Snapshot.Secs,
 			}}
 		}
 		settingsByID[plan.ID] = settings
@@ -1,12 +1,16 @@
 package redislabs_test
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
 	brokerconfig "github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
@@ -15,7 +19,6 @@ import (
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/testing"
 	"github.com/pivotal-cf/brokerapi"
-	"github.com/pivotal-golang/lager"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -27,6 +30,15 @@ var _ = Describe("Broker", func() {
 		config    brokerconfig.Config
 		persister persisters.StatePersister
 		logger    = lager.NewLogger("test") // does not actually log anything
+		ctx       = context.Background()
+
+		// A cluster with plenty of free memory and shards.
+		clusterNodes = []map[string]interface{}{
+			{"uid": 1, "total_memory": 1 << 34, "shard_count": 0, "max_redis_servers": 100},
+		}
+		clusterNodesStats = map[string]interface{}{
+			"1": map[string]interface{}{"provisional_memory": 1 << 34},
+		}
 	)
 
 	JustBeforeEach(func() {
@@ -39,6 +51,12 @@ var _ = Describe("Broker", func() {
 		)
 	})
 
+	catalog := func() []brokerapi.Service {
+		services, err := broker.Services(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		return services
+	}
+
 	Describe("Looking for plans", func() {
 		Context("Given a config with one default plan", func() {
 			BeforeEach(func() {
@@ -55,8 +73,8 @@ var _ = Describe("Broker", func() {
 				}
 			})
 			It("Offers a service with at least one plan to use", func() {
-				Expect(len(broker.Services())).To(Equal(1))
-				Expect(len(broker.Services()[0].Plans)).ToNot(Equal(0))
+				Expect(len(catalog())).To(Equal(1))
+				Expect(len(catalog()[0].Plans)).ToNot(Equal(0))
 			})
 		})
 	})
@@ -98,7 +116,7 @@ var _ = Describe("Broker", func() {
 				})
 
 				It("Rejects to create an instance", func() {
-					_, err := broker.Provision("some-id", details, false)
+					_, err := broker.Provision(ctx, "some-id", details, false)
 					Expect(err).To(HaveOccurred())
 					Expect(err).To(Equal(redislabs.ErrServiceDoesNotExist))
 				})
@@ -115,7 +133,7 @@ var _ = Describe("Broker", func() {
 				})
 
 				It("Rejects to create an instance", func() {
-					_, err := broker.Provision("some-id", details, false)
+					_, err := broker.Provision(ctx, "some-id", details, false)
 					Expect(err).To(HaveOccurred())
 					Expect(err).To(Equal(redislabs.ErrPlanDoesNotExist))
 				})
@@ -155,6 +173,10 @@ var _ = Describe("Broker", func() {
 							"status":                    "active",
 						}
 					})
+					proxy.RegisterEndpoints([]testing.Endpoint{
+						{URL: "/v1/nodes", Response: clusterNodes},
+						{URL: "/v1/nodes/stats/last", Response: clusterNodesStats},
+					})
 					config.Cluster.Address = proxy.URL()
 
 					config.ServiceBroker.Plans[0].ServiceInstanceConfig = brokerconfig.ServiceInstanceConfig{
@@ -170,7 +192,7 @@ var _ = Describe("Broker", func() {
 				})
 
 				It("Creates an instance of the configured default plan", func() {
-					_, err := broker.Provision("some-id", details, false)
+					_, err := broker.Provision(ctx, "some-id", details, false)
 					Expect(err).ToNot(HaveOccurred())
 					Expect(settings).To(HaveKey("memory_size"))
 					Expect(settings["memory_size"]).To(Equal(float64(1024)))
@@ -185,13 +207,13 @@ var _ = Describe("Broker", func() {
 				})
 
 				It("Rejects to provision the same instance again", func() {
-					broker.Provision("some-id", details, false)
-					_, err := broker.Provision("some-id", details, false)
+					broker.Provision(ctx, "some-id", details, false)
+					_, err := broker.Provision(ctx, "some-id", details, false)
 					Expect(err).To(HaveOccurred())
 				})
 
 				It("Saves the credentials properly", func() {
-					_, err := broker.Provision("some-id", details, false)
+					_, err := broker.Provision(ctx, "some-id", details, false)
 					Expect(err).ToNot(HaveOccurred())
 
 					state, err := persister.Load()
@@ -205,13 +227,14 @@ var _ = Describe("Broker", func() {
 						IPList:   []string{"10.0.2.4"},
 						Password: "pass",
 					}))
+					Expect(s.PlanID).To(Equal(planID))
 				})
 
 				Context("When optional attributues given", func() {
 					Context("name", func() {
 						It("works", func() {
 							details.RawParameters = []byte(`{"name": "mydb"}`)
-							_, err := broker.Provision("some-id", details, false)
+							_, err := broker.Provision(ctx, "some-id", details, false)
 							Expect(err).ToNot(HaveOccurred())
 						})
 					})
@@ -219,13 +242,13 @@ var _ = Describe("Broker", func() {
 					Context("memory_size", func() {
 						It("works when value is integer", func() {
 							details.RawParameters = []byte(`{"memory_size": 1024}`)
-							_, err := broker.Provision("some-id", details, false)
+							_, err := broker.Provision(ctx, "some-id", details, false)
 							Expect(err).ToNot(HaveOccurred())
 						})
 
 						It("works when value is string", func() {
 							details.RawParameters = []byte(`{"memory_size": "1024"}`)
-							_, err := broker.Provision("some-id", details, false)
+							_, err := broker.Provision(ctx, "some-id", details, false)
 							Expect(err).ToNot(HaveOccurred())
 						})
 					})
@@ -239,7 +262,7 @@ var _ = Describe("Broker", func() {
 						}
 					})
 					It("Setups the sharding properly", func() {
-						_, err := broker.Provision("some-id", details, false)
+						_, err := broker.Provision(ctx, "some-id", details, false)
 						Expect(err).NotTo(HaveOccurred())
 						Expect(settings).To(HaveKey("memory_size"))
 						Expect(settings["memory_size"]).To(Equal(float64(2048)))
@@ -268,7 +291,7 @@ var _ = Describe("Broker", func() {
 						}
 					})
 					It("Applies the given snapshot configuration", func() {
-						_, err := broker.Provision("some-id", details, false)
+						_, err := broker.Provision(ctx, "some-id", details, false)
 						Expect(err).NotTo(HaveOccurred())
 						Expect(settings).To(HaveKey("data_persistence"))
 						Expect(settings["data_persistence"]).To(Equal("snapshot"))
@@ -280,6 +303,59 @@ var _ = Describe("Broker", func() {
 					})
 				})
 			})
+
+			Context("When the database does not become active", func() {
+				var (
+					tmpStateDir string
+					proxy       testing.HTTPProxy
+					err         error
+				)
+
+				BeforeEach(func() {
+					details = brokerapi.ProvisionDetails{
+						ServiceID: serviceID,
+						PlanID:    planID,
+					}
+					tmpStateDir, err = ioutil.TempDir("", "redislabs-state-test")
+					Expect(err).NotTo(HaveOccurred())
+					persister = persisters.NewLocalPersister(path.Join(tmpStateDir, "state.json"))
+
+					proxy = testing.NewHTTPProxy()
+					proxy.RegisterEndpoints([]testing.Endpoint{{
+						URL: "/",
+						Response: map[string]interface{}{
+							"uid":    1,
+							"status": "pending",
+						},
+					}})
+					config.Cluster.Address = proxy.URL()
+					config.Cluster.Timeouts = brokerconfig.TimeoutsConfig{
+						Database:        1,
+						PollingInterval: 10,
+					}
+				})
+
+				AfterEach(func() {
+					proxy.Close()
+					os.RemoveAll(tmpStateDir)
+				})
+
+				It("Gives up after the configured timeout", func() {
+					_, err := broker.Provision(ctx, "some-id", details, false)
+					Expect(err).To(Equal(instancecreators.ErrCreateDatabaseTimeoutExpired))
+				})
+
+				It("Gives up when the request is cancelled", func() {
+					cancelled, cancel := context.WithCancel(ctx)
+					cancel()
+					_, err := broker.Provision(cancelled, "some-id", details, false)
+					Expect(err).To(HaveOccurred())
+
+					state, err := persister.Load()
+					Expect(err).NotTo(HaveOccurred())
+					Expect(state.AvailableInstances).To(BeEmpty())
+				})
+			})
 		})
 	})
 
@@ -296,7 +372,7 @@ var _ = Describe("Broker", func() {
 		})
 		Context("When there are no provisioned instances", func() {
 			It("Rejects to bind anything", func() {
-				_, err := broker.Bind("instance-id", "binding-id", details)
+				_, err := broker.Bind(ctx, "instance-id", "binding-id", details, false)
 				Expect(err).To(HaveOccurred())
 				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
 			})
@@ -334,7 +410,7 @@ var _ = Describe("Broker", func() {
 				os.RemoveAll(tmpStateDir)
 			})
 			It("Successfully retrieves the credentials", func() {
-				brokerapiBinding, err := broker.Bind("test-instance", "test-binding", details)
+				brokerapiBinding, err := broker.Bind(ctx, "test-instance", "test-binding", details, false)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(brokerapiBinding.Credentials).To(Equal(map[string]interface{}{
 					"port":     11909,
@@ -342,6 +418,47 @@ var _ = Describe("Broker", func() {
 					"password": "pass",
 				}))
 			})
+			It("Returns the credentials of the binding on request", func() {
+				_, err := broker.Bind(ctx, "test-instance", "test-binding", details, false)
+				Expect(err).NotTo(HaveOccurred())
+				binding, err := broker.GetBinding(ctx, "test-instance", "test-binding")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.Credentials).To(Equal(map[string]interface{}{
+					"port":     11909,
+					"ip_list":  []string{"10.0.2.5"},
+					"password": "pass",
+				}))
+			})
+			It("Binds again with the same credentials", func() {
+				_, err := broker.Bind(ctx, "test-instance", "test-binding", details, false)
+				Expect(err).NotTo(HaveOccurred())
+				binding, err := broker.Bind(ctx, "test-instance", "test-binding", details, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.Credentials).To(HaveKeyWithValue("password", "pass"))
+				state, err := persister.Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(state.Bindings).To(Equal([]persisters.ServiceBinding{
+					{ID: "test-binding", InstanceID: "test-instance"},
+				}))
+			})
+			It("Does not return the credentials of an unknown binding", func() {
+				_, err := broker.GetBinding(ctx, "test-instance", "test-binding")
+				Expect(err).To(Equal(brokerapi.ErrBindingNotFound))
+				_, err = broker.GetBinding(ctx, "unknown-instance", "test-binding")
+				Expect(err).To(Equal(brokerapi.ErrBindingNotFound))
+			})
+			It("Forgets the binding on unbinding", func() {
+				_, err := broker.Bind(ctx, "test-instance", "test-binding", details, false)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = broker.Unbind(ctx, "test-instance", "test-binding", brokerapi.UnbindDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = broker.GetBinding(ctx, "test-instance", "test-binding")
+				Expect(err).To(Equal(brokerapi.ErrBindingNotFound))
+			})
+			It("Unbinds the bindings made before they have been recorded", func() {
+				_, err := broker.Unbind(ctx, "test-instance", "old-binding", brokerapi.UnbindDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+			})
 		})
 	})
 
@@ -351,7 +468,7 @@ var _ = Describe("Broker", func() {
 		)
 		Context("When there are no provisioned instances", func() {
 			It("Deprovisioning results in a failure", func() {
-				_, err = broker.Deprovision("instance-id", brokerapi.DeprovisionDetails{}, false)
+				_, err = broker.Deprovision(ctx, "instance-id", brokerapi.DeprovisionDetails{}, false)
 				Expect(err).To(HaveOccurred())
 				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
 			})
@@ -375,13 +492,22 @@ var _ = Describe("Broker", func() {
 							Credentials: cluster.InstanceCredentials{},
 						},
 					},
+					Bindings: []persisters.ServiceBinding{
+						{ID: "test-binding", InstanceID: "test-instance"},
+					},
 				}
 				if err = persister.Save(state); err != nil {
 					panic(err)
 				}
 
 				proxy = testing.NewHTTPProxy()
-				proxy.RegisterEndpoints([]testing.Endpoint{{"/", ""}})
+				proxy.RegisterEndpointHandler("/", func(w http.ResponseWriter, r *http.Request) interface{} {
+					if r.Method == "GET" {
+						// The database is gone once it has been deleted.
+						w.WriteHeader(http.StatusNotFound)
+					}
+					return ""
+				})
 				config.Cluster.Address = proxy.URL()
 			})
 			AfterEach(func() {
@@ -389,9 +515,12 @@ var _ = Describe("Broker", func() {
 				os.RemoveAll(tmpStateDir)
 			})
 			It("Can delete it successfully", func() {
-				_, err = broker.Deprovision("test-instance", brokerapi.DeprovisionDetails{}, false)
+				_, err = broker.Deprovision(ctx, "test-instance", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+				state, err = persister.Load()
 				Expect(err).NotTo(HaveOccurred())
-				_, err = broker.Deprovision("test-instance", brokerapi.DeprovisionDetails{}, false)
+				Expect(state.Bindings).To(BeEmpty())
+				_, err = broker.Deprovision(ctx, "test-instance", brokerapi.DeprovisionDetails{}, false)
 				Expect(err).To(HaveOccurred())
 			})
 		})
@@ -400,7 +529,7 @@ var _ = Describe("Broker", func() {
 	Describe("Updating instances", func() {
 		Context("When the broker does not offer any services", func() {
 			It("An update fails", func() {
-				_, err := broker.Update("test-instance", brokerapi.UpdateDetails{}, false)
+				_, err := broker.Update(ctx, "test-instance", brokerapi.UpdateDetails{}, false)
 				Expect(err).To(HaveOccurred())
 				Expect(err).To(Equal(redislabs.ErrServiceDoesNotExist))
 			})
@@ -414,7 +543,7 @@ var _ = Describe("Broker", func() {
 				}
 			})
 			It("Fails", func() {
-				_, err := broker.Update("test-instance", brokerapi.UpdateDetails{ServiceID: "test-service"}, false)
+				_, err := broker.Update(ctx, "test-instance", brokerapi.UpdateDetails{ServiceID: "test-service"}, false)
 				Expect(err).To(HaveOccurred())
 				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
 			})
@@ -435,15 +564,24 @@ var _ = Describe("Broker", func() {
 				persister = persisters.NewLocalPersister(path.Join(tmpStateDir, "state.json"))
 
 				proxy = testing.NewHTTPProxy()
-				proxy.RegisterEndpoints([]testing.Endpoint{
-					{"/v1/bdbs", map[string]interface{}{
+				proxy.RegisterEndpoints([]testing.Endpoint{{
+					URL: "/v1/bdbs",
+					Response: map[string]interface{}{
 						"uid": 1,
 						"authentication_redis_pass": "pass",
 						"endpoint_ip":               []string{"10.0.2.4"},
 						"dns_address_master":        "domain.com:11909",
 						"status":                    "active",
-					}}})
+					},
+				}})
 				proxy.RegisterEndpointHandler("/v1/bdbs/1", func(w http.ResponseWriter, r *http.Request) interface{} {
+					if r.Method == "GET" {
+						return map[string]interface{}{
+							"uid":                1,
+							"dns_address_master": "domain.com:11909",
+							"status":             "active",
+						}
+					}
 					bytes, err := ioutil.ReadAll(r.Body)
 					if err != nil {
 						panic(err)
@@ -497,7 +635,7 @@ var _ = Describe("Broker", func() {
 				os.RemoveAll(tmpStateDir)
 			})
 			JustBeforeEach(func() {
-				_, err = broker.Provision("test-instance", brokerapi.ProvisionDetails{
+				_, err = broker.Provision(ctx, "test-instance", brokerapi.ProvisionDetails{
 					ServiceID:        "test-service",
 					PlanID:           "test-plan-1",
 					OrganizationGUID: "",
@@ -509,22 +647,23 @@ var _ = Describe("Broker", func() {
 				}
 			})
 			It("Updates its memory limit", func() {
-				_, err = broker.Update("test-instance", brokerapi.UpdateDetails{
-					ServiceID: "test-service",
-					Parameters: map[string]interface{}{
-						"memory_size": 400000000,
-					},
+				_, err = broker.Update(ctx, "test-instance", brokerapi.UpdateDetails{
+					ServiceID:     "test-service",
+					RawParameters: []byte(`{"memory_size": 400000000}`),
 				}, false)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(updateSettings).To(HaveKey("memory_size"))
 				Expect(updateSettings["memory_size"]).To(BeEquivalentTo(400000000))
 			})
 			It("Updates its plan", func() {
-				_, err = broker.Update("test-instance", brokerapi.UpdateDetails{
+				_, err = broker.Update(ctx, "test-instance", brokerapi.UpdateDetails{
 					ServiceID: "test-service",
 					PlanID:    "test-plan-2",
 				}, false)
 				Expect(err).NotTo(HaveOccurred())
+				state, err := persister.Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(state.AvailableInstances[0].PlanID).To(Equal("test-plan-2"))
 				Expect(updateSettings).To(HaveKey("memory_size"))
 				Expect(updateSettings["memory_size"]).To(BeEquivalentTo(700000000))
 				Expect(updateSettings).To(HaveKey("replication"))
@@ -549,13 +688,10 @@ var _ = Describe("Broker", func() {
 				Expect(s["writes"]).To(BeEquivalentTo(100))
 			})
 			It("Updates both its plan and other parameters", func() {
-				_, err = broker.Update("test-instance", brokerapi.UpdateDetails{
-					ServiceID: "test-service",
-					PlanID:    "test-plan-2",
-					Parameters: map[string]interface{}{
-						"memory_size":      300000000,
-						"data_persistence": "aof",
-					},
+				_, err = broker.Update(ctx, "test-instance", brokerapi.UpdateDetails{
+					ServiceID:     "test-service",
+					PlanID:        "test-plan-2",
+					RawParameters: []byte(`{"memory_size": 300000000, "data_persistence": "aof"}`),
 				}, false)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(updateSettings).To(HaveKey("memory_size"))
@@ -568,7 +704,7 @@ var _ = Describe("Broker", func() {
 				Expect(updateSettings["data_persistence"]).To(BeEquivalentTo("aof"))
 			})
 			It("Rejects to update it to an unknown plan", func() {
-				_, err = broker.Update("test-instance", brokerapi.UpdateDetails{
+				_, err = broker.Update(ctx, "test-instance", brokerapi.UpdateDetails{
 					ServiceID: "test-service",
 					PlanID:    "test-plan-3",
 				}, false)
@@ -578,6 +714,268 @@ var _ = Describe("Broker", func() {
 		})
 	})
 
+	Describe("Reporting cluster failures", func() {
+		var (
+			tmpStateDir string
+			proxy       testing.HTTPProxy
+			status      int
+			errorCode   string
+			err         error
+			details     = brokerapi.ProvisionDetails{
+				ServiceID: "test-service",
+				PlanID:    "test-plan",
+			}
+		)
+
+		BeforeEach(func() {
+			tmpStateDir, err = ioutil.TempDir("", "redislabs-state-test")
+			Expect(err).NotTo(HaveOccurred())
+			persister = persisters.NewLocalPersister(path.Join(tmpStateDir, "state.json"))
+
+			proxy = testing.NewHTTPProxy()
+			proxy.RegisterEndpointHandler("/v1/bdbs", func(w http.ResponseWriter, r *http.Request) interface{} {
+				w.WriteHeader(status)
+				return map[string]interface{}{
+					"error_code":  errorCode,
+					"description": "the cluster says no",
+				}
+			})
+			config = brokerconfig.Config{
+				ServiceBroker: brokerconfig.ServiceBrokerConfig{
+					ServiceID: "test-service",
+					Plans:     []brokerconfig.ServicePlanConfig{{ID: "test-plan"}},
+				},
+				Cluster: brokerconfig.ClusterConfig{
+					Address: proxy.URL(),
+				},
+			}
+		})
+
+		AfterEach(func() {
+			proxy.Close()
+			os.RemoveAll(tmpStateDir)
+		})
+
+		failure := func(err error) *brokerapi.FailureResponse {
+			Expect(err).To(BeAssignableToTypeOf(&brokerapi.FailureResponse{}))
+			return err.(*brokerapi.FailureResponse)
+		}
+
+		It("Rejects a database that does not fit into the cluster with 422", func() {
+			status, errorCode = http.StatusBadRequest, "insufficient_resources"
+			_, err := broker.Provision(ctx, "some-id", details, false)
+			Expect(failure(err).ValidatedStatusCode(nil)).To(Equal(422))
+			Expect(err.Error()).To(ContainSubstring("the cluster says no"))
+		})
+
+		It("Rejects a taken database name with 409", func() {
+			status, errorCode = http.StatusConflict, "name_conflict"
+			_, err := broker.Provision(ctx, "some-id", details, false)
+			Expect(failure(err).ValidatedStatusCode(nil)).To(Equal(http.StatusConflict))
+		})
+
+		It("Serves the failures through the broker API with their status and description", func() {
+			api := brokerapi.New(broker, logger, brokerapi.BrokerCredentials{Username: "u", Password: "p"})
+			provision := func() *httptest.ResponseRecorder {
+				req, err := http.NewRequest("PUT", "/v2/service_instances/some-id", strings.NewReader(`{"service_id": "test-service", "plan_id": "test-plan"}`))
+				Expect(err).NotTo(HaveOccurred())
+				req.SetBasicAuth("u", "p")
+				req.Header.Set("X-Broker-API-Version", "2.14")
+				res := httptest.NewRecorder()
+				api.ServeHTTP(res, req)
+				return res
+			}
+
+			status, errorCode = http.StatusBadRequest, "insufficient_resources"
+			res := provision()
+			Expect(res.Code).To(Equal(422))
+			Expect(res.Body.String()).To(ContainSubstring("the cluster says no"))
+
+			status, errorCode = http.StatusConflict, "name_conflict"
+			Expect(provision().Code).To(Equal(http.StatusConflict))
+		})
+
+		It("Tells the developer to contact the operator when the cluster rejects the broker credentials", func() {
+			status, errorCode = http.StatusUnauthorized, ""
+			_, err := broker.Provision(ctx, "some-id", details, false)
+			Expect(failure(err).ValidatedStatusCode(nil)).To(Equal(http.StatusInternalServerError))
+			Expect(err.Error()).To(Equal(redislabs.ErrClusterAuthFailed.Error()))
+		})
+
+		Context("When the cluster is short of memory", func() {
+			var requested bool
+
+			BeforeEach(func() {
+				requested = false
+				proxy.RegisterEndpointHandler("/v1/bdbs/", func(w http.ResponseWriter, r *http.Request) interface{} {
+					requested = true
+					return nil
+				})
+				proxy.RegisterEndpoints([]testing.Endpoint{
+					{URL: "/v1/nodes", Response: []map[string]interface{}{
+						{"uid": 1, "total_memory": 4096, "shard_count": 0, "max_redis_servers": 10},
+						{"uid": 2, "total_memory": 4096, "shard_count": 0, "max_redis_servers": 10},
+					}},
+					{URL: "/v1/nodes/stats/last", Response: map[string]interface{}{
+						"1": map[string]interface{}{"provisional_memory": 1024},
+						"2": map[string]interface{}{"provisional_memory": 1024},
+					}},
+				})
+				status, errorCode = http.StatusInternalServerError, ""
+			})
+
+			It("Rejects a replicated database with 422 before asking the cluster", func() {
+				config.ServiceBroker.Plans[0].ServiceInstanceConfig = brokerconfig.ServiceInstanceConfig{
+					MemoryLimit: 1536,
+					Replication: true,
+				}
+				_, err := broker.Provision(ctx, "some-id", details, false)
+				Expect(failure(err).ValidatedStatusCode(nil)).To(Equal(422))
+				Expect(err.Error()).To(ContainSubstring("3072 bytes of memory"))
+				Expect(requested).To(BeFalse())
+			})
+
+			Context("And a headroom is configured", func() {
+				BeforeEach(func() {
+					config.Cluster.Capacity.Headroom = 25
+				})
+
+				It("Keeps the headroom in reserve", func() {
+					config.ServiceBroker.Plans[0].ServiceInstanceConfig = brokerconfig.ServiceInstanceConfig{
+						MemoryLimit: 1024,
+					}
+					_, err := broker.Provision(ctx, "some-id", details, false)
+					Expect(failure(err).ValidatedStatusCode(nil)).To(Equal(422))
+				})
+			})
+
+			It("Lets a database that fits through to the cluster", func() {
+				config.ServiceBroker.Plans[0].ServiceInstanceConfig = brokerconfig.ServiceInstanceConfig{
+					MemoryLimit: 1024,
+				}
+				_, err := broker.Provision(ctx, "some-id", details, false)
+				Expect(err).To(HaveOccurred())
+				Expect(err).NotTo(BeAssignableToTypeOf(&brokerapi.FailureResponse{}))
+			})
+		})
+
+		It("Passes other failures through", func() {
+			status, errorCode = http.StatusBadRequest, "invalid_parameter"
+			_, err := broker.Provision(ctx, "some-id", details, false)
+			Expect(err).To(MatchError("the cluster says no"))
+		})
+
+		Context("When the database of an instance has been removed from the cluster", func() {
+			BeforeEach(func() {
+				err = persister.Save(&persisters.State{
+					AvailableInstances: []persisters.ServiceInstance{
+						{ID: "test-instance", Credentials: cluster.InstanceCredentials{UID: 1}},
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				proxy.RegisterEndpointHandler("/v1/bdbs/1", func(w http.ResponseWriter, r *http.Request) interface{} {
+					w.WriteHeader(http.StatusNotFound)
+					return map[string]interface{}{"error_code": "db_not_exist"}
+				})
+			})
+
+			It("Reports the instance as gone on deprovisioning and forgets it", func() {
+				_, err := broker.Deprovision(ctx, "test-instance", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+
+				state, err := persister.Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(state.AvailableInstances).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Fetching instances", func() {
+		var (
+			tmpStateDir string
+			proxy       testing.HTTPProxy
+			err         error
+		)
+		BeforeEach(func() {
+			tmpStateDir, err = ioutil.TempDir("", "redislabs-state-test")
+			Expect(err).NotTo(HaveOccurred())
+			persister = persisters.NewLocalPersister(path.Join(tmpStateDir, "state.json"))
+			err = persister.Save(&persisters.State{
+				AvailableInstances: []persisters.ServiceInstance{
+					{
+						ID:              "test-instance",
+						Credentials:     cluster.InstanceCredentials{UID: 1},
+						InstanceDetails: persisters.InstanceDetails{PlanID: "test-plan"},
+					},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			proxy = testing.NewHTTPProxy()
+			proxy.RegisterEndpoints([]testing.Endpoint{{
+				URL: "/v1/bdbs/1",
+				Response: map[string]interface{}{
+					"uid":              1,
+					"status":           "active",
+					"memory_size":      400000000,
+					"replication":      true,
+					"shards_count":     2,
+					"data_persistence": "aof",
+				},
+			}})
+			config = brokerconfig.Config{
+				ServiceBroker: brokerconfig.ServiceBrokerConfig{
+					ServiceID: "test-service",
+				},
+				Cluster: brokerconfig.ClusterConfig{
+					Address: proxy.URL(),
+				},
+			}
+		})
+		AfterEach(func() {
+			proxy.Close()
+			os.RemoveAll(tmpStateDir)
+		})
+		It("Returns the plan and the settings of the database", func() {
+			instance, err := broker.GetInstance(ctx, "test-instance")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instance.ServiceID).To(Equal("test-service"))
+			Expect(instance.PlanID).To(Equal("test-plan"))
+			Expect(instance.Parameters).To(Equal(map[string]interface{}{
+				"memory_size":      int64(400000000),
+				"replication":      true,
+				"shards_count":     2,
+				"data_persistence": "aof",
+			}))
+		})
+		It("Does not know other instances", func() {
+			_, err := broker.GetInstance(ctx, "unknown-instance")
+			Expect(err).To(Equal(redislabs.ErrInstanceNotFound))
+		})
+		It("Serves the instances to platforms speaking version 2.14 of the broker API", func() {
+			api := brokerapi.New(broker, logger, brokerapi.BrokerCredentials{Username: "u", Password: "p"})
+			fetch := func(instanceID string, version string) *httptest.ResponseRecorder {
+				req, err := http.NewRequest("GET", "/v2/service_instances/"+instanceID, nil)
+				Expect(err).NotTo(HaveOccurred())
+				req.SetBasicAuth("u", "p")
+				req.Header.Set("X-Broker-API-Version", version)
+				res := httptest.NewRecorder()
+				api.ServeHTTP(res, req)
+				return res
+			}
+
+			res := fetch("test-instance", "2.14")
+			Expect(res.Code).To(Equal(http.StatusOK))
+			Expect(res.Body.String()).To(MatchJSON(`{
+				"service_id": "test-service",
+				"plan_id": "test-plan",
+				"parameters": {"memory_size": 400000000, "replication": true, "shards_count": 2, "data_persistence": "aof"}
+			}`))
+			Expect(fetch("unknown-instance", "2.14").Code).To(Equal(http.StatusNotFound))
+			Expect(fetch("test-instance", "2.13").Code).To(Equal(http.StatusPreconditionFailed))
+		})
+	})
+
 	Describe("Fetching the catalog", func() {
 		Context("Given a config with a service with the ID, name, description, and plan", func() {
 			BeforeEach(func() {
@@ -597,7 +995,7 @@ var _ = Describe("Broker", func() {
 				}
 			})
 			It("Provides them via a catalog request", func() {
-				services := broker.Services()
+				services := catalog()
 				Expect(len(services)).To(Equal(1))
 
 				service := services[0]
@@ -615,7 +1013,7 @@ var _ = Describe("Broker", func() {
 				}))
 			})
 			It("Assigns a tag", func() {
-				services := broker.Services()
+				services := catalog()
 				Expect(len(services)).To(Equal(1))
 				service := services[0]
 
@@ -623,14 +1021,19 @@ var _ = Describe("Broker", func() {
 				Expect(service.Tags[0]).To(Equal("redislabs"))
 			})
 			It("Says that it is bindable", func() {
-				services := broker.Services()
+				services := catalog()
 				Expect(len(services)).To(Equal(1))
 				service := services[0]
 
 				Expect(service.Bindable).To(Equal(true))
 			})
+			It("Says that the instances and bindings can be fetched", func() {
+				service := catalog()[0]
+				Expect(service.InstancesRetrievable).To(BeTrue())
+				Expect(service.BindingsRetrievable).To(BeTrue())
+			})
 			It("Says that the plan is updatable", func() {
-				services := broker.Services()
+				services := catalog()
 				Expect(len(services)).To(Equal(1))
 				service := services[0]
 
@@ -0,0 +1,193 @@
+package capacity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+)
+
+type (
+	// Requirement describes the cluster resources a database occupies.
+	// Replicas are accounted for, so a replicated database needs twice
+	// the memory and shards of its master.
+	Requirement struct {
+		Memory int64 // bytes
+		Shards int
+		// ShardMemory is the memory of the largest shard, which has to fit
+		// into a single node.
+		ShardMemory int64
+	}
+
+	// Available describes the cluster resources left for new databases.
+	Available struct {
+		TotalMemory       int64 // bytes
+		Memory            int64 // bytes
+		Shards            int
+		LargestNodeMemory int64 // bytes
+	}
+
+	// Error is returned when a database does not fit into the cluster.
+	Error struct {
+		Required  Requirement
+		Available Available
+	}
+
+	// Checker verifies whether databases fit into the cluster.
+	Checker struct {
+		api apiclient.Client
+		// headroom is the percentage of the total cluster memory kept
+		// in reserve.
+		headroom int
+		logger   lager.Logger
+	}
+)
+
+var ErrNoNodes = errors.New("the cluster has not reported any nodes")
+
+func (e *Error) Error() string {
+	switch {
+	case e.Required.Shards > e.Available.Shards:
+		return fmt.Sprintf("the database needs %d shards but only %d are available", e.Required.Shards, e.Available.Shards)
+	case e.Required.Memory > e.Available.Memory:
+		return fmt.Sprintf("the database needs %d bytes of memory but only %d are available", e.Required.Memory, e.Available.Memory)
+	}
+	return fmt.Sprintf("a database shard needs %d bytes of memory but no node has more than %d available", e.Required.ShardMemory, e.Available.LargestNodeMemory)
+}
+
+func NewChecker(api apiclient.Client, headroom int, logger lager.Logger) *Checker {
+	return &Checker{
+		api:      api,
+		headroom: headroom,
+		logger:   logger,
+	}
+}
+
+// RequirementOf returns the resources a database with the given settings
+// needs. The extra parameters take precedence over the typed fields
+// the same way they do in the request sent to the cluster.
+func RequirementOf(settings apiclient.DatabaseSettings) Requirement {
+	memory := settings.MemorySize
+	shards := settings.ShardsCount
+	replication := settings.Replication != nil && *settings.Replication
+	if value, ok := intParam(settings.Extra, "memory_size"); ok {
+		memory = value
+	}
+	if value, ok := intParam(settings.Extra, "shards_count"); ok {
+		shards = value
+	}
+	if value, ok := settings.Extra["replication"].(bool); ok {
+		replication = value
+	}
+	return requirement(memory, shards, replication)
+}
+
+// RequirementOfDatabase returns the resources an existing database occupies.
+func RequirementOfDatabase(database apiclient.Database) Requirement {
+	return requirement(database.MemorySize, int64(database.ShardsCount), database.Replication)
+}
+
+func requirement(memory int64, shards int64, replication bool) Requirement {
+	if shards < 1 {
+		shards = 1
+	}
+	r := Requirement{
+		Memory:      memory,
+		Shards:      int(shards),
+		ShardMemory: memory / shards,
+	}
+	if replication {
+		r.Memory *= 2
+		r.Shards *= 2
+	}
+	return r
+}
+
+// Extra returns the resources needed on top of the current ones to turn
+// the current requirement into r. Shrinking resources are not counted.
+func (r Requirement) Extra(current Requirement) Requirement {
+	extra := Requirement{}
+	if r.ShardMemory > current.ShardMemory {
+		extra.ShardMemory = r.ShardMemory - current.ShardMemory
+	}
+	if r.Memory > current.Memory {
+		extra.Memory = r.Memory - current.Memory
+	}
+	if r.Shards > current.Shards {
+		extra.Shards = r.Shards - current.Shards
+	}
+	return extra
+}
+
+// Available returns the cluster resources left for new databases, the
+// headroom excluded.
+func (c *Checker) Available(ctx context.Context) (Available, error) {
+	nodes, err := c.api.ListNodes(ctx)
+	if err != nil {
+		return Available{}, err
+	}
+	if len(nodes) == 0 {
+		return Available{}, ErrNoNodes
+	}
+	stats, err := c.api.GetNodesStats(ctx)
+	if err != nil {
+		return Available{}, err
+	}
+
+	available := Available{}
+	for _, node := range nodes {
+		available.TotalMemory += node.TotalMemory
+		if free := node.MaxRedisServers - node.ShardCount; free > 0 {
+			available.Shards += free
+		}
+		memory := int64(stats[node.UID].ProvisionalMemory)
+		available.Memory += memory
+		if memory > available.LargestNodeMemory {
+			available.LargestNodeMemory = memory
+		}
+	}
+	available.Memory -= available.TotalMemory * int64(c.headroom) / 100
+	if available.Memory < 0 {
+		available.Memory = 0
+	}
+	return available, nil
+}
+
+// Check returns *Error if the required resources do not fit into the
+// cluster. If the cluster resources cannot be determined the check is
+// skipped, the cluster still validates the request itself.
+func (c *Checker) Check(ctx context.Context, required Requirement) error {
+	if required.Memory == 0 && required.Shards == 0 {
+		return nil
+	}
+	available, err := c.Available(ctx)
+	if err != nil {
+		c.logger.Error("Failed to determine the cluster capacity, skipping the check", err)
+		return nil
+	}
+	if required.Memory > available.Memory ||
+		required.Shards > available.Shards ||
+		required.ShardMemory > available.LargestNodeMemory {
+		err := &Error{Required: required, Available: available}
+		c.logger.Error("The database does not fit into the cluster", err, lager.Data{
+			"required":  required,
+			"available": available,
+		})
+		return err
+	}
+	return nil
+}
+
+func intParam(params map[string]interface{}, name string) (int64, bool) {
+	switch v := params[name].(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
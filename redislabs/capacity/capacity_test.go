@@ -0,0 +1,177 @@
+package capacity_test
+
+import (
+	"context"
+	"errors"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient/fakes"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/capacity"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+const gb = int64(1024 * 1024 * 1024)
+
+var _ = Describe("Capacity", func() {
+
+	DescribeTable("Computes the requirement of the database settings",
+		func(settings apiclient.DatabaseSettings, expected capacity.Requirement) {
+			Expect(capacity.RequirementOf(settings)).To(Equal(expected))
+		},
+		Entry("a single shard",
+			apiclient.DatabaseSettings{MemorySize: 2 * gb},
+			capacity.Requirement{Memory: 2 * gb, Shards: 1, ShardMemory: 2 * gb}),
+		Entry("a replicated database",
+			apiclient.DatabaseSettings{MemorySize: 2 * gb, Replication: boolPtr(true)},
+			capacity.Requirement{Memory: 4 * gb, Shards: 2, ShardMemory: 2 * gb}),
+		Entry("a sharded database",
+			apiclient.DatabaseSettings{MemorySize: 4 * gb, ShardsCount: 4},
+			capacity.Requirement{Memory: 4 * gb, Shards: 4, ShardMemory: gb}),
+		Entry("a sharded and replicated database",
+			apiclient.DatabaseSettings{MemorySize: 4 * gb, ShardsCount: 2, Replication: boolPtr(true)},
+			capacity.Requirement{Memory: 8 * gb, Shards: 4, ShardMemory: 2 * gb}),
+		Entry("the extra parameters overriding the typed fields",
+			apiclient.DatabaseSettings{
+				MemorySize:  gb,
+				ShardsCount: 1,
+				Replication: boolPtr(true),
+				Extra: map[string]interface{}{
+					"memory_size":  float64(6 * gb),
+					"shards_count": 3,
+					"replication":  false,
+				},
+			},
+			capacity.Requirement{Memory: 6 * gb, Shards: 3, ShardMemory: 2 * gb}),
+	)
+
+	DescribeTable("Computes the extra requirement of an update",
+		func(current, updated, expected capacity.Requirement) {
+			Expect(updated.Extra(current)).To(Equal(expected))
+		},
+		Entry("a growing database",
+			capacity.Requirement{Memory: gb, Shards: 1, ShardMemory: gb},
+			capacity.Requirement{Memory: 4 * gb, Shards: 2, ShardMemory: 2 * gb},
+			capacity.Requirement{Memory: 3 * gb, Shards: 1, ShardMemory: gb}),
+		Entry("a shrinking database",
+			capacity.Requirement{Memory: 4 * gb, Shards: 2, ShardMemory: 2 * gb},
+			capacity.Requirement{Memory: gb, Shards: 1, ShardMemory: gb},
+			capacity.Requirement{}),
+	)
+
+	DescribeTable("Checks whether the database fits into the cluster",
+		func(nodes []apiclient.Node, stats map[int]apiclient.NodeStats, headroom int, required capacity.Requirement, fits bool) {
+			client := &fakes.FakeClient{Nodes: nodes, NodesStats: stats}
+			checker := capacity.NewChecker(client, headroom, lager.NewLogger("test"))
+
+			err := checker.Check(context.Background(), required)
+			if fits {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(BeAssignableToTypeOf(&capacity.Error{}))
+			}
+		},
+		Entry("a database within the limits",
+			twoNodes(), twoNodesStats(4*gb, 4*gb), 0,
+			capacity.Requirement{Memory: 6 * gb, Shards: 2, ShardMemory: 3 * gb}, true),
+		Entry("a database exceeding the provisional memory",
+			twoNodes(), twoNodesStats(4*gb, 4*gb), 0,
+			capacity.Requirement{Memory: 9 * gb, Shards: 2, ShardMemory: 3 * gb}, false),
+		Entry("a replicated database exceeding the provisional memory",
+			twoNodes(), twoNodesStats(3*gb, 3*gb), 0,
+			capacity.RequirementOf(apiclient.DatabaseSettings{MemorySize: 4 * gb, Replication: boolPtr(true)}), false),
+		Entry("a shard larger than any node",
+			twoNodes(), twoNodesStats(4*gb, 4*gb), 0,
+			capacity.Requirement{Memory: 5 * gb, Shards: 1, ShardMemory: 5 * gb}, false),
+		Entry("the same memory split into shards that fit",
+			twoNodes(), twoNodesStats(4*gb, 4*gb), 0,
+			capacity.RequirementOf(apiclient.DatabaseSettings{MemorySize: 5 * gb, ShardsCount: 2}), true),
+		Entry("a database exceeding the free redis servers",
+			twoNodes(), twoNodesStats(4*gb, 4*gb), 0,
+			capacity.Requirement{Memory: gb, Shards: 5, ShardMemory: gb / 5}, false),
+		Entry("a database using up the free redis servers",
+			twoNodes(), twoNodesStats(4*gb, 4*gb), 0,
+			capacity.Requirement{Memory: gb, Shards: 4, ShardMemory: gb / 4}, true),
+		Entry("a database fitting only into the headroom",
+			twoNodes(), twoNodesStats(4*gb, 4*gb), 25,
+			capacity.Requirement{Memory: 6 * gb, Shards: 2, ShardMemory: 3 * gb}, false),
+		Entry("a database fitting next to the headroom",
+			twoNodes(), twoNodesStats(4*gb, 4*gb), 25,
+			capacity.Requirement{Memory: 4 * gb, Shards: 2, ShardMemory: 2 * gb}, true),
+		Entry("an empty requirement without any nodes",
+			[]apiclient.Node{}, map[int]apiclient.NodeStats{}, 0,
+			capacity.Requirement{}, true),
+		Entry("a database on a cluster that has not reported its nodes",
+			[]apiclient.Node{}, map[int]apiclient.NodeStats{}, 0,
+			capacity.Requirement{Memory: 100 * gb, Shards: 100}, true),
+	)
+
+	It("Sums up the resources of the nodes", func() {
+		client := &fakes.FakeClient{
+			Nodes: []apiclient.Node{
+				{UID: 1, TotalMemory: 8 * gb, ShardCount: 3, MaxRedisServers: 4},
+				{UID: 2, TotalMemory: 8 * gb, ShardCount: 6, MaxRedisServers: 4},
+				{UID: 3, TotalMemory: 4 * gb, ShardCount: 0, MaxRedisServers: 2},
+			},
+			NodesStats: map[int]apiclient.NodeStats{
+				1: {ProvisionalMemory: float64(3 * gb)},
+				2: {ProvisionalMemory: float64(5 * gb)},
+				3: {ProvisionalMemory: float64(gb)},
+			},
+		}
+		checker := capacity.NewChecker(client, 10, lager.NewLogger("test"))
+
+		available, err := checker.Available(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(available).To(Equal(capacity.Available{
+			TotalMemory:       20 * gb,
+			Memory:            9*gb - 2*gb,
+			Shards:            3,
+			LargestNodeMemory: 5 * gb,
+		}))
+	})
+
+	It("Does not report negative memory when the headroom exceeds it", func() {
+		client := &fakes.FakeClient{Nodes: twoNodes(), NodesStats: twoNodesStats(gb, gb)}
+		checker := capacity.NewChecker(client, 50, lager.NewLogger("test"))
+
+		available, err := checker.Available(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(available.Memory).To(BeZero())
+	})
+
+	It("Fails to determine the resources without any nodes", func() {
+		checker := capacity.NewChecker(&fakes.FakeClient{}, 0, lager.NewLogger("test"))
+
+		_, err := checker.Available(context.Background())
+		Expect(err).To(Equal(capacity.ErrNoNodes))
+	})
+
+	It("Skips the check when the cluster cannot be reached", func() {
+		client := &fakes.FakeClient{NodesError: errors.New("unreachable")}
+		checker := capacity.NewChecker(client, 0, lager.NewLogger("test"))
+
+		Expect(checker.Check(context.Background(), capacity.Requirement{Memory: gb, Shards: 1})).To(Succeed())
+	})
+})
+
+func twoNodes() []apiclient.Node {
+	return []apiclient.Node{
+		{UID: 1, TotalMemory: 8 * gb, ShardCount: 2, MaxRedisServers: 4},
+		{UID: 2, TotalMemory: 8 * gb, ShardCount: 2, MaxRedisServers: 4},
+	}
+}
+
+func twoNodesStats(first, second int64) map[int]apiclient.NodeStats {
+	return map[int]apiclient.NodeStats{
+		1: {ProvisionalMemory: float64(first)},
+		2: {ProvisionalMemory: float64(second)},
+	}
+}
+
+func boolPtr(value bool) *bool {
+	return &value
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
 
 	"github.com/cloudfoundry-incubator/candiedyaml"
@@ -9,11 +11,126 @@ import (
 type Config struct {
 	Cluster       ClusterConfig       `yaml:"cluster"`
 	ServiceBroker ServiceBrokerConfig `yaml:"broker"`
+	Metering      MeteringConfig      `yaml:"metering"`
+	Metrics       MetricsConfig       `yaml:"metrics"`
+	Logging       LoggingConfig       `yaml:"logging"`
+	Audit         AuditConfig         `yaml:"audit"`
+	Webhooks      []WebhookConfig     `yaml:"webhooks"`
+	State         StateConfig         `yaml:"state"`
+}
+
+// StateConfig controls how the broker state is stored. The state is kept
+// in a local file unless another backend is chosen.
+type StateConfig struct {
+	Backend    string           `yaml:"backend"` // local, redis or sql
+	Redis      RedisStateConfig `yaml:"redis"`
+	SQL        SQLStateConfig   `yaml:"sql"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+}
+
+// SQLStateConfig names the database/sql driver (postgres, mysql or sqlite)
+// and the data source of the database keeping the state.
+type SQLStateConfig struct {
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+}
+
+// RedisStateConfig locates the Redis database keeping the state.
+type RedisStateConfig struct {
+	Address  string `yaml:"address"` // host:port
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	TLS      bool   `yaml:"tls"`
+	Key      string `yaml:"key"`     // defaults to redislabs-broker:state
+	Timeout  int    `yaml:"timeout"` // seconds
+}
+
+// EncryptionConfig lists the keys sealing the credentials in the state.
+// The first key encrypts, all of them decrypt, so a new key is put first
+// while the previous one stays until the state has been re-encrypted.
+// The state is not encrypted unless a key is given.
+type EncryptionConfig struct {
+	Keys []KeyConfig `yaml:"keys"`
+}
+
+// KeyConfig names a base64 encoded 256-bit key kept either in a file
+// or in an environment variable.
+type KeyConfig struct {
+	ID   string `yaml:"id"`
+	File string `yaml:"file"`
+	Env  string `yaml:"env"`
+}
+
+// WebhookConfig describes an endpoint notified of the instance lifecycle.
+// The body is signed with the secret. An empty list of events
+// subscribes to all of them.
+type WebhookConfig struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Events []string `yaml:"events"`
+}
+
+// AuditConfig sets where the audit records are appended to. They go
+// next to the broker state unless the file is set.
+type AuditConfig struct {
+	File string `yaml:"file"`
+}
+
+// LoggingConfig lists the key names whose values are masked in the logs
+// on top of the default ones.
+type LoggingConfig struct {
+	RedactKeys []string `yaml:"redact_keys"`
+}
+
+// MetricsConfig sets where the Prometheus metrics are served. They are
+// not served unless the port is set.
+type MetricsConfig struct {
+	Port int `yaml:"port"`
+}
+
+// MeteringConfig controls sampling the instance memory for chargeback.
+// Zero values fall back to the defaults.
+type MeteringConfig struct {
+	Interval  int `yaml:"interval"`  // seconds between samples
+	Retention int `yaml:"retention"` // days the records are kept
 }
 
 type ClusterConfig struct {
-	Auth    AuthConfig `yaml:"auth"`
-	Address string     `yaml:"address"`
+	Auth           AuthConfig           `yaml:"auth"`
+	Address        string               `yaml:"address"`
+	Retry          RetryConfig          `yaml:"retry"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Timeouts       TimeoutsConfig       `yaml:"timeouts"`
+	Capacity       CapacityConfig       `yaml:"capacity"`
+}
+
+// CapacityConfig controls the check whether a database fits into
+// the cluster before it is requested.
+type CapacityConfig struct {
+	Headroom int `yaml:"headroom"` // percent of the total cluster memory kept in reserve
+}
+
+// RetryConfig sets the budget for retrying idempotent cluster API requests.
+// Zero values fall back to the defaults.
+type RetryConfig struct {
+	MaxAttempts    int `yaml:"max_attempts"`
+	InitialBackoff int `yaml:"initial_backoff"` // milliseconds
+	MaxBackoff     int `yaml:"max_backoff"`     // milliseconds
+}
+
+// CircuitBreakerConfig defines when the broker stops calling an unhealthy
+// cluster API. Zero values fall back to the defaults.
+type CircuitBreakerConfig struct {
+	FailureThreshold int `yaml:"failure_threshold"`
+	Cooldown         int `yaml:"cooldown"` // seconds
+}
+
+// TimeoutsConfig sets deadlines for the cluster operations. Zero values
+// fall back to the defaults.
+type TimeoutsConfig struct {
+	Request         int `yaml:"request"`          // seconds, one API call including retries
+	Database        int `yaml:"database"`         // seconds, waiting for a database to become active
+	PollingInterval int `yaml:"polling_interval"` // milliseconds
 }
 
 type ServiceBrokerConfig struct {
@@ -72,6 +189,76 @@ func LoadFromFile(path string) (Config, error) {
 	if err := candiedyaml.NewDecoder(file).Decode(&config); err != nil {
 		return Config{}, err
 	}
-	// TODO: add validations here
 	return config, nil
 }
+
+var (
+	ErrClusterAddressMissing     = errors.New("cluster.address is not set")
+	ErrClusterCredentialsMissing = errors.New("cluster.auth.username and cluster.auth.password must be set")
+	ErrBrokerCredentialsMissing  = errors.New("broker.auth.username and broker.auth.password must be set")
+	ErrServiceIDMissing          = errors.New("broker.service_id is not set")
+	ErrNoPlans                   = errors.New("broker.plans must contain at least one plan")
+	ErrPlanIncomplete            = errors.New("every plan must have an id and a name")
+	ErrWebhookIncomplete         = errors.New("every webhook must have a url and a secret")
+	ErrRedisAddressMissing       = errors.New("state.redis.address must be set for the redis backend")
+	ErrSQLSourceMissing          = errors.New("state.sql.driver and state.sql.dsn must be set for the sql backend")
+	ErrStateKeyIncomplete        = errors.New("every state encryption key must have an id and either a file or an env")
+)
+
+// Validate tells whether the broker can work with the config.
+func (c Config) Validate() error {
+	switch {
+	case c.Cluster.Address == "":
+		return ErrClusterAddressMissing
+	case c.Cluster.Auth.Username == "" || c.Cluster.Auth.Password == "":
+		return ErrClusterCredentialsMissing
+	case c.ServiceBroker.Auth.Username == "" || c.ServiceBroker.Auth.Password == "":
+		return ErrBrokerCredentialsMissing
+	case c.ServiceBroker.ServiceID == "":
+		return ErrServiceIDMissing
+	case len(c.ServiceBroker.Plans) == 0:
+		return ErrNoPlans
+	}
+	ids := map[string]bool{}
+	for _, plan := range c.ServiceBroker.Plans {
+		if plan.ID == "" || plan.Name == "" {
+			return ErrPlanIncomplete
+		}
+		if ids[plan.ID] {
+			return fmt.Errorf("plan id %q is used more than once", plan.ID)
+		}
+		ids[plan.ID] = true
+	}
+	if headroom := c.Cluster.Capacity.Headroom; headroom < 0 || headroom >= 100 {
+		return fmt.Errorf("cluster.capacity.headroom must be a percentage below 100, got %d", headroom)
+	}
+	for _, webhook := range c.Webhooks {
+		if webhook.URL == "" || webhook.Secret == "" {
+			return ErrWebhookIncomplete
+		}
+	}
+	switch c.State.Backend {
+	case "", "local":
+	case "redis":
+		if c.State.Redis.Address == "" {
+			return ErrRedisAddressMissing
+		}
+	case "sql":
+		if c.State.SQL.Driver == "" || c.State.SQL.DSN == "" {
+			return ErrSQLSourceMissing
+		}
+	default:
+		return fmt.Errorf("state.backend %q is not supported, use local, redis or sql", c.State.Backend)
+	}
+	keyIDs := map[string]bool{}
+	for _, key := range c.State.Encryption.Keys {
+		if key.ID == "" || (key.File == "") == (key.Env == "") {
+			return ErrStateKeyIncomplete
+		}
+		if keyIDs[key.ID] {
+			return fmt.Errorf("state encryption key id %q is used more than once", key.ID)
+		}
+		keyIDs[key.ID] = true
+	}
+	return nil
+}
@@ -3,11 +3,12 @@ package config_test
 import (
 	brokerconfig "github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
 
-	// "os"
+	"os"
 	"path"
 	"path/filepath"
 
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 )
 
@@ -45,7 +46,8 @@ var _ = Describe("Config", func() {
 			Ω(config.ServiceBroker.Metadata.ProviderDisplayName).To(Equal("RedisLabs"))
 		})
 		It("loads service broker plans", func() {
-			Ω(config.ServiceBroker.Plans).To(Equal("redislabs-service-broker-0b814f"))
+			Ω(config.ServiceBroker.Plans).To(HaveLen(3))
+			Ω(config.ServiceBroker.Plans[0].ID).To(Equal("rlec-minimal-plan-4fc771"))
 		})
 	})
 
@@ -55,7 +57,7 @@ var _ = Describe("Config", func() {
 		})
 
 		It("returns an error", func() {
-			Ω(parseConfigErr).Should(MatchError(ContainSubstring("not found")))
+			Ω(os.IsNotExist(parseConfigErr)).Should(BeTrue())
 		})
 	})
 
@@ -68,4 +70,88 @@ var _ = Describe("Config", func() {
 		})
 	})
 
+	Describe("Validate", func() {
+		valid := func() brokerconfig.Config {
+			return brokerconfig.Config{
+				Cluster: brokerconfig.ClusterConfig{
+					Address: "https://cluster:9443",
+					Auth:    brokerconfig.AuthConfig{Username: "admin", Password: "secret"},
+				},
+				ServiceBroker: brokerconfig.ServiceBrokerConfig{
+					Auth:      brokerconfig.AuthConfig{Username: "broker", Password: "secret"},
+					ServiceID: "service-id",
+					Plans: []brokerconfig.ServicePlanConfig{
+						{ID: "small-id", Name: "small"},
+						{ID: "large-id", Name: "large"},
+					},
+				},
+			}
+		}
+
+		It("accepts a complete config", func() {
+			Ω(valid().Validate()).To(Succeed())
+		})
+
+		DescribeTable("rejects an incomplete or inconsistent config",
+			func(change func(*brokerconfig.Config), expected string) {
+				config := valid()
+				change(&config)
+				Ω(config.Validate()).To(MatchError(expected))
+			},
+			Entry("without the cluster address",
+				func(c *brokerconfig.Config) { c.Cluster.Address = "" },
+				brokerconfig.ErrClusterAddressMissing.Error()),
+			Entry("without the cluster password",
+				func(c *brokerconfig.Config) { c.Cluster.Auth.Password = "" },
+				brokerconfig.ErrClusterCredentialsMissing.Error()),
+			Entry("without the broker username",
+				func(c *brokerconfig.Config) { c.ServiceBroker.Auth.Username = "" },
+				brokerconfig.ErrBrokerCredentialsMissing.Error()),
+			Entry("without the service id",
+				func(c *brokerconfig.Config) { c.ServiceBroker.ServiceID = "" },
+				brokerconfig.ErrServiceIDMissing.Error()),
+			Entry("without plans",
+				func(c *brokerconfig.Config) { c.ServiceBroker.Plans = nil },
+				brokerconfig.ErrNoPlans.Error()),
+			Entry("with a plan without a name",
+				func(c *brokerconfig.Config) { c.ServiceBroker.Plans[1].Name = "" },
+				brokerconfig.ErrPlanIncomplete.Error()),
+			Entry("with duplicate plan ids",
+				func(c *brokerconfig.Config) { c.ServiceBroker.Plans[1].ID = "small-id" },
+				`plan id "small-id" is used more than once`),
+			Entry("with a negative headroom",
+				func(c *brokerconfig.Config) { c.Cluster.Capacity.Headroom = -1 },
+				"cluster.capacity.headroom must be a percentage below 100, got -1"),
+			Entry("with the whole cluster as headroom",
+				func(c *brokerconfig.Config) { c.Cluster.Capacity.Headroom = 100 },
+				"cluster.capacity.headroom must be a percentage below 100, got 100"),
+			Entry("with a webhook without a secret",
+				func(c *brokerconfig.Config) {
+					c.Webhooks = []brokerconfig.WebhookConfig{{URL: "https://hooks.example.com"}}
+				},
+				brokerconfig.ErrWebhookIncomplete.Error()),
+			Entry("with an unknown state backend",
+				func(c *brokerconfig.Config) { c.State.Backend = "etcd" },
+				`state.backend "etcd" is not supported, use local, redis or sql`),
+			Entry("with the redis backend without an address",
+				func(c *brokerconfig.Config) { c.State.Backend = "redis" },
+				brokerconfig.ErrRedisAddressMissing.Error()),
+			Entry("with the sql backend without a data source",
+				func(c *brokerconfig.Config) {
+					c.State.Backend = "sql"
+					c.State.SQL.Driver = "postgres"
+				},
+				brokerconfig.ErrSQLSourceMissing.Error()),
+			Entry("with a state key in both a file and an env",
+				func(c *brokerconfig.Config) {
+					c.State.Encryption.Keys = []brokerconfig.KeyConfig{{ID: "k1", File: "/keys/k1", Env: "K1"}}
+				},
+				brokerconfig.ErrStateKeyIncomplete.Error()),
+			Entry("with duplicate state key ids",
+				func(c *brokerconfig.Config) {
+					c.State.Encryption.Keys = []brokerconfig.KeyConfig{{ID: "k1", Env: "K1"}, {ID: "k1", Env: "K2"}}
+				},
+				`state encryption key id "k1" is used more than once`),
+		)
+	})
 })
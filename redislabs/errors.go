@@ -1,8 +1,71 @@
 package redislabs
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/capacity"
+	"github.com/pivotal-cf/brokerapi"
+)
 
 var (
 	ErrPlanDoesNotExist    = errors.New("plan does not exist")
 	ErrServiceDoesNotExist = errors.New("service does not exist")
+	ErrClusterAuthFailed   = errors.New("the service broker cannot authenticate with the Redis Labs cluster, please contact your operator")
+	// ErrInstanceNotFound answers a fetch of an unknown instance, the
+	// other requests report it as gone with brokerapi.ErrInstanceDoesNotExist.
+	ErrInstanceNotFound = brokerapi.NewFailureResponseBuilder(
+		errors.New("instance cannot be fetched"), http.StatusNotFound, "instance-not-found",
+	).WithEmptyResponse().Build()
+)
+
+var (
+	// Cluster error codes meaning that the database does not fit
+	// into the cluster.
+	capacityErrorCodes = map[string]bool{
+		"insufficient_resources": true,
+		"not_enough_memory":      true,
+		"not_enough_shards":      true,
+	}
+	// Cluster error codes meaning that the database name is taken.
+	conflictErrorCodes = map[string]bool{
+		"name_conflict":  true,
+		"db_name_exists": true,
+	}
 )
+
+// translateClusterError turns a failure reported by the cluster into
+// a response the platform and the developer can act upon. Other errors
+// are returned as they are.
+func translateClusterError(err error) error {
+	if capErr, ok := err.(*capacity.Error); ok {
+		return brokerapi.NewFailureResponse(
+			fmt.Errorf("the cluster does not have enough capacity for the database: %s, choose a smaller plan or ask your operator to add capacity", capErr),
+			http.StatusUnprocessableEntity,
+			"insufficient-cluster-capacity",
+		)
+	}
+	apiErr, ok := err.(*apiclient.Error)
+	if !ok {
+		return err
+	}
+	switch {
+	case apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden:
+		return brokerapi.NewFailureResponse(ErrClusterAuthFailed, http.StatusInternalServerError, "cluster-authentication-failed")
+	case capacityErrorCodes[apiErr.Code]:
+		return brokerapi.NewFailureResponse(
+			fmt.Errorf("the cluster does not have enough memory or shards for the database (%s), choose a smaller plan or ask your operator to add capacity", apiErr),
+			http.StatusUnprocessableEntity,
+			"insufficient-cluster-capacity",
+		)
+	case conflictErrorCodes[apiErr.Code]:
+		return brokerapi.NewFailureResponse(
+			fmt.Errorf("a database with this name already exists in the cluster (%s), provide another name prefix via the name parameter", apiErr),
+			http.StatusConflict,
+			"database-name-conflict",
+		)
+	}
+	return err
+}
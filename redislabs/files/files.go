@@ -0,0 +1,107 @@
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Lock modes of WithLock.
+const (
+	Shared    = lockShared
+	Exclusive = lockExclusive
+)
+
+var (
+	// The files the broker keeps may hold credentials, only the broker
+	// user may read them.
+	fileMask   = os.FileMode(0600)
+	folderMask = os.FileMode(0700)
+)
+
+// WriteAtomically writes the data to a temporary file, flushes it to the
+// disk and renames it over the given path, so that a crash leaves either
+// the previous content or the new one. The folder is created if missing.
+func WriteAtomically(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, folderMask); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if err = tmp.Chmod(fileMask); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Append adds the data to the end of the file at the given path in a
+// single write, creating the file and its folder if missing, and flushes
+// it to the disk.
+func Append(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), folderMask); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, fileMask)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// WithLock runs the function holding the advisory lock of the file at
+// the given path. The lock is taken on a file next to it, so that the
+// file itself can be replaced by WriteAtomically in the meantime.
+func WithLock(path string, how int, fn func() error) error {
+	if err := os.MkdirAll(filepath.Dir(path), folderMask); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, fileMask)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err = lockFile(file, how); err != nil {
+		return err
+	}
+	defer unlockFile(file)
+	return fn()
+}
+
+// syncDir flushes the directory so that a rename survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,95 @@
+package files_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/files"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Files", func() {
+	var (
+		tmpDir   string
+		filePath string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "redislabs-files-test")
+		Expect(err).NotTo(HaveOccurred())
+		filePath = path.Join(tmpDir, "broker", "state.json")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	Describe("WriteAtomically", func() {
+		It("Creates the folder and a file readable by the owner only", func() {
+			Expect(files.WriteAtomically(filePath, []byte("first"))).To(Succeed())
+			info, err := os.Stat(filePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			info, err = os.Stat(path.Dir(filePath))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0700)))
+		})
+
+		It("Replaces the content and leaves no temporary file behind", func() {
+			Expect(files.WriteAtomically(filePath, []byte("first"))).To(Succeed())
+			Expect(files.WriteAtomically(filePath, []byte("second"))).To(Succeed())
+			Expect(ioutil.ReadFile(filePath)).To(Equal([]byte("second")))
+
+			entries, err := ioutil.ReadDir(path.Dir(filePath))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+		})
+	})
+
+	Describe("Append", func() {
+		It("Creates the file readable by the owner only and adds to its end", func() {
+			Expect(files.Append(filePath, []byte("first\n"))).To(Succeed())
+			Expect(files.Append(filePath, []byte("second\n"))).To(Succeed())
+			Expect(ioutil.ReadFile(filePath)).To(Equal([]byte("first\nsecond\n")))
+			info, err := os.Stat(filePath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+	})
+
+	Describe("WithLock", func() {
+		It("Serializes the changes made holding the exclusive lock", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					Expect(files.WithLock(filePath, files.Exclusive, func() error {
+						count := 0
+						if data, err := ioutil.ReadFile(filePath); err == nil {
+							count, _ = strconv.Atoi(string(data))
+						}
+						return files.WriteAtomically(filePath, []byte(fmt.Sprint(count+1)))
+					})).To(Succeed())
+				}()
+			}
+			wg.Wait()
+			Expect(ioutil.ReadFile(filePath)).To(Equal([]byte("10")))
+		})
+
+		It("Returns the error of the function", func() {
+			failure := fmt.Errorf("failed")
+			Expect(files.WithLock(filePath, files.Shared, func() error {
+				return failure
+			})).To(Equal(failure))
+		})
+	})
+})
@@ -0,0 +1,185 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+)
+
+type (
+	// Check is a single readiness condition.
+	Check struct {
+		Name string
+		Run  func(ctx context.Context) error
+	}
+
+	// Result is the outcome of a check as it is reported.
+	Result struct {
+		Name     string  `json:"name"`
+		Status   string  `json:"status"`
+		Error    string  `json:"error,omitempty"`
+		Duration float64 `json:"duration_seconds"`
+	}
+
+	// Report lists the results of every check.
+	Report struct {
+		Status string   `json:"status"`
+		Checks []Result `json:"checks"`
+	}
+)
+
+const (
+	StatusOK     = "ok"
+	StatusFailed = "failed"
+)
+
+var (
+	// CheckTimeout limits how long Run waits for the checks.
+	CheckTimeout = 5 * time.Second
+
+	// ErrTimeout is reported for the checks still running when
+	// CheckTimeout expires.
+	ErrTimeout = errors.New("the check has not completed in time")
+)
+
+// PersisterCheck verifies that the broker state can be loaded. Loading
+// cannot be cancelled, the check gives up waiting when the context is
+// done.
+func PersisterCheck(persister persisters.StatePersister) Check {
+	return Check{
+		Name: "state",
+		Run: func(ctx context.Context) error {
+			loaded := make(chan error, 1)
+			go func() {
+				_, err := persister.Load()
+				loaded <- err
+			}()
+			select {
+			case err := <-loaded:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+}
+
+// ClusterCheck verifies that the cluster API is reachable and accepts
+// the configured credentials.
+func ClusterCheck(api apiclient.Client) Check {
+	return Check{
+		Name: "cluster",
+		Run: func(ctx context.Context) error {
+			_, err := api.GetClusterInfo(ctx)
+			return err
+		},
+	}
+}
+
+// ConfigCheck verifies that the config is valid.
+func ConfigCheck(conf config.Config) Check {
+	return Check{
+		Name: "config",
+		Run: func(ctx context.Context) error {
+			return conf.Validate()
+		},
+	}
+}
+
+// Run runs the checks concurrently and reports their results in order.
+// The checks still running when the context is done or CheckTimeout
+// expires are reported as failed.
+func Run(ctx context.Context, checks []Check) Report {
+	ctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+	defer cancel()
+
+	type outcome struct {
+		index  int
+		result Result
+	}
+	start := time.Now()
+	// Buffered so that the checks finishing late do not block.
+	done := make(chan outcome, len(checks))
+	for i, check := range checks {
+		go func(i int, check Check) {
+			err := check.Run(ctx)
+			result := Result{
+				Name:     check.Name,
+				Status:   StatusOK,
+				Duration: time.Since(start).Seconds(),
+			}
+			if err != nil {
+				result.Status = StatusFailed
+				result.Error = err.Error()
+			}
+			done <- outcome{index: i, result: result}
+		}(i, check)
+	}
+
+	results := make([]Result, len(checks))
+	finished := make([]bool, len(checks))
+collect:
+	for range checks {
+		select {
+		case o := <-done:
+			results[o.index] = o.result
+			finished[o.index] = true
+		case <-ctx.Done():
+			break collect
+		}
+	}
+	for i, check := range checks {
+		if !finished[i] {
+			results[i] = Result{
+				Name:     check.Name,
+				Status:   StatusFailed,
+				Error:    ErrTimeout.Error(),
+				Duration: time.Since(start).Seconds(),
+			}
+		}
+	}
+
+	report := Report{Status: StatusOK, Checks: results}
+	for _, result := range results {
+		if result.Status != StatusOK {
+			report.Status = StatusFailed
+		}
+	}
+	return report
+}
+
+// LivenessHandler tells that the process is alive.
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": StatusOK})
+	})
+}
+
+// ReadinessHandler runs the checks on every request. It responds with
+// 503 Service Unavailable unless every check passes.
+func ReadinessHandler(checks []Check, logger lager.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := Run(r.Context(), checks)
+		status := http.StatusOK
+		if report.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+			logger.Info("The broker is not ready", lager.Data{
+				"checks": report.Checks,
+			})
+		}
+		writeJSON(w, status, report)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,156 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient/fakes"
+	brokerconfig "github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/health"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Readiness", func() {
+	var (
+		api         *fakes.FakeClient
+		conf        brokerconfig.Config
+		tmpStateDir string
+		statePath   string
+		logger      = lager.NewLogger("test")
+	)
+
+	BeforeEach(func() {
+		api = &fakes.FakeClient{}
+		conf = brokerconfig.Config{
+			Cluster: brokerconfig.ClusterConfig{
+				Address: "https://cluster:9443",
+				Auth:    brokerconfig.AuthConfig{Username: "admin", Password: "secret"},
+			},
+			ServiceBroker: brokerconfig.ServiceBrokerConfig{
+				Auth:      brokerconfig.AuthConfig{Username: "broker", Password: "secret"},
+				ServiceID: "service-id",
+				Plans:     []brokerconfig.ServicePlanConfig{{ID: "plan-id", Name: "plan"}},
+			},
+		}
+		var err error
+		tmpStateDir, err = ioutil.TempDir("", "redislabs-state-test")
+		Expect(err).NotTo(HaveOccurred())
+		statePath = path.Join(tmpStateDir, "state.json")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpStateDir)
+	})
+
+	ready := func() (int, health.Report) {
+		checks := []health.Check{
+			health.ConfigCheck(conf),
+			health.PersisterCheck(persisters.NewLocalPersister(statePath)),
+			health.ClusterCheck(api),
+		}
+		req, err := http.NewRequest("GET", "/readyz", nil)
+		Expect(err).NotTo(HaveOccurred())
+		rec := httptest.NewRecorder()
+		health.ReadinessHandler(checks, logger).ServeHTTP(rec, req)
+
+		report := health.Report{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &report)).To(Succeed())
+		return rec.Code, report
+	}
+
+	It("Is ready when every check passes", func() {
+		code, report := ready()
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(report.Status).To(Equal(health.StatusOK))
+		Expect(report.Checks).To(HaveLen(3))
+	})
+
+	It("Reports the cluster rejecting the credentials", func() {
+		api.ClusterError = &apiclient.Error{StatusCode: 401, Description: "invalid credentials"}
+		code, report := ready()
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(report.Checks[2].Name).To(Equal("cluster"))
+		Expect(report.Checks[2].Status).To(Equal(health.StatusFailed))
+		Expect(report.Checks[2].Error).To(Equal("invalid credentials"))
+	})
+
+	It("Reports an unreadable state", func() {
+		Expect(ioutil.WriteFile(statePath, []byte("{"), 0600)).To(Succeed())
+		code, report := ready()
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(report.Checks[1].Status).To(Equal(health.StatusFailed))
+		Expect(report.Checks[0].Status).To(Equal(health.StatusOK))
+	})
+
+	It("Reports an invalid config", func() {
+		conf.ServiceBroker.Plans = nil
+		code, report := ready()
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(report.Checks[0].Error).To(Equal(brokerconfig.ErrNoPlans.Error()))
+	})
+
+	Context("When a check does not complete in time", func() {
+		var (
+			timeout = health.CheckTimeout
+			release chan struct{}
+		)
+
+		BeforeEach(func() {
+			health.CheckTimeout = 50 * time.Millisecond
+			release = make(chan struct{})
+		})
+
+		AfterEach(func() {
+			close(release)
+			health.CheckTimeout = timeout
+		})
+
+		It("Reports it as failed along with the checks that have completed", func() {
+			release := release
+			report := health.Run(context.Background(), []health.Check{
+				health.ConfigCheck(conf),
+				{Name: "stuck", Run: func(ctx context.Context) error {
+					<-release
+					return nil
+				}},
+			})
+			Expect(report.Status).To(Equal(health.StatusFailed))
+			Expect(report.Checks[0].Status).To(Equal(health.StatusOK))
+			Expect(report.Checks[1].Name).To(Equal("stuck"))
+			Expect(report.Checks[1].Status).To(Equal(health.StatusFailed))
+			Expect(report.Checks[1].Error).To(Equal(health.ErrTimeout.Error()))
+		})
+
+		It("Stops waiting for a state that cannot be loaded", func() {
+			check := health.PersisterCheck(&stuckPersister{
+				StatePersister: persisters.NewLocalPersister(statePath),
+				release:        release,
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			Expect(check.Run(ctx)).To(Equal(context.Canceled))
+		})
+	})
+})
+
+// stuckPersister loads the state once released.
+type stuckPersister struct {
+	persisters.StatePersister
+	release chan struct{}
+}
+
+func (p *stuckPersister) Load() (*persisters.State, error) {
+	<-p.release
+	return p.StatePersister.Load()
+}
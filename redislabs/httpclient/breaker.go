@@ -0,0 +1,101 @@
+package httpclient
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerPolicy describes when the circuit breaker opens and for how long
+// it stays open.
+type BreakerPolicy struct {
+	// FailureThreshold is the number of consecutive transient failures
+	// after which the breaker opens.
+	FailureThreshold int
+	// Cooldown is the time an open breaker rejects requests before it lets
+	// a single probe request through.
+	Cooldown time.Duration
+}
+
+var (
+	DefaultBreakerPolicy = BreakerPolicy{
+		FailureThreshold: 5,
+		Cooldown:         10 * time.Second,
+	}
+
+	// Breakers are shared by all the clients talking to the same address,
+	// since the broker creates a new client for every cluster operation.
+	breakers     = map[string]*circuitBreaker{}
+	breakersLock sync.Mutex
+)
+
+// circuitBreaker tracks the health of the cluster API and makes requests
+// fail fast while the API is unhealthy.
+type circuitBreaker struct {
+	policy   BreakerPolicy
+	lock     sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+func breakerFor(address string, policy BreakerPolicy) *circuitBreaker {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+
+	b, ok := breakers[address]
+	if !ok {
+		b = newCircuitBreaker(policy)
+		breakers[address] = b
+	}
+	return b
+}
+
+func newCircuitBreaker(policy BreakerPolicy) *circuitBreaker {
+	return &circuitBreaker{
+		policy: policy,
+		now:    time.Now,
+	}
+}
+
+// Allow tells whether a request may be sent. Once the cooldown is over
+// an open breaker lets exactly one probe request through; its outcome
+// decides whether the breaker closes or stays open.
+func (b *circuitBreaker) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.policy.FailureThreshold <= 0 || b.failures < b.policy.FailureThreshold {
+		return true
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.policy.Cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// Record registers the outcome of a request that has been allowed.
+func (b *circuitBreaker) Record(success bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.probing = false
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.policy.FailureThreshold {
+		b.openedAt = b.now()
+	}
+}
+
+// Abandon releases a request that has been allowed but whose outcome
+// does not tell anything about the cluster health.
+func (b *circuitBreaker) Abandon() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.probing = false
+}
@@ -2,6 +2,7 @@ package httpclient
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"net"
@@ -9,17 +10,18 @@ import (
 	"net/url"
 	"time"
 
-	"github.com/pivotal-golang/lager"
+	"code.cloudfoundry.org/lager"
 )
 
 type (
 	HTTPParams  map[string]string
 	HTTPPayload []byte
 	HTTPClient  interface {
-		Get(endpoint string, params HTTPParams) (*http.Response, error)
-		Post(endpoint string, payload HTTPPayload) (*http.Response, error)
-		Put(endpoint string, payload HTTPPayload) (*http.Response, error)
-		Delete(endpoint string) (*http.Response, error)
+		Get(ctx context.Context, endpoint string, params HTTPParams) (*http.Response, error)
+		Post(ctx context.Context, endpoint string, payload HTTPPayload) (*http.Response, error)
+		Put(ctx context.Context, endpoint string, payload HTTPPayload) (*http.Response, error)
+		Patch(ctx context.Context, endpoint string, payload HTTPPayload) (*http.Response, error)
+		Delete(ctx context.Context, endpoint string) (*http.Response, error)
 	}
 
 	httpClient struct {
@@ -28,6 +30,8 @@ type (
 		address  string
 		logger   lager.Logger
 		client   *http.Client
+		retry    RetryPolicy
+		breaker  *circuitBreaker
 	}
 )
 
@@ -44,7 +48,9 @@ var defaultClient = &http.Client{
 }
 
 // New returns a client that implements HTTPClient interface.
-func New(username string, password string, address string, logger lager.Logger) *httpClient {
+// Idempotent requests are retried according to the given retry policy.
+// All the clients created for the same address share a circuit breaker.
+func New(username string, password string, address string, retry RetryPolicy, breaker BreakerPolicy, logger lager.Logger) *httpClient {
 	logger.Info("Creating new http client", lager.Data{"address": address})
 	return &httpClient{
 		username: username,
@@ -52,11 +58,13 @@ func New(username string, password string, address string, logger lager.Logger)
 		address:  address,
 		logger:   logger,
 		client:   defaultClient,
+		retry:    retry,
+		breaker:  breakerFor(address, breaker),
 	}
 }
 
-func (c *httpClient) Put(endpoint string, payload HTTPPayload) (*http.Response, error) {
-	response, err := c.performRequest("PUT", endpoint, HTTPParams{}, payload)
+func (c *httpClient) Put(ctx context.Context, endpoint string, payload HTTPPayload) (*http.Response, error) {
+	response, err := c.performRequest(ctx, "PUT", endpoint, HTTPParams{}, payload)
 	if err != nil {
 		var js interface{}
 		json.Unmarshal(payload, &js)
@@ -69,8 +77,22 @@ func (c *httpClient) Put(endpoint string, payload HTTPPayload) (*http.Response,
 	return response, nil
 }
 
-func (c *httpClient) Post(endpoint string, payload HTTPPayload) (*http.Response, error) {
-	response, err := c.performRequest("POST", endpoint, HTTPParams{}, payload)
+func (c *httpClient) Patch(ctx context.Context, endpoint string, payload HTTPPayload) (*http.Response, error) {
+	response, err := c.performRequest(ctx, "PATCH", endpoint, HTTPParams{}, payload)
+	if err != nil {
+		var js interface{}
+		json.Unmarshal(payload, &js)
+		c.logger.Error("Performing PATCH request", err, lager.Data{
+			"endoint": endpoint,
+			"payload": js,
+		})
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *httpClient) Post(ctx context.Context, endpoint string, payload HTTPPayload) (*http.Response, error) {
+	response, err := c.performRequest(ctx, "POST", endpoint, HTTPParams{}, payload)
 	if err != nil {
 		var js interface{}
 		json.Unmarshal(payload, &js)
@@ -83,8 +105,8 @@ func (c *httpClient) Post(endpoint string, payload HTTPPayload) (*http.Response,
 	return response, nil
 }
 
-func (c *httpClient) Get(endpoint string, params HTTPParams) (*http.Response, error) {
-	response, err := c.performRequest("GET", endpoint, params, HTTPPayload{})
+func (c *httpClient) Get(ctx context.Context, endpoint string, params HTTPParams) (*http.Response, error) {
+	response, err := c.performRequest(ctx, "GET", endpoint, params, HTTPPayload{})
 	if err != nil {
 		c.logger.Error("Performing GET request", err, lager.Data{
 			"endoint": endpoint,
@@ -94,8 +116,8 @@ func (c *httpClient) Get(endpoint string, params HTTPParams) (*http.Response, er
 	return response, nil
 }
 
-func (c *httpClient) Delete(endpoint string) (*http.Response, error) {
-	response, err := c.performRequest("DELETE", endpoint, HTTPParams{}, HTTPPayload{})
+func (c *httpClient) Delete(ctx context.Context, endpoint string) (*http.Response, error) {
+	response, err := c.performRequest(ctx, "DELETE", endpoint, HTTPParams{}, HTTPPayload{})
 	if err != nil {
 		c.logger.Error("Failed to perform DELETE request", err, lager.Data{
 			"endpoint": endpoint,
@@ -116,7 +138,7 @@ func (c *httpClient) buildFullRequestURL(path string, params HTTPParams) string
 	return endpoint.String()
 }
 
-func (c *httpClient) performRequest(verb string, path string, params HTTPParams, payload HTTPPayload) (*http.Response, error) {
+func (c *httpClient) performRequest(ctx context.Context, verb string, path string, params HTTPParams, payload HTTPPayload) (*http.Response, error) {
 	var js interface{}
 	json.Unmarshal(payload, &js)
 	c.logger.Info(
@@ -129,11 +151,61 @@ func (c *httpClient) performRequest(verb string, path string, params HTTPParams,
 		},
 	)
 	requestURL := c.buildFullRequestURL(path, params)
+
+	for attempt := 1; ; attempt++ {
+		if !c.breaker.Allow() {
+			c.logger.Error("The circuit breaker is open", ErrClusterUnavailable, lager.Data{
+				"verb": verb,
+				"path": path,
+			})
+			return nil, ErrClusterUnavailable
+		}
+
+		res, err := c.attemptRequest(ctx, verb, requestURL, payload)
+		if ctx.Err() != nil {
+			// Cancelled requests say nothing about the cluster health.
+			c.breaker.Abandon()
+		} else {
+			c.breaker.Record(!isTransient(res, err))
+		}
+
+		if attempt >= c.retry.MaxAttempts || ctx.Err() != nil || !isRetryable(verb, res, err) {
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+
+		delay := c.retry.backoff(attempt)
+		c.logger.Info("Retrying the request", lager.Data{
+			"verb":    verb,
+			"path":    path,
+			"attempt": attempt,
+			"delay":   delay.String(),
+			"error":   describeFailure(res, err),
+		})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *httpClient) attemptRequest(ctx context.Context, verb string, requestURL string, payload HTTPPayload) (*http.Response, error) {
 	req, err := http.NewRequest(verb, requestURL, bytes.NewReader(payload))
 	if err != nil {
-		return &http.Response{}, err
+		return nil, err
 	}
+	req = req.WithContext(ctx)
 	req.SetBasicAuth(c.username, c.password)
 	req.Header.Add("Content-Type", "application/json")
 	return c.client.Do(req)
 }
+
+func describeFailure(res *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return res.Status
+}
@@ -0,0 +1,116 @@
+package httpclient_test
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/httpclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTP client", func() {
+	var (
+		proxy    testing.HTTPProxy
+		client   httpclient.HTTPClient
+		requests int
+		failures int
+		retry    = httpclient.RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     2 * time.Millisecond,
+		}
+		breaker = httpclient.BreakerPolicy{
+			FailureThreshold: 5,
+			Cooldown:         time.Hour,
+		}
+		logger = lager.NewLogger("test")
+		ctx    = context.Background()
+	)
+
+	BeforeEach(func() {
+		requests = 0
+		proxy = testing.NewHTTPProxy()
+		proxy.RegisterEndpointHandler("/v1/bdbs/1", func(w http.ResponseWriter, r *http.Request) interface{} {
+			requests++
+			if requests <= failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return map[string]interface{}{"description": "rebalancing"}
+			}
+			return map[string]interface{}{"uid": 1}
+		})
+		client = httpclient.New("user", "pass", proxy.URL(), retry, breaker, logger)
+	})
+
+	AfterEach(func() {
+		proxy.Close()
+	})
+
+	Context("When the cluster is temporarily unavailable", func() {
+		BeforeEach(func() {
+			failures = 2
+		})
+
+		It("Retries GET requests until they succeed", func() {
+			res, err := client.Get(ctx, "/v1/bdbs/1", httpclient.HTTPParams{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(requests).To(Equal(3))
+		})
+
+		It("Retries DELETE requests the cluster has rejected with 503", func() {
+			res, err := client.Delete(ctx, "/v1/bdbs/1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(requests).To(Equal(3))
+		})
+
+		It("Does not retry non-idempotent requests", func() {
+			res, err := client.Put(ctx, "/v1/bdbs/1", httpclient.HTTPPayload("{}"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(requests).To(Equal(1))
+		})
+	})
+
+	Context("When the request is cancelled", func() {
+		BeforeEach(func() {
+			failures = 10
+		})
+
+		It("Stops retrying", func() {
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err := client.Get(cancelled, "/v1/bdbs/1", httpclient.HTTPParams{})
+			Expect(err).To(HaveOccurred())
+			Expect(requests).To(Equal(0))
+		})
+	})
+
+	Context("When the retry budget is exhausted", func() {
+		BeforeEach(func() {
+			failures = 10
+		})
+
+		It("Returns the last response", func() {
+			res, err := client.Get(ctx, "/v1/bdbs/1", httpclient.HTTPParams{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(requests).To(Equal(3))
+		})
+
+		It("Fails fast once the circuit breaker opens", func() {
+			client.Get(ctx, "/v1/bdbs/1", httpclient.HTTPParams{})
+			client.Get(ctx, "/v1/bdbs/1", httpclient.HTTPParams{})
+			Expect(requests).To(Equal(5))
+
+			_, err := client.Post(ctx, "/v1/bdbs", httpclient.HTTPPayload("{}"))
+			Expect(err).To(Equal(httpclient.ErrClusterUnavailable))
+			Expect(requests).To(Equal(5))
+		})
+	})
+})
@@ -0,0 +1,7 @@
+package httpclient
+
+import "errors"
+
+var (
+	ErrClusterUnavailable = errors.New("cluster unavailable")
+)
@@ -0,0 +1,86 @@
+package httpclient
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// RetryPolicy describes how idempotent requests are retried when the
+// cluster responds with a transient failure.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first one.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry. Every next delay
+	// is twice as long as the previous one up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var (
+	DefaultRetryPolicy = RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 200 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+	}
+)
+
+// backoff returns a jittered delay before the given retry (1-based).
+// The delay is picked uniformly from [d/2, d) where d is the exponential
+// delay for this retry capped by MaxBackoff.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := int64(d) / 2
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// isTransient tells whether the outcome of a request signals a temporary
+// cluster problem. Such outcomes are counted by the circuit breaker.
+func isTransient(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isRetryable tells whether a request can be repeated safely. GET requests
+// are retried on any transient failure. DELETE requests are retried only when
+// the cluster has definitely not processed them (it refused the connection or
+// replied with 503), otherwise a repeated removal would fail with 404.
+func isRetryable(verb string, res *http.Response, err error) bool {
+	switch verb {
+	case "GET":
+		return isTransient(res, err)
+	case "DELETE":
+		if err != nil {
+			return isDialError(err)
+		}
+		return res.StatusCode == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// isDialError tells whether the request failed before a connection to
+// the cluster has been established.
+func isDialError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
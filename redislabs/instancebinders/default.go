@@ -1,10 +1,12 @@
 package instancebinders
 
 import (
+	"context"
+
+	"code.cloudfoundry.org/lager"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
 	"github.com/pivotal-cf/brokerapi"
-	"github.com/pivotal-golang/lager"
 )
 
 type defaultBinder struct {
@@ -19,32 +21,105 @@ func NewDefault(conf config.Config, logger lager.Logger) *defaultBinder {
 	}
 }
 
-func (d *defaultBinder) Unbind(instanceID string, bindingID string, persister persisters.StatePersister) error {
-	return nil
+// Unbind forgets the binding. The bindings made before they have been
+// recorded are not known, so an unknown one is not an error.
+func (d *defaultBinder) Unbind(ctx context.Context, instanceID string, bindingID string, persister persisters.StatePersister) error {
+	err := persister.Update(func(state *persisters.State) error {
+		left := []persisters.ServiceBinding{}
+		for _, binding := range state.Bindings {
+			if binding.ID != bindingID || binding.InstanceID != instanceID {
+				left = append(left, binding)
+			}
+		}
+		state.Bindings = left
+		return nil
+	})
+	if err != nil {
+		d.logger.Error("Failed to save the broker state after unbinding", err, lager.Data{
+			"instance-id": instanceID,
+			"binding-id":  bindingID,
+		})
+	}
+	return err
 }
 
-func (d *defaultBinder) InstanceExists(instanceID string, persister persisters.StatePersister) (bool, error) {
+func (d *defaultBinder) InstanceExists(ctx context.Context, instanceID string, persister persisters.StatePersister) (bool, error) {
 	return false, nil
 }
 
-func (d *defaultBinder) Bind(instanceID string, bindingID string, persister persisters.StatePersister) (interface{}, error) {
+func (d *defaultBinder) Bind(ctx context.Context, instanceID string, bindingID string, persister persisters.StatePersister) (interface{}, error) {
+	var credentials interface{}
+	err := persister.Update(func(state *persisters.State) error {
+		instance, found := findInstance(state, instanceID)
+		if !found {
+			return brokerapi.ErrInstanceDoesNotExist
+		}
+		for _, binding := range state.Bindings {
+			if binding.ID != bindingID {
+				continue
+			}
+			if binding.InstanceID != instanceID {
+				return brokerapi.ErrBindingAlreadyExists
+			}
+			// Binding again returns the same credentials.
+			credentials = instanceCredentials(instance)
+			return nil
+		}
+		state.Bindings = append(state.Bindings, persisters.ServiceBinding{
+			ID:         bindingID,
+			InstanceID: instanceID,
+		})
+		credentials = instanceCredentials(instance)
+		return nil
+	})
+	if err == brokerapi.ErrInstanceDoesNotExist || err == brokerapi.ErrBindingAlreadyExists {
+		return nil, err
+	}
+	if err != nil {
+		d.logger.Error("Failed to save the broker state after binding", err)
+		return nil, err
+	}
+	d.logger.Info("Returning the service credentials", lager.Data{
+		"instance-id": instanceID,
+		"binding-id":  bindingID,
+	})
+	return credentials, nil
+}
+
+// Binding returns the credentials of a recorded binding.
+func (d *defaultBinder) Binding(ctx context.Context, instanceID string, bindingID string, persister persisters.StatePersister) (interface{}, error) {
 	state, err := persister.Load()
 	if err != nil {
 		d.logger.Error("Failed to load the broker state", err)
 		return nil, err
 	}
+	instance, found := findInstance(state, instanceID)
+	if !found {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	}
+	for _, binding := range state.Bindings {
+		if binding.ID == bindingID && binding.InstanceID == instanceID {
+			return instanceCredentials(instance), nil
+		}
+	}
+	return nil, brokerapi.ErrBindingDoesNotExist
+}
+
+func findInstance(state *persisters.State, instanceID string) (persisters.ServiceInstance, bool) {
 	for _, instance := range state.AvailableInstances {
 		if instance.ID == instanceID {
-			creds := instance.Credentials
-			d.logger.Info("Returning the service credentials", lager.Data{
-				"credentials": creds,
-			})
-			return map[string]interface{}{
-				"port":     creds.Port,
-				"ip_list":  creds.IPList,
-				"password": creds.Password,
-			}, nil
+			return instance, true
 		}
 	}
-	return nil, brokerapi.ErrInstanceDoesNotExist
+	return persisters.ServiceInstance{}, false
+}
+
+// instanceCredentials are what an app bound to the instance gets.
+func instanceCredentials(instance persisters.ServiceInstance) map[string]interface{} {
+	creds := instance.Credentials
+	return map[string]interface{}{
+		"port":     creds.Port,
+		"ip_list":  creds.IPList,
+		"password": creds.Password,
+	}
 }
@@ -1,159 +1,375 @@
 package instancecreators
 
 import (
+	"context"
 	"fmt"
-	"sync"
 	"time"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/capacity"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/locks"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
 	"github.com/pivotal-cf/brokerapi"
-	"github.com/pivotal-golang/lager"
 )
 
 type defaultCreator struct {
-	lock   sync.Mutex
-	logger lager.Logger
-	conf   config.Config
+	// instanceLocks serializes the cluster work on an instance while
+	// different instances are handled in parallel.
+	instanceLocks *locks.Keyed
+	logger        lager.Logger
+	conf          config.Config
+	api           apiclient.Client
 }
 
 var (
+	// Default used unless the database timeout is configured.
 	WaitingForDatabaseTimeout = 15 //seconds
 )
 
 func NewDefault(conf config.Config, logger lager.Logger) *defaultCreator {
+	return NewDefaultWithClient(apiclient.New(conf, logger, nil), conf, logger)
+}
+
+// NewDefaultWithClient returns a creator that talks to the cluster
+// through the given client.
+func NewDefaultWithClient(api apiclient.Client, conf config.Config, logger lager.Logger) *defaultCreator {
 	return &defaultCreator{
-		conf:   conf,
-		logger: logger,
+		instanceLocks: locks.NewKeyed(),
+		conf:          conf,
+		logger:        logger,
+		api:           api,
 	}
 }
 
-func (d *defaultCreator) Create(instanceID string, settings map[string]interface{}, persister persisters.StatePersister) error {
-	d.lock.Lock()
-	defer d.lock.Unlock()
+func (d *defaultCreator) Create(ctx context.Context, instanceID string, details persisters.InstanceDetails, settings apiclient.DatabaseSettings, persister persisters.StatePersister) error {
+	unlock, err := d.lockInstance(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	// Load the broker state.
+	// Check whether the instance already exists.
 	d.logger.Info("Loading the broker state", lager.Data{
 		"instance-id": instanceID,
 	})
-	state, err := persister.Load()
+	_, found, err := d.findInstance(instanceID, persister)
 	if err != nil {
-		d.logger.Fatal("Failed to load the broker state", err)
 		return ErrFailedToLoadState
 	}
+	if found {
+		d.logger.Error(fmt.Sprintf("Received a request to create an instance with ID %s that already exists", instanceID), ErrInstanceExists)
+		return ErrInstanceExists
+	}
 
-	// Check whether the instance already exists.
-	for _, s := range (*state).AvailableInstances {
-		if s.ID == instanceID {
-			d.logger.Error(fmt.Sprintf("Received a request to create an instance with ID %s that already exists", instanceID), ErrInstanceExists)
-			return ErrInstanceExists
-		}
+	// Make sure the database fits into the cluster.
+	if err = d.capacityChecker().Check(ctx, capacity.RequirementOf(settings)); err != nil {
+		return err
 	}
 
 	// Ask the cluster to create a database.
 	d.logger.Info("Creating a database", lager.Data{
 		"instance-id": instanceID,
 	})
-	credentials, err := d.createDatabase(settings)
+	credentials, err := d.createDatabase(ctx, settings)
 	if err != nil {
 		return err
 	}
 
 	// Save the new state.
 	s := persisters.ServiceInstance{ // the future state
-		ID:          instanceID,
-		Credentials: credentials,
+		ID:              instanceID,
+		Credentials:     credentials,
+		InstanceDetails: details,
 	}
-	(*state).AvailableInstances = append((*state).AvailableInstances, s)
 	d.logger.Info("Saving the broker state", lager.Data{
 		"instance-id": instanceID,
 	})
-	if err = persister.Save(state); err != nil {
+	err = d.modifyState(persister, func(state *persisters.State) error {
+		// Another broker process may have created the instance since
+		// the state has been loaded.
+		for _, instance := range state.AvailableInstances {
+			if instance.ID == instanceID {
+				return ErrInstanceExists
+			}
+		}
+		state.AvailableInstances = append(state.AvailableInstances, s)
+		return nil
+	})
+	if err == ErrInstanceExists {
+		d.logger.Error("The instance has been created concurrently, deleting the new database", err, lager.Data{
+			"instance-id": instanceID,
+			"UID":         credentials.UID,
+		})
+		if err := d.deleteDatabase(ctx, credentials.UID); err != nil {
+			d.logger.Error("Failed to delete the database of the duplicate instance", err, lager.Data{
+				"UID": credentials.UID,
+			})
+		}
+		return ErrInstanceExists
+	}
+	if err != nil {
 		d.logger.Error("Failed to save the new state", err)
 		return ErrFailedToSaveState
 	}
 	return nil
 }
 
-func (d *defaultCreator) Update(instanceID string, params map[string]interface{}, persister persisters.StatePersister) error {
-	state, err := persister.Load()
+func (d *defaultCreator) Update(ctx context.Context, instanceID string, details persisters.InstanceDetails, settings apiclient.DatabaseSettings, persister persisters.StatePersister) error {
+	unlock, err := d.lockInstance(ctx, instanceID)
 	if err != nil {
-		d.logger.Error("Failed to load the broker state", err)
 		return err
 	}
-	for _, instance := range state.AvailableInstances {
-		if instance.ID == instanceID {
-			return d.updateDatabase(instance.Credentials.UID, params)
-		}
-	}
-	return brokerapi.ErrInstanceDoesNotExist
-}
+	defer unlock()
 
-func (d *defaultCreator) Destroy(instanceID string, persister persisters.StatePersister) error {
-	state, err := persister.Load()
+	instance, found, err := d.findInstance(instanceID, persister)
 	if err != nil {
-		d.logger.Error("Failed to load the broker state", err)
 		return err
 	}
+	if !found {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	if err = d.checkUpdateCapacity(ctx, instance.Credentials.UID, settings); err != nil {
+		return err
+	}
+	if err = d.updateDatabase(ctx, instance.Credentials.UID, settings); err != nil {
+		return err
+	}
+	if details.PlanID == "" || details.PlanID == instance.PlanID {
+		return nil
+	}
 
-	instancesLeft := []persisters.ServiceInstance{}
-	removed := false
-	for _, instance := range state.AvailableInstances {
-		if instance.ID == instanceID {
-			if err := d.deleteDatabase(instance.Credentials.UID); err != nil {
-				return err
+	// Record the new plan.
+	err = d.modifyState(persister, func(state *persisters.State) error {
+		for i := range state.AvailableInstances {
+			if state.AvailableInstances[i].ID == instanceID {
+				state.AvailableInstances[i].PlanID = details.PlanID
 			}
-			removed = true
-		} else {
-			instancesLeft = append(instancesLeft, instance)
 		}
+		return nil
+	})
+	if err != nil {
+		d.logger.Error("Failed to save the new broker state after the instance update", err, lager.Data{
+			"instance-id": instanceID,
+		})
+		return ErrFailedToSaveState
 	}
+	return nil
+}
 
-	if !removed {
+func (d *defaultCreator) Destroy(ctx context.Context, instanceID string, persister persisters.StatePersister) error {
+	unlock, err := d.lockInstance(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	instance, found, err := d.findInstance(instanceID, persister)
+	if err != nil {
+		return err
+	}
+	if !found {
 		return brokerapi.ErrInstanceDoesNotExist
 	}
 
+	gone := false
+	err = d.deleteDatabase(ctx, instance.Credentials.UID)
+	if apiclient.IsNotFound(err) {
+		// The database has been removed bypassing the broker.
+		d.logger.Info("The cluster does not know the database of the instance", lager.Data{
+			"instance-id": instanceID,
+			"UID":         instance.Credentials.UID,
+		})
+		gone = true
+	} else if err != nil {
+		return err
+	}
+
 	// Save the new broker state.
-	state.AvailableInstances = instancesLeft
-	if err = persister.Save(state); err != nil {
+	err = d.modifyState(persister, func(state *persisters.State) error {
+		instancesLeft := []persisters.ServiceInstance{}
+		for _, instance := range state.AvailableInstances {
+			if instance.ID != instanceID {
+				instancesLeft = append(instancesLeft, instance)
+			}
+		}
+		state.AvailableInstances = instancesLeft
+		bindingsLeft := []persisters.ServiceBinding{}
+		for _, binding := range state.Bindings {
+			if binding.InstanceID != instanceID {
+				bindingsLeft = append(bindingsLeft, binding)
+			}
+		}
+		state.Bindings = bindingsLeft
+		return nil
+	})
+	if err != nil {
 		d.logger.Error("Failed to save the new broker state after the instance removal", err, lager.Data{
 			"instance-id": instanceID,
 		})
-		return err
+		return ErrFailedToSaveState
+	}
+	if gone {
+		return brokerapi.ErrInstanceDoesNotExist
 	}
 	return nil
 }
 
-func (d *defaultCreator) InstanceExists(instanceID string, persister persisters.StatePersister) (bool, error) {
+// Database returns the database with the UID as the cluster reports it.
+func (d *defaultCreator) Database(ctx context.Context, UID int) (apiclient.Database, error) {
+	return d.api.GetDatabase(ctx, UID)
+}
+
+// lockInstance waits until no other operation works on the instance.
+func (d *defaultCreator) lockInstance(ctx context.Context, instanceID string) (func(), error) {
+	unlock, err := d.instanceLocks.Lock(ctx, instanceID)
+	if err != nil {
+		d.logger.Error("Gave up waiting for another operation on the instance", err, lager.Data{
+			"instance-id": instanceID,
+		})
+	}
+	return unlock, err
+}
+
+// findInstance looks the instance up in the broker state.
+func (d *defaultCreator) findInstance(instanceID string, persister persisters.StatePersister) (persisters.ServiceInstance, bool, error) {
+	state, err := persister.Load()
+	if err != nil {
+		d.logger.Error("Failed to load the broker state", err)
+		return persisters.ServiceInstance{}, false, err
+	}
+	for _, instance := range state.AvailableInstances {
+		if instance.ID == instanceID {
+			return instance, true, nil
+		}
+	}
+	return persisters.ServiceInstance{}, false, nil
+}
+
+// modifyState applies the change to the latest broker state, so that
+// the changes of operations running in parallel are not lost. The state
+// is left as it is if the change returns an error.
+func (d *defaultCreator) modifyState(persister persisters.StatePersister, modify func(*persisters.State) error) error {
+	return persister.Update(modify)
+}
+
+func (d *defaultCreator) InstanceExists(ctx context.Context, instanceID string, persister persisters.StatePersister) (bool, error) {
 	return false, nil
 }
 
-func (d *defaultCreator) createDatabase(settings map[string]interface{}) (cluster.InstanceCredentials, error) {
-	api := apiclient.New(d.conf, d.logger)
-	ch, err := api.CreateDatabase(settings)
+func (d *defaultCreator) capacityChecker() *capacity.Checker {
+	return capacity.NewChecker(d.api, d.conf.Cluster.Capacity.Headroom, d.logger)
+}
+
+// checkUpdateCapacity makes sure the resources the update adds to
+// the database fit into the cluster.
+func (d *defaultCreator) checkUpdateCapacity(ctx context.Context, UID int, settings apiclient.DatabaseSettings) error {
+	database, err := d.api.GetDatabase(ctx, UID)
+	if err != nil {
+		// Let the update request itself report the problem.
+		d.logger.Error("Failed to get the database, skipping the capacity check", err, lager.Data{
+			"UID": UID,
+		})
+		return nil
+	}
+	// Settings left out by the update keep their current values.
+	if settings.MemorySize == 0 && settings.Extra["memory_size"] == nil {
+		settings.MemorySize = database.MemorySize
+	}
+	if settings.ShardsCount == 0 && settings.Extra["shards_count"] == nil {
+		settings.ShardsCount = int64(database.ShardsCount)
+	}
+	if settings.Replication == nil && settings.Extra["replication"] == nil {
+		settings.Replication = apiclient.Bool(database.Replication)
+	}
+	return d.capacityChecker().Check(ctx, capacity.RequirementOf(settings).Extra(capacity.RequirementOfDatabase(database)))
+}
+
+func (d *defaultCreator) createDatabase(ctx context.Context, settings apiclient.DatabaseSettings) (cluster.InstanceCredentials, error) {
+	// Cancelling the context on return stops the cluster polling.
+	ctx, cancel := context.WithTimeout(ctx, d.databaseTimeout())
+	defer cancel()
+
+	ch, err := d.api.CreateDatabase(ctx, settings)
 	if err != nil {
 		return cluster.InstanceCredentials{}, err //ErrFailedToCreateDatabase
 	}
 
-	for {
-		select {
-		case credentials := <-ch:
-			return credentials, nil
-		case <-time.After(time.Second * time.Duration(WaitingForDatabaseTimeout)):
-			d.logger.Error("Waiting for a database timeout is expired", ErrCreateDatabaseTimeoutExpired)
-			return cluster.InstanceCredentials{}, ErrCreateDatabaseTimeoutExpired
-		}
+	result := <-ch
+	switch result.Outcome {
+	case apiclient.DatabaseActive:
+		return result.Credentials, nil
+	case apiclient.DatabaseFailed:
+		err = fmt.Errorf("%s: %s", ErrFailedToCreateDatabase, result.Reason)
+	case apiclient.DatabaseDeleted:
+		err = ErrDatabaseDeleted
+	default:
+		err = d.timeoutError(result, ErrCreateDatabaseTimeoutExpired)
 	}
+	d.logger.Error("Waiting for a database to become active", err)
+	return cluster.InstanceCredentials{}, err
 }
 
-func (d *defaultCreator) updateDatabase(UID int, params map[string]interface{}) error {
-	api := apiclient.New(d.conf, d.logger)
-	return api.UpdateDatabase(UID, params)
+func (d *defaultCreator) updateDatabase(ctx context.Context, UID int, settings apiclient.DatabaseSettings) error {
+	ctx, cancel := context.WithTimeout(ctx, d.databaseTimeout())
+	defer cancel()
+
+	if err := d.api.UpdateDatabase(ctx, UID, settings); err != nil {
+		return err
+	}
+
+	result := <-d.api.WatchDatabase(ctx, UID, apiclient.WaitForActive)
+	var err error
+	switch result.Outcome {
+	case apiclient.DatabaseActive:
+		return nil
+	case apiclient.DatabaseFailed:
+		err = fmt.Errorf("%s: %s", ErrFailedToUpdateDatabase, result.Reason)
+	case apiclient.DatabaseDeleted:
+		err = ErrDatabaseDeleted
+	default:
+		err = d.timeoutError(result, ErrUpdateDatabaseTimeoutExpired)
+	}
+	d.logger.Error("Waiting for a database to apply the update", err, lager.Data{
+		"UID": UID,
+	})
+	return err
+}
+
+func (d *defaultCreator) deleteDatabase(ctx context.Context, UID int) error {
+	ctx, cancel := context.WithTimeout(ctx, d.databaseTimeout())
+	defer cancel()
+
+	if err := d.api.DeleteDatabase(ctx, UID); err != nil {
+		return err
+	}
+
+	result := <-d.api.WatchDatabase(ctx, UID, apiclient.WaitForDeletion)
+	if result.Outcome == apiclient.DatabaseDeleted {
+		return nil
+	}
+	err := d.timeoutError(result, ErrDeleteDatabaseTimeoutExpired)
+	d.logger.Error("Waiting for a database to be removed", err, lager.Data{
+		"UID": UID,
+	})
+	return err
 }
 
-func (d *defaultCreator) deleteDatabase(UID int) error {
-	api := apiclient.New(d.conf, d.logger)
-	return api.DeleteDatabase(UID)
+// timeoutError returns the given timeout error if the watcher has run out
+// of time and the context error if the request has been cancelled.
+func (d *defaultCreator) timeoutError(result apiclient.WatchResult, timeoutErr error) error {
+	if result.Err != nil && result.Err != context.DeadlineExceeded {
+		return result.Err
+	}
+	return timeoutErr
+}
+
+func (d *defaultCreator) databaseTimeout() time.Duration {
+	timeout := d.conf.Cluster.Timeouts.Database
+	if timeout <= 0 {
+		timeout = WaitingForDatabaseTimeout
+	}
+	return time.Duration(timeout) * time.Second
 }
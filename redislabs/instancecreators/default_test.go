@@ -0,0 +1,222 @@
+package instancecreators_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient/fakes"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/capacity"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+	brokerconfig "github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/instancecreators"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Default creator", func() {
+	var (
+		api         *fakes.FakeClient
+		persister   persisters.StatePersister
+		tmpStateDir string
+		ctx         = context.Background()
+		logger      = lager.NewLogger("test")
+	)
+
+	creator := func() redislabs.ServiceInstanceCreator {
+		return instancecreators.NewDefaultWithClient(api, brokerconfig.Config{}, logger)
+	}
+
+	BeforeEach(func() {
+		api = &fakes.FakeClient{}
+		var err error
+		tmpStateDir, err = ioutil.TempDir("", "redislabs-state-test")
+		Expect(err).NotTo(HaveOccurred())
+		persister = persisters.NewLocalPersister(path.Join(tmpStateDir, "state.json"))
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpStateDir)
+	})
+
+	Context("When the cluster fails to create a database", func() {
+		BeforeEach(func() {
+			api.WatchResult = apiclient.WatchResult{
+				Outcome: apiclient.DatabaseFailed,
+				Reason:  "not enough memory",
+			}
+		})
+
+		It("Reports the reason and does not record the instance", func() {
+			err := creator().Create(ctx, "instance-id", persisters.InstanceDetails{}, apiclient.DatabaseSettings{Name: "cf"}, persister)
+			Expect(err).To(MatchError(ContainSubstring("not enough memory")))
+
+			state, err := persister.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.AvailableInstances).To(BeEmpty())
+		})
+	})
+
+	Context("When another broker process records the instance in the meantime", func() {
+		BeforeEach(func() {
+			api.WatchResult = apiclient.WatchResult{
+				Outcome:     apiclient.DatabaseActive,
+				Credentials: cluster.InstanceCredentials{UID: 7},
+			}
+			persister = &racingPersister{
+				StatePersister: persister,
+				other:          persisters.ServiceInstance{ID: "instance-id", Credentials: cluster.InstanceCredentials{UID: 5}},
+			}
+		})
+
+		It("Deletes the new database and keeps the recorded instance", func() {
+			err := creator().Create(ctx, "instance-id", persisters.InstanceDetails{}, apiclient.DatabaseSettings{Name: "cf"}, persister)
+			Expect(err).To(Equal(instancecreators.ErrInstanceExists))
+			Expect(api.DeletedUIDs).To(Equal([]int{7}))
+
+			state, err := persister.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.AvailableInstances).To(HaveLen(1))
+			Expect(state.AvailableInstances[0].Credentials.UID).To(Equal(5))
+		})
+	})
+
+	Context("When there is an instance", func() {
+		BeforeEach(func() {
+			err := persister.Save(&persisters.State{
+				AvailableInstances: []persisters.ServiceInstance{
+					{ID: "instance-id", Credentials: cluster.InstanceCredentials{UID: 3}},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Updates the database the instance refers to", func() {
+			api.WatchResult = apiclient.WatchResult{Outcome: apiclient.DatabaseActive}
+			settings := apiclient.DatabaseSettings{MemorySize: 2048}
+			Expect(creator().Update(ctx, "instance-id", persisters.InstanceDetails{}, settings, persister)).To(Succeed())
+			Expect(api.UpdatedUIDs).To(Equal([]int{3}))
+			Expect(api.UpdatedSettings).To(Equal([]apiclient.DatabaseSettings{settings}))
+		})
+
+		Context("And the cluster is nearly full", func() {
+			BeforeEach(func() {
+				api.Databases = map[int]apiclient.Database{
+					3: {UID: 3, MemorySize: 1024, ShardsCount: 1},
+				}
+				api.Nodes = []apiclient.Node{{UID: 1, TotalMemory: 8192, MaxRedisServers: 10}}
+				api.NodesStats = map[int]apiclient.NodeStats{1: {ProvisionalMemory: 2048}}
+			})
+
+			It("Rejects an upgrade that needs more memory than is left", func() {
+				settings := apiclient.DatabaseSettings{MemorySize: 2048, Replication: apiclient.Bool(true)}
+				err := creator().Update(ctx, "instance-id", persisters.InstanceDetails{}, settings, persister)
+				Expect(err).To(BeAssignableToTypeOf(&capacity.Error{}))
+				Expect(api.UpdatedUIDs).To(BeEmpty())
+			})
+
+			It("Counts only the memory the upgrade adds", func() {
+				api.WatchResult = apiclient.WatchResult{Outcome: apiclient.DatabaseActive}
+				settings := apiclient.DatabaseSettings{MemorySize: 3072}
+				Expect(creator().Update(ctx, "instance-id", persisters.InstanceDetails{}, settings, persister)).To(Succeed())
+				Expect(api.UpdatedUIDs).To(Equal([]int{3}))
+			})
+		})
+
+		It("Does not lose state changes of operations running in parallel", func() {
+			api.WatchResult = apiclient.WatchResult{Outcome: apiclient.DatabaseActive}
+			c := creator()
+			var wg sync.WaitGroup
+			for _, id := range []string{"instance-1", "instance-2", "instance-3"} {
+				wg.Add(1)
+				go func(id string) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					Expect(c.Create(ctx, id, persisters.InstanceDetails{}, apiclient.DatabaseSettings{Name: "cf"}, persister)).To(Succeed())
+				}(id)
+			}
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				details := persisters.InstanceDetails{PlanID: "larger-plan"}
+				Expect(c.Update(ctx, "instance-id", details, apiclient.DatabaseSettings{}, persister)).To(Succeed())
+			}()
+			wg.Wait()
+
+			state, err := persister.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.AvailableInstances).To(HaveLen(4))
+			Expect(state.AvailableInstances).To(ContainElement(persisters.ServiceInstance{
+				ID:              "instance-id",
+				Credentials:     cluster.InstanceCredentials{UID: 3},
+				InstanceDetails: persisters.InstanceDetails{PlanID: "larger-plan"},
+			}))
+		})
+
+		It("Keeps the instance if the database removal fails", func() {
+			api.DeleteError = errors.New("cluster unavailable")
+			Expect(creator().Destroy(ctx, "instance-id", persister)).NotTo(Succeed())
+
+			state, err := persister.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.AvailableInstances).To(HaveLen(1))
+		})
+
+		It("Reports a failure to save the state after the database removal", func() {
+			api.WatchResult = apiclient.WatchResult{Outcome: apiclient.DatabaseDeleted}
+			persister = &failingPersister{StatePersister: persister, err: errors.New("disk full")}
+			Expect(creator().Destroy(ctx, "instance-id", persister)).To(Equal(instancecreators.ErrFailedToSaveState))
+		})
+
+		It("Forgets the instance once the database is gone", func() {
+			api.WatchResult = apiclient.WatchResult{Outcome: apiclient.DatabaseDeleted}
+			Expect(creator().Destroy(ctx, "instance-id", persister)).To(Succeed())
+			Expect(api.DeletedUIDs).To(Equal([]int{3}))
+
+			state, err := persister.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.AvailableInstances).To(BeEmpty())
+		})
+	})
+})
+
+// racingPersister records another instance right before the first update,
+// the way another broker process would.
+type racingPersister struct {
+	persisters.StatePersister
+	other persisters.ServiceInstance
+}
+
+func (p *racingPersister) Update(change func(*persisters.State) error) error {
+	if p.other.ID != "" {
+		other := p.other
+		p.other = persisters.ServiceInstance{}
+		err := p.StatePersister.Update(func(state *persisters.State) error {
+			state.AvailableInstances = append(state.AvailableInstances, other)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return p.StatePersister.Update(change)
+}
+
+// failingPersister loads the state but fails to change it.
+type failingPersister struct {
+	persisters.StatePersister
+	err error
+}
+
+func (p *failingPersister) Update(change func(*persisters.State) error) error {
+	return p.err
+}
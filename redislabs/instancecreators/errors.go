@@ -7,5 +7,9 @@ var (
 	ErrInstanceExists               = errors.New("such instance already exists")
 	ErrFailedToSaveState            = errors.New("failed to save the new broker state")
 	ErrFailedToCreateDatabase       = errors.New("failed to create a database")
+	ErrFailedToUpdateDatabase       = errors.New("failed to update the database")
+	ErrDatabaseDeleted              = errors.New("the database has been deleted")
 	ErrCreateDatabaseTimeoutExpired = errors.New("create database timeout expired")
+	ErrUpdateDatabaseTimeoutExpired = errors.New("update database timeout expired")
+	ErrDeleteDatabaseTimeoutExpired = errors.New("delete database timeout expired")
 )
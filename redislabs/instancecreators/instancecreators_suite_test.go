@@ -0,0 +1,13 @@
+package instancecreators_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestInstanceCreators(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Instance Creators Suite")
+}
@@ -0,0 +1,71 @@
+package locks
+
+import (
+	"context"
+	"sync"
+)
+
+type (
+	// Keyed hands out a lock per key, so that work on different keys
+	// runs in parallel while work on the same key is serialized.
+	Keyed struct {
+		lock    sync.Mutex
+		entries map[string]*entry
+	}
+
+	entry struct {
+		ch chan struct{}
+		// refs counts the holder and the waiters, the entry is dropped
+		// once nobody needs it.
+		refs int
+	}
+)
+
+func NewKeyed() *Keyed {
+	return &Keyed{entries: map[string]*entry{}}
+}
+
+// Lock waits for the lock of the key and returns the function releasing
+// it. It gives up and returns the context error if the context is done
+// first.
+func (k *Keyed) Lock(ctx context.Context, key string) (func(), error) {
+	k.lock.Lock()
+	e, ok := k.entries[key]
+	if !ok {
+		e = &entry{ch: make(chan struct{}, 1)}
+		k.entries[key] = e
+	}
+	e.refs++
+	k.lock.Unlock()
+
+	select {
+	case e.ch <- struct{}{}:
+	case <-ctx.Done():
+		k.release(key, e)
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-e.ch
+			k.release(key, e)
+		})
+	}, nil
+}
+
+// Len returns the number of keys locked or waited for.
+func (k *Keyed) Len() int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return len(k.entries)
+}
+
+func (k *Keyed) release(key string, e *entry) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	e.refs--
+	if e.refs == 0 {
+		delete(k.entries, key)
+	}
+}
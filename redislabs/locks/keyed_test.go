@@ -0,0 +1,60 @@
+package locks_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/locks"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Keyed", func() {
+	var keyed *locks.Keyed
+
+	BeforeEach(func() {
+		keyed = locks.NewKeyed()
+	})
+
+	It("Does not block other keys", func() {
+		unlock, err := keyed.Lock(context.Background(), "instance-1")
+		Expect(err).NotTo(HaveOccurred())
+		defer unlock()
+
+		unlockOther, err := keyed.Lock(context.Background(), "instance-2")
+		Expect(err).NotTo(HaveOccurred())
+		unlockOther()
+	})
+
+	It("Serializes the holders of the same key", func() {
+		unlock, err := keyed.Lock(context.Background(), "instance-1")
+		Expect(err).NotTo(HaveOccurred())
+
+		acquired := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			unlockSecond, err := keyed.Lock(context.Background(), "instance-1")
+			Expect(err).NotTo(HaveOccurred())
+			close(acquired)
+			unlockSecond()
+		}()
+
+		Consistently(acquired, 50*time.Millisecond).ShouldNot(BeClosed())
+		unlock()
+		Eventually(acquired).Should(BeClosed())
+		Eventually(keyed.Len).Should(Equal(0))
+	})
+
+	It("Stops waiting when the context is done", func() {
+		unlock, err := keyed.Lock(context.Background(), "instance-1")
+		Expect(err).NotTo(HaveOccurred())
+		defer unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = keyed.Lock(ctx, "instance-1")
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		Expect(keyed.Len()).To(Equal(1))
+	})
+})
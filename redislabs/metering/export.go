@@ -0,0 +1,111 @@
+package metering
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// Output formats of an export.
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// bytesPerGB is the gigabyte the memory-hours are measured in.
+const bytesPerGB = 1 << 30
+
+// Levels a summary sums the records up at.
+const (
+	ByOrganization = "organization"
+	BySpace        = "space"
+)
+
+// Usage is the memory an organization or one of its spaces has held over
+// a period, measured in gigabyte-hours.
+type Usage struct {
+	OrganizationGUID string `json:"organization_guid"`
+	// SpaceGUID is empty in the organization totals.
+	SpaceGUID        string  `json:"space_guid,omitempty"`
+	AllocatedGBHours float64 `json:"allocated_memory_gb_hours"`
+	UsedGBHours      float64 `json:"used_memory_gb_hours"`
+}
+
+// Summarize sums the records up per organization space, or per
+// organization if by is ByOrganization.
+func Summarize(records []Record, by string) ([]Usage, error) {
+	if by != ByOrganization && by != BySpace {
+		return nil, fmt.Errorf("unknown summary level %q", by)
+	}
+	type key struct {
+		org   string
+		space string
+	}
+	index := map[key]int{}
+	usages := []Usage{}
+	for _, r := range records {
+		k := key{r.OrganizationGUID, r.SpaceGUID}
+		if by == ByOrganization {
+			k.space = ""
+		}
+		i, ok := index[k]
+		if !ok {
+			usages = append(usages, Usage{OrganizationGUID: k.org, SpaceGUID: k.space})
+			i = len(usages) - 1
+			index[k] = i
+		}
+		usages[i].AllocatedGBHours += r.AllocatedByteHours / bytesPerGB
+		usages[i].UsedGBHours += r.UsedByteHours / bytesPerGB
+	}
+	sort.Sort(byOwner(usages))
+	return usages, nil
+}
+
+// Export writes the usage summed up at the given level in the given
+// format.
+func Export(w io.Writer, usages []Usage, by string, format string) error {
+	switch format {
+	case FormatCSV:
+		return writeCSV(w, usages, by == ByOrganization)
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(usages)
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+func writeCSV(w io.Writer, usages []Usage, byOrganization bool) error {
+	writer := csv.NewWriter(w)
+	header := []string{"organization_guid", "space_guid", "allocated_memory_gb_hours", "used_memory_gb_hours"}
+	if byOrganization {
+		header = append(header[:1], header[2:]...)
+	}
+	writer.Write(header)
+	for _, u := range usages {
+		row := []string{u.OrganizationGUID}
+		if !byOrganization {
+			row = append(row, u.SpaceGUID)
+		}
+		writer.Write(append(row,
+			strconv.FormatFloat(u.AllocatedGBHours, 'f', 4, 64),
+			strconv.FormatFloat(u.UsedGBHours, 'f', 4, 64),
+		))
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+type byOwner []Usage
+
+func (u byOwner) Len() int      { return len(u) }
+func (u byOwner) Swap(i, j int) { u[i], u[j] = u[j], u[i] }
+func (u byOwner) Less(i, j int) bool {
+	if u[i].OrganizationGUID == u[j].OrganizationGUID {
+		return u[i].SpaceGUID < u[j].SpaceGUID
+	}
+	return u[i].OrganizationGUID < u[j].OrganizationGUID
+}
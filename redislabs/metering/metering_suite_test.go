@@ -0,0 +1,13 @@
+package metering_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestMetering(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Metering Suite")
+}
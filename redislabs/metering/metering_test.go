@@ -0,0 +1,226 @@
+package metering_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient/fakes"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/files"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/metering"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const gb = 1 << 30
+
+var _ = Describe("Metering", func() {
+	var (
+		api       *fakes.FakeClient
+		persister persisters.StatePersister
+		store     metering.Store
+		tmpDir    string
+		ctx       = context.Background()
+		logger    = lager.NewLogger("test")
+		start     = time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "redislabs-metering-test")
+		Expect(err).NotTo(HaveOccurred())
+		persister = persisters.NewLocalPersister(path.Join(tmpDir, "state.json"))
+		store = metering.NewFileStore(path.Join(tmpDir, "metering"), 0)
+
+		instance := func(id string, UID int, org string, space string) persisters.ServiceInstance {
+			return persisters.ServiceInstance{
+				ID:          id,
+				Credentials: cluster.InstanceCredentials{UID: UID},
+				InstanceDetails: persisters.InstanceDetails{
+					PlanID:           "plan",
+					OrganizationGUID: org,
+					SpaceGUID:        space,
+				},
+			}
+		}
+		err = persister.Save(&persisters.State{
+			AvailableInstances: []persisters.ServiceInstance{
+				instance("a", 1, "org-1", "space-1"),
+				instance("b", 2, "org-1", "space-1"),
+				instance("c", 3, "org-2", "space-2"),
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		api = &fakes.FakeClient{
+			Databases: map[int]apiclient.Database{
+				1: {UID: 1, MemorySize: 1 * gb},
+				2: {UID: 2, MemorySize: 1 * gb, Replication: true},
+				3: {UID: 3, MemorySize: 4 * gb},
+			},
+			DatabasesStats: map[int]apiclient.DatabaseStats{
+				1: {UsedMemory: gb / 2},
+				3: {UsedMemory: 1 * gb},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	// sampleFor takes a sample every 30 minutes for the given hours.
+	sampleFor := func(hours int) {
+		sampler := metering.NewSampler(api, persister, store, 1800, logger)
+		for i := 1; i <= hours*2; i++ {
+			Expect(sampler.Sample(ctx, start.Add(time.Duration(i)*30*time.Minute))).To(Succeed())
+		}
+	}
+
+	It("Sums the samples of an instance up into hourly records", func() {
+		sampleFor(2)
+		records, err := store.Records(start, start.Add(24*time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		// The last sample falls into the third bucket.
+		Expect(records).To(HaveLen(9))
+		Expect(records[3]).To(Equal(metering.Record{
+			Bucket:             start.Add(time.Hour),
+			InstanceID:         "a",
+			PlanID:             "plan",
+			OrganizationGUID:   "org-1",
+			SpaceGUID:          "space-1",
+			Samples:            2,
+			AllocatedByteHours: 1 * gb,
+			UsedByteHours:      gb / 2,
+		}))
+	})
+
+	It("Exports memory-hours per organization and space for a date range", func() {
+		sampleFor(2)
+		records, err := store.Records(start, start.Add(2*time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		usages, err := metering.Summarize(records, metering.BySpace)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usages).To(Equal([]metering.Usage{
+			{OrganizationGUID: "org-1", SpaceGUID: "space-1", AllocatedGBHours: 4.5, UsedGBHours: 0.75},
+			{OrganizationGUID: "org-2", SpaceGUID: "space-2", AllocatedGBHours: 6, UsedGBHours: 1.5},
+		}))
+
+		var out bytes.Buffer
+		Expect(metering.Export(&out, usages, metering.BySpace, metering.FormatCSV)).To(Succeed())
+		Expect(out.String()).To(Equal(
+			"organization_guid,space_guid,allocated_memory_gb_hours,used_memory_gb_hours\n" +
+				"org-1,space-1,4.5000,0.7500\n" +
+				"org-2,space-2,6.0000,1.5000\n"))
+	})
+
+	It("Exports memory-hours per organization", func() {
+		state, err := persister.Load()
+		Expect(err).NotTo(HaveOccurred())
+		state.AvailableInstances[1].SpaceGUID = "space-3"
+		Expect(persister.Save(state)).To(Succeed())
+		sampleFor(2)
+
+		records, err := store.Records(start, start.Add(2*time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		usages, err := metering.Summarize(records, metering.ByOrganization)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usages).To(Equal([]metering.Usage{
+			{OrganizationGUID: "org-1", AllocatedGBHours: 4.5, UsedGBHours: 0.75},
+			{OrganizationGUID: "org-2", AllocatedGBHours: 6, UsedGBHours: 1.5},
+		}))
+
+		var out bytes.Buffer
+		Expect(metering.Export(&out, usages, metering.ByOrganization, metering.FormatCSV)).To(Succeed())
+		Expect(out.String()).To(Equal(
+			"organization_guid,allocated_memory_gb_hours,used_memory_gb_hours\n" +
+				"org-1,4.5000,0.7500\n" +
+				"org-2,6.0000,1.5000\n"))
+	})
+
+	It("Counts the samples the broker replicas take at the same time once", func() {
+		sampleFor(2)
+		// The replica starts a few seconds later.
+		replica := metering.NewSampler(api, persister, store, 1800, logger)
+		for i := 1; i <= 4; i++ {
+			Expect(replica.Sample(ctx, start.Add(time.Duration(i)*30*time.Minute+7*time.Second))).To(Succeed())
+		}
+
+		records, err := store.Records(start, start.Add(2*time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		usages, err := metering.Summarize(records, metering.BySpace)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usages[0].AllocatedGBHours).To(Equal(4.5))
+	})
+
+	It("Appends the samples to a file per day", func() {
+		sampleFor(1)
+		sampler := metering.NewSampler(api, persister, store, 1800, logger)
+		Expect(sampler.Sample(ctx, start.Add(24*time.Hour))).To(Succeed())
+
+		first, err := ioutil.ReadFile(path.Join(tmpDir, "metering", "2026-03-01.jsonl"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Count(first, []byte("\n"))).To(Equal(6))
+		second, err := ioutil.ReadFile(path.Join(tmpDir, "metering", "2026-03-02.jsonl"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Count(second, []byte("\n"))).To(Equal(3))
+	})
+
+	It("Skips a sample cut short by a crash", func() {
+		sampleFor(1)
+		day := path.Join(tmpDir, "metering", "2026-03-01.jsonl")
+		Expect(files.Append(day, []byte(`{"time":"2026-03-01T11:30:00Z","inst`))).To(Succeed())
+
+		records, err := store.Records(start, start.Add(time.Hour*2))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(6))
+	})
+
+	It("Rejects an unknown summary level", func() {
+		_, err := metering.Summarize(nil, "plan")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Skips instances the cluster does not know", func() {
+		delete(api.Databases, 3)
+		sampleFor(1)
+		records, err := store.Records(start, start.Add(time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		for _, r := range records {
+			Expect(r.InstanceID).NotTo(Equal("c"))
+		}
+	})
+
+	It("Drops the records older than the retention", func() {
+		store = metering.NewFileStore(path.Join(tmpDir, "metering"), 1)
+		sampleFor(1)
+		sampler := metering.NewSampler(api, persister, store, 1800, logger)
+		Expect(sampler.Sample(ctx, start.Add(24*time.Hour))).To(Succeed())
+		records, err := store.Records(start, start.Add(72*time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(9))
+
+		Expect(sampler.Sample(ctx, start.Add(48*time.Hour))).To(Succeed())
+		records, err = store.Records(start, start.Add(72*time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(6))
+		for _, r := range records {
+			Expect(r.Bucket).NotTo(BeTemporally("<", start.Add(24*time.Hour)))
+		}
+	})
+
+	It("Writes the files readable by the broker user only", func() {
+		sampleFor(1)
+		info, err := os.Stat(path.Join(tmpDir, "metering", "2026-03-01.jsonl"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+})
@@ -0,0 +1,103 @@
+package metering
+
+import (
+	"context"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/capacity"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+)
+
+// Default used unless the sampling interval is configured.
+var SamplingInterval = 300 // seconds
+
+// Sampler periodically records the memory of every instance in the
+// broker state.
+type Sampler struct {
+	api       apiclient.Client
+	persister persisters.StatePersister
+	store     Store
+	interval  time.Duration
+	logger    lager.Logger
+}
+
+// NewSampler returns a sampler taking a sample every interval seconds,
+// or every SamplingInterval seconds if the interval is not positive.
+func NewSampler(api apiclient.Client, persister persisters.StatePersister, store Store, interval int, logger lager.Logger) *Sampler {
+	if interval <= 0 {
+		interval = SamplingInterval
+	}
+	return &Sampler{
+		api:       api,
+		persister: persister,
+		store:     store,
+		interval:  time.Duration(interval) * time.Second,
+		logger:    logger.Session("metering"),
+	}
+}
+
+// Run takes samples until the context is done. A failed sample is logged
+// and the time it stands for is not metered.
+func (s *Sampler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := s.Sample(ctx, now); err != nil {
+				s.logger.Error("Failed to take a metering sample", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sample records the memory of every instance at the given time.
+// Allocated memory includes the replicas. The time is rounded down to
+// the sampling interval, so that the broker replicas record their samples
+// at the same times and the store counts them once.
+func (s *Sampler) Sample(ctx context.Context, now time.Time) error {
+	now = now.UTC().Truncate(s.interval)
+	state, err := s.persister.Load()
+	if err != nil {
+		return err
+	}
+	databases, err := s.api.ListDatabases(ctx)
+	if err != nil {
+		return err
+	}
+	stats, err := s.api.GetDatabasesStats(ctx)
+	if err != nil {
+		return err
+	}
+	databasesByUID := map[int]apiclient.Database{}
+	for _, database := range databases {
+		databasesByUID[database.UID] = database
+	}
+
+	samples := []Sample{}
+	for _, instance := range state.AvailableInstances {
+		database, ok := databasesByUID[instance.Credentials.UID]
+		if !ok {
+			s.logger.Info("The cluster does not know the database of the instance", lager.Data{
+				"instance-id": instance.ID,
+				"UID":         instance.Credentials.UID,
+			})
+			continue
+		}
+		samples = append(samples, Sample{
+			Time:             now,
+			InstanceID:       instance.ID,
+			PlanID:           instance.PlanID,
+			OrganizationGUID: instance.OrganizationGUID,
+			SpaceGUID:        instance.SpaceGUID,
+			AllocatedMemory:  capacity.RequirementOfDatabase(database).Memory,
+			UsedMemory:       int64(stats[database.UID].UsedMemory),
+			Interval:         s.interval,
+		})
+	}
+	return s.store.Add(samples)
+}
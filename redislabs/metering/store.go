@@ -0,0 +1,285 @@
+package metering
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/files"
+)
+
+// BucketSize is the time span a record covers.
+var BucketSize = time.Hour
+
+// Default used unless the retention is configured.
+var RetentionDays = 400
+
+const (
+	dayLayout = "2006-01-02"
+	dayExt    = ".jsonl"
+)
+
+type (
+	// Sample is the memory an instance has at a point in time. Memory is
+	// measured in bytes. Every sample stands for the sampling interval
+	// that precedes it.
+	Sample struct {
+		Time       time.Time `json:"time"`
+		InstanceID string    `json:"instance_id"`
+		PlanID     string    `json:"plan_id"`
+		// OrganizationGUID and SpaceGUID are empty for instances
+		// provisioned before the broker started recording them.
+		OrganizationGUID string        `json:"organization_guid"`
+		SpaceGUID        string        `json:"space_guid"`
+		AllocatedMemory  int64         `json:"allocated_memory"`
+		UsedMemory       int64         `json:"used_memory"`
+		Interval         time.Duration `json:"interval"`
+	}
+
+	// Record sums up the samples of an instance within a bucket.
+	Record struct {
+		Bucket           time.Time `json:"bucket"`
+		InstanceID       string    `json:"instance_id"`
+		PlanID           string    `json:"plan_id"`
+		OrganizationGUID string    `json:"organization_guid"`
+		SpaceGUID        string    `json:"space_guid"`
+		Samples          int       `json:"samples"`
+		// Byte-hours, that is the memory multiplied by the time it has
+		// been held.
+		AllocatedByteHours float64 `json:"allocated_byte_hours"`
+		UsedByteHours      float64 `json:"used_byte_hours"`
+	}
+
+	// Store keeps the metering records.
+	Store interface {
+		Add(samples []Sample) error
+		// Records returns the records of the buckets starting within
+		// [from, to).
+		Records(from time.Time, to time.Time) ([]Record, error)
+	}
+
+	// fileStore appends the samples to a file per day in its folder, so
+	// that adding a sample costs the same however long the history is.
+	// The folder is changed under its lock, so that the broker and the
+	// metering command may use it at once.
+	fileStore struct {
+		dir       string
+		retention int // days
+		lock      sync.Mutex
+	}
+)
+
+// NewFileStore returns a store keeping the samples of the last retention
+// days in the folder at the given path, or the ones of the last
+// RetentionDays days if the retention is not positive.
+func NewFileStore(dir string, retention int) Store {
+	if retention <= 0 {
+		retention = RetentionDays
+	}
+	return &fileStore{
+		dir:       dir,
+		retention: retention,
+	}
+}
+
+func bucketOf(t time.Time) time.Time {
+	return t.UTC().Truncate(BucketSize)
+}
+
+func dayOf(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+func (s *fileStore) Add(samples []Sample) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return files.WithLock(s.dir, files.Exclusive, func() error {
+		latest := time.Time{}
+		lines := map[time.Time][]byte{}
+		for _, sample := range samples {
+			line, err := json.Marshal(sample)
+			if err != nil {
+				return err
+			}
+			day := dayOf(sample.Time)
+			lines[day] = append(append(lines[day], line...), '\n')
+			if day.After(latest) {
+				latest = day
+			}
+		}
+		for day, data := range lines {
+			if err := files.Append(s.dayPath(day), data); err != nil {
+				return err
+			}
+		}
+		if latest.IsZero() {
+			return nil
+		}
+		return s.prune(latest)
+	})
+}
+
+// prune removes the files of the days older than the retention, counted
+// back from the latest day.
+func (s *fileStore) prune(latest time.Time) error {
+	oldest := latest.AddDate(0, 0, -s.retention)
+	days, err := s.days()
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		if day.Before(oldest) {
+			if err = os.Remove(s.dayPath(day)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) Records(from time.Time, to time.Time) ([]Record, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	samples := []Sample{}
+	err := files.WithLock(s.dir, files.Shared, func() error {
+		days, err := s.days()
+		if err != nil {
+			return err
+		}
+		for _, day := range days {
+			if day.Before(dayOf(from)) || !day.Before(to) {
+				continue
+			}
+			loaded, err := s.load(day)
+			if err != nil {
+				return err
+			}
+			samples = append(samples, loaded...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	inRange := []Record{}
+	for _, r := range add(samples) {
+		if !r.Bucket.Before(from) && r.Bucket.Before(to) {
+			inRange = append(inRange, r)
+		}
+	}
+	sort.Sort(byBucket(inRange))
+	return inRange, nil
+}
+
+// add sums the samples up into the records of their buckets. The broker
+// replicas sample the same instances, a sample taken at the time another
+// one has been taken for the instance is counted once.
+func add(samples []Sample) []Record {
+	type key struct {
+		bucket     time.Time
+		instanceID string
+	}
+	type sampleKey struct {
+		time       time.Time
+		instanceID string
+	}
+	index := map[key]int{}
+	seen := map[sampleKey]bool{}
+	records := []Record{}
+	for _, sample := range samples {
+		sk := sampleKey{sample.Time.UTC(), sample.InstanceID}
+		if seen[sk] {
+			continue
+		}
+		seen[sk] = true
+
+		k := key{bucketOf(sample.Time), sample.InstanceID}
+		i, ok := index[k]
+		if !ok {
+			records = append(records, Record{Bucket: k.bucket, InstanceID: sample.InstanceID})
+			i = len(records) - 1
+			index[k] = i
+		}
+		r := &records[i]
+		// The latest sample tells whom the instance belongs to.
+		r.PlanID = sample.PlanID
+		r.OrganizationGUID = sample.OrganizationGUID
+		r.SpaceGUID = sample.SpaceGUID
+		r.Samples++
+		hours := sample.Interval.Hours()
+		r.AllocatedByteHours += float64(sample.AllocatedMemory) * hours
+		r.UsedByteHours += float64(sample.UsedMemory) * hours
+	}
+	return records
+}
+
+// days returns the days the folder has a file of.
+func (s *fileStore) days() ([]time.Time, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return []time.Time{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	days := []time.Time{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, dayExt) {
+			continue
+		}
+		day, err := time.Parse(dayLayout, strings.TrimSuffix(name, dayExt))
+		if err != nil {
+			continue
+		}
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+func (s *fileStore) dayPath(day time.Time) string {
+	return filepath.Join(s.dir, day.Format(dayLayout)+dayExt)
+}
+
+// load reads the samples of a day. A line cut short by a crash is
+// skipped, the samples after it are still read.
+func (s *fileStore) load(day time.Time) ([]Sample, error) {
+	file, err := os.Open(s.dayPath(day))
+	if os.IsNotExist(err) {
+		return []Sample{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	samples := []Sample{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var sample Sample
+		if err = json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	return samples, scanner.Err()
+}
+
+type byBucket []Record
+
+func (r byBucket) Len() int      { return len(r) }
+func (r byBucket) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byBucket) Less(i, j int) bool {
+	if r[i].Bucket.Equal(r[j].Bucket) {
+		return r[i].InstanceID < r[j].InstanceID
+	}
+	return r[i].Bucket.Before(r[j].Bucket)
+}
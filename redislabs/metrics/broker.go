@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+type instrumentedBroker struct {
+	brokerapi.ServiceBroker
+}
+
+// InstrumentBroker counts and times the operations of the given broker.
+func InstrumentBroker(broker brokerapi.ServiceBroker) brokerapi.ServiceBroker {
+	return &instrumentedBroker{broker}
+}
+
+func (b *instrumentedBroker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (spec brokerapi.ProvisionedServiceSpec, err error) {
+	defer track("provision", details.PlanID)(&err)
+	return b.ServiceBroker.Provision(ctx, instanceID, details, asyncAllowed)
+}
+
+func (b *instrumentedBroker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (spec brokerapi.UpdateServiceSpec, err error) {
+	defer track("update", details.PlanID)(&err)
+	return b.ServiceBroker.Update(ctx, instanceID, details, asyncAllowed)
+}
+
+func (b *instrumentedBroker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (spec brokerapi.DeprovisionServiceSpec, err error) {
+	defer track("deprovision", details.PlanID)(&err)
+	return b.ServiceBroker.Deprovision(ctx, instanceID, details, asyncAllowed)
+}
+
+func (b *instrumentedBroker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails, asyncAllowed bool) (binding brokerapi.Binding, err error) {
+	defer track("bind", details.PlanID)(&err)
+	return b.ServiceBroker.Bind(ctx, instanceID, bindingID, details, asyncAllowed)
+}
+
+func (b *instrumentedBroker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails, asyncAllowed bool) (spec brokerapi.UnbindSpec, err error) {
+	defer track("unbind", details.PlanID)(&err)
+	return b.ServiceBroker.Unbind(ctx, instanceID, bindingID, details, asyncAllowed)
+}
+
+// track marks the operation as in flight and returns the function that
+// records its outcome once it is over.
+func track(operation string, plan string) func(err *error) {
+	start := time.Now()
+	BrokerOperationsInFlight.Inc(operation)
+	return func(err *error) {
+		BrokerOperationsInFlight.Dec(operation)
+		result := outcome(*err)
+		BrokerOperations.Inc(operation, plan, result)
+		BrokerOperationDuration.Observe(time.Since(start).Seconds(), operation, plan, result)
+	}
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"strings"
+	"time"
+)
+
+// Outcomes of broker operations and cluster API calls.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+var (
+	// Default is the registry served on the metrics port.
+	Default = NewRegistry()
+
+	BrokerOperations = NewCounter(
+		"redislabs_broker_operations_total",
+		"Service broker operations by plan and outcome.",
+		"operation", "plan", "outcome",
+	)
+	BrokerOperationDuration = NewHistogram(
+		"redislabs_broker_operation_duration_seconds",
+		"Service broker operation latency by plan and outcome.",
+		DefaultBuckets,
+		"operation", "plan", "outcome",
+	)
+	// The broker completes every operation within the request, so
+	// the operations in flight are the requests being served.
+	BrokerOperationsInFlight = NewGauge(
+		"redislabs_broker_operations_in_flight",
+		"Service broker operations in progress.",
+		"operation",
+	)
+	ClusterRequestDuration = NewHistogram(
+		"redislabs_broker_cluster_request_duration_seconds",
+		"Cluster API call latency by endpoint, retries included.",
+		DefaultBuckets,
+		"method", "endpoint",
+	)
+	ClusterRequestErrors = NewCounter(
+		"redislabs_broker_cluster_request_errors_total",
+		"Failed cluster API calls by endpoint.",
+		"method", "endpoint",
+	)
+	PersisterDuration = NewHistogram(
+		"redislabs_broker_state_persister_duration_seconds",
+		"State persister latency by operation.",
+		DefaultBuckets,
+		"operation",
+	)
+)
+
+func init() {
+	Default.Register(BrokerOperations)
+	Default.Register(BrokerOperationDuration)
+	Default.Register(BrokerOperationsInFlight)
+	Default.Register(ClusterRequestDuration)
+	Default.Register(ClusterRequestErrors)
+	Default.Register(PersisterDuration)
+}
+
+// ObserveClusterRequest records the latency and the failure of a cluster
+// API call. It is meant to be the observer of the API client.
+func ObserveClusterRequest(verb string, path string, duration time.Duration, err error) {
+	endpoint := Endpoint(path)
+	ClusterRequestDuration.Observe(duration.Seconds(), verb, endpoint)
+	if err != nil {
+		ClusterRequestErrors.Inc(verb, endpoint)
+	}
+}
+
+var (
+	// collections are the cluster API path segments followed by an
+	// object ID, unless it is one of the subresources.
+	collections = map[string]bool{
+		"bdbs":       true,
+		"crdbs":      true,
+		"crdb_tasks": true,
+		"modules":    true,
+		"nodes":      true,
+		"redis_acls": true,
+		"roles":      true,
+		"users":      true,
+		"last":       true,
+	}
+	subresources = map[string]bool{
+		"stats": true,
+	}
+)
+
+// Endpoint returns the cluster API path with the object IDs replaced,
+// so that the endpoint label does not grow with every database. Numeric
+// IDs are replaced anywhere, GUIDs and the other IDs where the path names
+// an object of a collection.
+func Endpoint(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		numeric := strings.Trim(segment, "0123456789") == ""
+		named := i > 0 && collections[segments[i-1]] && !subresources[segment]
+		if numeric || named {
+			segments[i] = ":uid"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return OutcomeFailure
+	}
+	return OutcomeSuccess
+}
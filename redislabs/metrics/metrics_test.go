@@ -0,0 +1,165 @@
+package metrics_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/metrics"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	collect := func(c metrics.Collector) string {
+		registry := metrics.NewRegistry()
+		registry.Register(c)
+		var buf bytes.Buffer
+		_, err := registry.WriteTo(&buf)
+		Expect(err).NotTo(HaveOccurred())
+		return buf.String()
+	}
+
+	It("Writes counters in the Prometheus text format", func() {
+		c := metrics.NewCounter("requests_total", "Requests.", "plan")
+		c.Inc("b")
+		c.Add(2, `a"\`)
+		Expect(collect(c)).To(Equal(
+			"# HELP requests_total Requests.\n" +
+				"# TYPE requests_total counter\n" +
+				`requests_total{plan="a\"\\"} 2` + "\n" +
+				`requests_total{plan="b"} 1` + "\n"))
+	})
+
+	It("Escapes the help text and the label values as the text format requires", func() {
+		c := metrics.NewCounter("requests_total", "Requests \\ by\nplan \"quoted\".", "plan")
+		c.Inc("line\nbreak")
+		c.Inc(`back\slash`)
+		c.Inc(`double"quote`)
+		c.Inc("single'quote {brace} =,")
+		Expect(collect(c)).To(Equal(
+			"# HELP requests_total Requests \\\\ by\\nplan \"quoted\".\n" +
+				"# TYPE requests_total counter\n" +
+				`requests_total{plan="back\\slash"} 1` + "\n" +
+				`requests_total{plan="double\"quote"} 1` + "\n" +
+				`requests_total{plan="line\nbreak"} 1` + "\n" +
+				`requests_total{plan="single'quote {brace} =,"} 1` + "\n"))
+	})
+
+	It("Writes the special float values as the text format spells them", func() {
+		g := metrics.NewGauge("temperature", "Temperature.", "kind")
+		g.Set(math.Inf(1), "hot")
+		g.Set(math.Inf(-1), "cold")
+		g.Set(math.NaN(), "unknown")
+		g.Set(1e-7, "small")
+		Expect(collect(g)).To(Equal(
+			"# HELP temperature Temperature.\n" +
+				"# TYPE temperature gauge\n" +
+				`temperature{kind="cold"} -Inf` + "\n" +
+				`temperature{kind="hot"} +Inf` + "\n" +
+				`temperature{kind="small"} 1e-07` + "\n" +
+				`temperature{kind="unknown"} NaN` + "\n"))
+	})
+
+	DescribeTable("Rejects the names the text format does not allow",
+		func(declare func()) {
+			Expect(declare).To(Panic())
+		},
+		Entry("a metric name starting with a digit", func() { metrics.NewCounter("1requests", "") }),
+		Entry("a metric name with a dash", func() { metrics.NewCounter("broker-requests", "") }),
+		Entry("an empty metric name", func() { metrics.NewGauge("", "") }),
+		Entry("a label name with a colon", func() { metrics.NewCounter("requests", "", "plan:id") }),
+		Entry("a reserved label name", func() { metrics.NewCounter("requests", "", "__plan") }),
+		Entry("a label name given twice", func() { metrics.NewCounter("requests", "", "plan", "plan") }),
+		Entry("a histogram with the le label", func() { metrics.NewHistogram("latency", "", metrics.DefaultBuckets, "le") }),
+	)
+
+	It("Accepts the names the text format allows", func() {
+		Expect(func() { metrics.NewCounter("broker:requests_total", "", "_plan", "outcome2") }).NotTo(Panic())
+	})
+
+	It("Rejects a second metric of the same name", func() {
+		registry := metrics.NewRegistry()
+		registry.Register(metrics.NewCounter("requests_total", ""))
+		Expect(func() { registry.Register(metrics.NewGauge("requests_total", "")) }).To(Panic())
+	})
+
+	It("Writes cumulative histogram buckets", func() {
+		h := metrics.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+		h.Observe(0.05)
+		h.Observe(0.5)
+		h.Observe(5)
+		Expect(collect(h)).To(Equal(
+			"# HELP latency_seconds Latency.\n" +
+				"# TYPE latency_seconds histogram\n" +
+				`latency_seconds_bucket{le="0.1"} 1` + "\n" +
+				`latency_seconds_bucket{le="1"} 2` + "\n" +
+				`latency_seconds_bucket{le="+Inf"} 3` + "\n" +
+				"latency_seconds_sum 5.55\n" +
+				"latency_seconds_count 3\n"))
+	})
+
+	It("Replaces object IDs in cluster API endpoints", func() {
+		Expect(metrics.Endpoint("/v1/bdbs/12/actions/export")).To(Equal("/v1/bdbs/:uid/actions/export"))
+		Expect(metrics.Endpoint("/v1/bdbs/stats/last/3")).To(Equal("/v1/bdbs/stats/last/:uid"))
+		Expect(metrics.Endpoint("/v1/bdbs/stats/last")).To(Equal("/v1/bdbs/stats/last"))
+		Expect(metrics.Endpoint("/v1/crdbs/1b9e5b2c-37e4-4a8f-9c4e-2d3f61d0c9a7")).To(Equal("/v1/crdbs/:uid"))
+		Expect(metrics.Endpoint("/v1/crdb_tasks/task-1")).To(Equal("/v1/crdb_tasks/:uid"))
+		Expect(metrics.Endpoint("/v1/modules/2f1a")).To(Equal("/v1/modules/:uid"))
+		Expect(metrics.Endpoint("/v1/nodes/stats/last")).To(Equal("/v1/nodes/stats/last"))
+		Expect(metrics.Endpoint("/v1/crdbs")).To(Equal("/v1/crdbs"))
+	})
+
+	It("Records the cluster API calls by endpoint", func() {
+		metrics.ObserveClusterRequest("PUT", "/v1/bdbs/7", time.Second, nil)
+		metrics.ObserveClusterRequest("PUT", "/v1/bdbs/8", time.Second, errors.New("no"))
+
+		Expect(collect(metrics.ClusterRequestDuration)).To(ContainSubstring(`redislabs_broker_cluster_request_duration_seconds_count{method="PUT",endpoint="/v1/bdbs/:uid"} 2`))
+		Expect(collect(metrics.ClusterRequestErrors)).To(ContainSubstring(`redislabs_broker_cluster_request_errors_total{method="PUT",endpoint="/v1/bdbs/:uid"} 1`))
+	})
+
+	It("Counts the broker operations by plan and outcome", func() {
+		broker := &fakes.FakeServiceBroker{InstanceLimit: 1}
+		instrumented := metrics.InstrumentBroker(broker)
+		details := brokerapi.ProvisionDetails{PlanID: "metrics-plan"}
+		instrumented.Provision(context.Background(), "a", details, false)
+		broker.ProvisionError = errors.New("no")
+		instrumented.Provision(context.Background(), "b", details, false)
+
+		out := collect(metrics.BrokerOperations)
+		Expect(out).To(ContainSubstring(`redislabs_broker_operations_total{operation="provision",plan="metrics-plan",outcome="success"} 1`))
+		Expect(out).To(ContainSubstring(`redislabs_broker_operations_total{operation="provision",plan="metrics-plan",outcome="failure"} 1`))
+		Expect(collect(metrics.BrokerOperationsInFlight)).To(ContainSubstring(`{operation="provision"} 0`))
+	})
+
+	It("Counts the instances by plan", func() {
+		persister := &memoryPersister{state: &persisters.State{
+			AvailableInstances: []persisters.ServiceInstance{
+				{ID: "a", InstanceDetails: persisters.InstanceDetails{PlanID: "small"}},
+				{ID: "b", InstanceDetails: persisters.InstanceDetails{PlanID: "small"}},
+				{ID: "c", InstanceDetails: persisters.InstanceDetails{PlanID: "large"}},
+			},
+		}}
+		out := collect(metrics.InstancesByPlan(metrics.InstrumentPersister(persister)))
+		Expect(out).To(ContainSubstring(`redislabs_broker_instances{plan="small"} 2`))
+		Expect(out).To(ContainSubstring(`redislabs_broker_instances{plan="large"} 1`))
+		Expect(collect(metrics.PersisterDuration)).To(ContainSubstring(`redislabs_broker_state_persister_duration_seconds_count{operation="load"}`))
+	})
+})
+
+type memoryPersister struct {
+	state *persisters.State
+}
+
+func (p *memoryPersister) Load() (*persisters.State, error) { return p.state, nil }
+func (p *memoryPersister) Save(s *persisters.State) error   { p.state = s; return nil }
+func (p *memoryPersister) Update(change func(*persisters.State) error) error {
+	return change(p.state)
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+)
+
+type instrumentedPersister struct {
+	persisters.StatePersister
+}
+
+// InstrumentPersister measures how long the given persister takes to load,
+// save and update the state.
+func InstrumentPersister(persister persisters.StatePersister) persisters.StatePersister {
+	return &instrumentedPersister{persister}
+}
+
+func (p *instrumentedPersister) Load() (*persisters.State, error) {
+	defer observeSince(PersisterDuration, time.Now(), "load")
+	return p.StatePersister.Load()
+}
+
+func (p *instrumentedPersister) Save(s *persisters.State) error {
+	defer observeSince(PersisterDuration, time.Now(), "save")
+	return p.StatePersister.Save(s)
+}
+
+func (p *instrumentedPersister) Update(change func(*persisters.State) error) error {
+	defer observeSince(PersisterDuration, time.Now(), "update")
+	return p.StatePersister.Update(change)
+}
+
+// InstancesByPlan counts the instances in the state per plan on every
+// scrape.
+func InstancesByPlan(persister persisters.StatePersister) *GaugeFunc {
+	return NewGaugeFunc(
+		"redislabs_broker_instances",
+		"Service instances by plan.",
+		func() []Value {
+			state, err := persister.Load()
+			if err != nil {
+				return nil
+			}
+			counts := map[string]float64{}
+			plans := []string{}
+			for _, instance := range state.AvailableInstances {
+				if _, ok := counts[instance.PlanID]; !ok {
+					plans = append(plans, instance.PlanID)
+				}
+				counts[instance.PlanID]++
+			}
+			values := []Value{}
+			for _, plan := range plans {
+				values = append(values, Value{Labels: []string{plan}, Value: counts[plan]})
+			}
+			return values
+		},
+		"plan",
+	)
+}
+
+func observeSince(h *Histogram, start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
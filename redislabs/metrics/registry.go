@@ -0,0 +1,345 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// Collector writes its metrics in the Prometheus text format.
+	Collector interface {
+		Name() string
+		Collect(w io.Writer)
+	}
+
+	// Registry holds the collectors served together.
+	Registry struct {
+		lock       sync.Mutex
+		collectors []Collector
+	}
+
+	// Value is a single sample of a metric with its label values.
+	Value struct {
+		Labels []string
+		Value  float64
+	}
+)
+
+// DefaultBuckets suit both single cluster API calls and broker operations
+// waiting for a database.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds the collector to the registry. It panics if the registry
+// already has a collector of the same name, as Prometheus would reject
+// the scrape.
+func (r *Registry) Register(c Collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, registered := range r.collectors {
+		if registered.Name() == c.Name() {
+			panic(fmt.Sprintf("metric %s is already registered", c.Name()))
+		}
+	}
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo writes the metrics of every collector in the registration order.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	collectors := append([]Collector{}, r.collectors...)
+	r.lock.Unlock()
+
+	var buf bytes.Buffer
+	for _, c := range collectors {
+		c.Collect(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// Handler serves the metrics of the registry to Prometheus.
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteTo(w)
+	})
+}
+
+// vec keeps the values of a metric per label values.
+type vec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	lock       sync.Mutex
+	keys       []string
+	labels     map[string][]string
+}
+
+var (
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// newVec panics if the names are not valid in the Prometheus text format,
+// the metrics are declared once when the broker starts.
+func newVec(name string, help string, kind string, labelNames []string) *vec {
+	if !metricNamePattern.MatchString(name) {
+		panic(fmt.Sprintf("invalid metric name %q", name))
+	}
+	seen := map[string]bool{}
+	for _, labelName := range labelNames {
+		// Names starting with __ are reserved for Prometheus itself.
+		if !labelNamePattern.MatchString(labelName) || strings.HasPrefix(labelName, "__") {
+			panic(fmt.Sprintf("metric %s has an invalid label name %q", name, labelName))
+		}
+		if seen[labelName] {
+			panic(fmt.Sprintf("metric %s has the label %s twice", name, labelName))
+		}
+		seen[labelName] = true
+	}
+	return &vec{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		labels:     map[string][]string{},
+	}
+}
+
+// key returns the key of the label values, registering them if they
+// are new. It is called with the lock held.
+func (v *vec) key(labels []string) string {
+	if len(labels) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labelNames), len(labels)))
+	}
+	key := strings.Join(labels, "\xff")
+	if _, ok := v.labels[key]; !ok {
+		v.labels[key] = append([]string{}, labels...)
+		v.keys = append(v.keys, key)
+		sort.Strings(v.keys)
+	}
+	return key
+}
+
+func (v *vec) Name() string {
+	return v.name
+}
+
+func (v *vec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+}
+
+// Counter is a metric that only goes up.
+type Counter struct {
+	*vec
+	values map[string]float64
+}
+
+func NewCounter(name string, help string, labelNames ...string) *Counter {
+	return &Counter{
+		vec:    newVec(name, help, "counter", labelNames),
+		values: map[string]float64{},
+	}
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *Counter) Add(delta float64, labels ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.values[c.key(labels)] += delta
+}
+
+func (c *Counter) Collect(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeHeader(w)
+	for _, key := range c.keys {
+		writeSample(w, c.name, c.labelNames, c.labels[key], c.values[key])
+	}
+}
+
+// Gauge is a metric that goes up and down.
+type Gauge struct {
+	*vec
+	values map[string]float64
+}
+
+func NewGauge(name string, help string, labelNames ...string) *Gauge {
+	return &Gauge{
+		vec:    newVec(name, help, "gauge", labelNames),
+		values: map[string]float64{},
+	}
+}
+
+func (g *Gauge) Inc(labels ...string) {
+	g.Add(1, labels...)
+}
+
+func (g *Gauge) Dec(labels ...string) {
+	g.Add(-1, labels...)
+}
+
+func (g *Gauge) Add(delta float64, labels ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.values[g.key(labels)] += delta
+}
+
+func (g *Gauge) Set(value float64, labels ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.values[g.key(labels)] = value
+}
+
+func (g *Gauge) Collect(w io.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.writeHeader(w)
+	for _, key := range g.keys {
+		writeSample(w, g.name, g.labelNames, g.labels[key], g.values[key])
+	}
+}
+
+// GaugeFunc is a gauge whose values are computed on every scrape.
+type GaugeFunc struct {
+	*vec
+	values func() []Value
+}
+
+func NewGaugeFunc(name string, help string, values func() []Value, labelNames ...string) *GaugeFunc {
+	return &GaugeFunc{
+		vec:    newVec(name, help, "gauge", labelNames),
+		values: values,
+	}
+}
+
+func (g *GaugeFunc) Collect(w io.Writer) {
+	g.writeHeader(w)
+	for _, v := range g.values() {
+		if len(v.Labels) != len(g.labelNames) {
+			continue
+		}
+		writeSample(w, g.name, g.labelNames, v.Labels, v.Value)
+	}
+}
+
+// Histogram counts observations, such as latencies, in buckets.
+type Histogram struct {
+	*vec
+	buckets []float64
+	counts  map[string][]uint64 // cumulative, per bucket
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	for _, labelName := range labelNames {
+		if labelName == "le" {
+			panic(fmt.Sprintf("histogram %s may not have the label le", name))
+		}
+	}
+	return &Histogram{
+		vec:     newVec(name, help, "histogram", labelNames),
+		buckets: buckets,
+		counts:  map[string][]uint64{},
+		sums:    map[string]float64{},
+		totals:  map[string]uint64{},
+	}
+}
+
+func (h *Histogram) Observe(value float64, labels ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	key := h.key(labels)
+	counts, ok := h.counts[key]
+	if !ok {
+		counts = make([]uint64, len(h.buckets))
+		h.counts[key] = counts
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			counts[i]++
+		}
+	}
+	h.sums[key] += value
+	h.totals[key]++
+}
+
+func (h *Histogram) Collect(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.writeHeader(w)
+	labelNames := append(append([]string{}, h.labelNames...), "le")
+	for _, key := range h.keys {
+		labels := h.labels[key]
+		for i, upper := range h.buckets {
+			le := append(append([]string{}, labels...), formatFloat(upper))
+			writeSample(w, h.name+"_bucket", labelNames, le, float64(h.counts[key][i]))
+		}
+		inf := append(append([]string{}, labels...), "+Inf")
+		writeSample(w, h.name+"_bucket", labelNames, inf, float64(h.totals[key]))
+		writeSample(w, h.name+"_sum", h.labelNames, labels, h.sums[key])
+		writeSample(w, h.name+"_count", h.labelNames, labels, float64(h.totals[key]))
+	}
+}
+
+func writeSample(w io.Writer, name string, labelNames []string, labels []string, value float64) {
+	io.WriteString(w, name)
+	if len(labelNames) > 0 {
+		pairs := make([]string, len(labelNames))
+		for i, labelName := range labelNames {
+			pairs[i] = fmt.Sprintf("%s=\"%s\"", labelName, escapeLabel(labels[i]))
+		}
+		fmt.Fprintf(w, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(w, " %s\n", formatFloat(value))
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,83 @@
+package persisters_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters/persisterstest"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Persister conformance", func() {
+	var (
+		tmpStateDir string
+		stateFile   string
+	)
+
+	persisterstest.Conformance("Local JSON file persister", persisterstest.Backend{
+		Setup: func() {
+			var err error
+			tmpStateDir, err = ioutil.TempDir("", "redislabs-state-test")
+			Expect(err).NotTo(HaveOccurred())
+			stateFile = path.Join(tmpStateDir, "state.json")
+		},
+		Teardown: func() {
+			os.RemoveAll(tmpStateDir)
+		},
+		New: func() persisters.StatePersister {
+			return persisters.NewLocalPersister(stateFile)
+		},
+		Corrupt: func() {
+			Expect(ioutil.WriteFile(stateFile, []byte(`{"AvailableInstances":[{"ID":`), 0600)).To(Succeed())
+		},
+	})
+
+	key := persisters.Key{ID: "key", Secret: bytes.Repeat([]byte{1}, 32)}
+	persisterstest.Conformance("Encrypting persister", persisterstest.Backend{
+		Setup: func() {
+			var err error
+			tmpStateDir, err = ioutil.TempDir("", "redislabs-state-test")
+			Expect(err).NotTo(HaveOccurred())
+			stateFile = path.Join(tmpStateDir, "state.json")
+		},
+		Teardown: func() {
+			os.RemoveAll(tmpStateDir)
+		},
+		New: func() persisters.StatePersister {
+			p, err := persisters.NewEncryptingPersister(persisters.NewLocalPersister(stateFile), []persisters.Key{key})
+			Expect(err).NotTo(HaveOccurred())
+			return p
+		},
+		Corrupt: func() {
+			local := persisters.NewLocalPersister(stateFile)
+			state, err := local.Load()
+			Expect(err).NotTo(HaveOccurred())
+			state.AvailableInstances[0].Credentials.Password = "bm90IGEgY2lwaGVydGV4dA=="
+			state.AvailableInstances[0].PasswordKey = "key"
+			Expect(local.Save(state)).To(Succeed())
+		},
+	})
+
+	var redis *testing.RedisServer
+	persisterstest.Conformance("Redis persister", persisterstest.Backend{
+		Setup: func() {
+			redis = testing.NewRedisServer("")
+		},
+		Teardown: func() {
+			redis.Close()
+		},
+		New: func() persisters.StatePersister {
+			return persisters.NewRedisPersister(config.RedisStateConfig{Address: redis.Address()})
+		},
+		Corrupt: func() {
+			redis.Set(0, persisters.DefaultRedisKey, "not json")
+		},
+	})
+})
@@ -0,0 +1,305 @@
+package persisters
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+)
+
+// Key is an AES-256 key sealing the credentials in the state.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// encrypting seals the database passwords with AES-GCM before the state
+// reaches the wrapped persister and opens them once it is loaded.
+// A sealed password holds the base64 encoded nonce and ciphertext, bound
+// to its instance ID, and the instance records the ID of its key in
+// PasswordKey. The passwords sealed before the keys were recorded are
+// prefixed with their key ID instead, see openLegacy.
+type encrypting struct {
+	StatePersister
+	primary Key
+	keys    map[string]Key
+}
+
+// legacyPrefix started the passwords sealed before the keys were
+// recorded, followed by the key ID and the sealed value:
+// "aesgcm:<key id>:<value>".
+const legacyPrefix = "aesgcm:"
+
+var (
+	ErrNoKeys        = errors.New("no state encryption key is given")
+	ErrUnknownKey    = errors.New("the state is encrypted with a key that is not configured")
+	ErrNotEncrypting = errors.New("the state encryption is not configured")
+
+	// errUnchanged leaves the state as it is when no password needs
+	// to be sealed again.
+	errUnchanged = errors.New("every password is sealed with the first key")
+)
+
+// NewEncryptingPersister wraps the persister so that the state it stores
+// holds the passwords encrypted with the first key. Any of the keys opens
+// them. Passwords stored in plain text are loaded as they are and sealed
+// on the next save.
+func NewEncryptingPersister(persister StatePersister, keys []Key) (StatePersister, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	e := &encrypting{
+		StatePersister: persister,
+		primary:        keys[0],
+		keys:           map[string]Key{},
+	}
+	for _, key := range keys {
+		if len(key.Secret) != 32 {
+			return nil, fmt.Errorf("state encryption key %q must be 32 bytes long, got %d", key.ID, len(key.Secret))
+		}
+		e.keys[key.ID] = key
+	}
+	return e, nil
+}
+
+// LoadKeys reads the configured keys from their files or environment
+// variables.
+func LoadKeys(configs []config.KeyConfig) ([]Key, error) {
+	keys := []Key{}
+	for _, c := range configs {
+		var encoded string
+		if c.File != "" {
+			bytes, err := ioutil.ReadFile(c.File)
+			if err != nil {
+				return nil, err
+			}
+			encoded = string(bytes)
+		} else {
+			encoded = os.Getenv(c.Env)
+		}
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("state encryption key %q is not base64 encoded: %s", c.ID, err)
+		}
+		keys = append(keys, Key{ID: c.ID, Secret: secret})
+	}
+	return keys, nil
+}
+
+// Reencrypt seals with the first key of an encrypting persister every
+// password stored in plain text or sealed with another key, and returns
+// how many it has sealed. It lets an old key be dropped after a rotation
+// and seals the passwords saved before the encryption was enabled. The
+// state is not saved if every password is sealed with the first key.
+func Reencrypt(persister StatePersister) (int, error) {
+	e, ok := persister.(*encrypting)
+	if !ok {
+		return 0, ErrNotEncrypting
+	}
+	stored, err := e.StatePersister.Load()
+	if err != nil {
+		return 0, err
+	}
+	if e.stale(stored) == 0 {
+		return 0, nil
+	}
+	sealed := 0
+	err = e.StatePersister.Update(func(s *State) error {
+		if sealed = e.stale(s); sealed == 0 {
+			return errUnchanged
+		}
+		for i, instance := range s.AvailableInstances {
+			if !e.isStale(instance) {
+				continue
+			}
+			password, err := e.plaintext(instance)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt the password of instance %s: %s", instance.ID, err)
+			}
+			if password, err = e.encrypt(instance.ID, password); err != nil {
+				return err
+			}
+			s.AvailableInstances[i].Credentials.Password = password
+			s.AvailableInstances[i].PasswordKey = e.primary.ID
+		}
+		return nil
+	})
+	if err == errUnchanged {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return sealed, nil
+}
+
+// stale returns how many passwords of the stored state are not sealed
+// with the first key.
+func (e *encrypting) stale(s *State) int {
+	count := 0
+	for _, instance := range s.AvailableInstances {
+		if e.isStale(instance) {
+			count++
+		}
+	}
+	return count
+}
+
+func (e *encrypting) isStale(instance ServiceInstance) bool {
+	return instance.Credentials.Password != "" && instance.PasswordKey != e.primary.ID
+}
+
+func (e *encrypting) Load() (*State, error) {
+	s, err := e.StatePersister.Load()
+	if err != nil {
+		return nil, err
+	}
+	if err = e.open(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (e *encrypting) Save(s *State) error {
+	sealed, err := e.seal(s)
+	if err != nil {
+		return err
+	}
+	if err = e.StatePersister.Save(sealed); err != nil {
+		return err
+	}
+	s.Version = sealed.Version
+	return nil
+}
+
+func (e *encrypting) Update(change func(*State) error) error {
+	return e.StatePersister.Update(func(s *State) error {
+		if err := e.open(s); err != nil {
+			return err
+		}
+		if err := change(s); err != nil {
+			return err
+		}
+		sealed, err := e.seal(s)
+		if err != nil {
+			return err
+		}
+		*s = *sealed
+		return nil
+	})
+}
+
+// seal returns a copy of the state with the passwords encrypted, the
+// given state is left as it is.
+func (e *encrypting) seal(s *State) (*State, error) {
+	sealed := *s
+	sealed.AvailableInstances = make([]ServiceInstance, len(s.AvailableInstances))
+	for i, instance := range s.AvailableInstances {
+		if instance.Credentials.Password != "" && instance.PasswordKey == "" {
+			password, err := e.encrypt(instance.ID, instance.Credentials.Password)
+			if err != nil {
+				return nil, err
+			}
+			instance.Credentials.Password = password
+			instance.PasswordKey = e.primary.ID
+		}
+		sealed.AvailableInstances[i] = instance
+	}
+	return &sealed, nil
+}
+
+// open decrypts the passwords in place.
+func (e *encrypting) open(s *State) error {
+	for i, instance := range s.AvailableInstances {
+		password, err := e.plaintext(instance)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt the password of instance %s: %s", instance.ID, err)
+		}
+		s.AvailableInstances[i].Credentials.Password = password
+		s.AvailableInstances[i].PasswordKey = ""
+	}
+	return nil
+}
+
+// plaintext returns the password of the stored instance decrypted.
+func (e *encrypting) plaintext(instance ServiceInstance) (string, error) {
+	if instance.PasswordKey != "" {
+		return e.decrypt(instance.ID, instance.PasswordKey, instance.Credentials.Password)
+	}
+	if password, ok := e.openLegacy(instance); ok {
+		return password, nil
+	}
+	return instance.Credentials.Password, nil
+}
+
+// openLegacy opens a password sealed before the keys were recorded. A
+// password reading like one is taken as sealed only if it opens with the
+// key it names, any other is plain text.
+func (e *encrypting) openLegacy(instance ServiceInstance) (string, bool) {
+	password := instance.Credentials.Password
+	if !strings.HasPrefix(password, legacyPrefix) {
+		return "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(password, legacyPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	opened, err := e.decrypt(instance.ID, parts[0], parts[1])
+	if err != nil {
+		return "", false
+	}
+	return opened, true
+}
+
+func (e *encrypting) encrypt(instanceID string, plaintext string) (string, error) {
+	aead, err := newAEAD(e.primary)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(instanceID))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (e *encrypting) decrypt(instanceID string, keyID string, value string) (string, error) {
+	key, ok := e.keys[keyID]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(instanceID))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func newAEAD(key Key) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
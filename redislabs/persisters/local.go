@@ -2,35 +2,109 @@ package persisters
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 	"sync"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/files"
 )
 
 var (
-	stateFileMask = os.FileMode(0777)
+	// BackupCount is the number of previous states kept next to the state
+	// file as state.json.1 (the latest) to state.json.N.
+	BackupCount = 5
 )
 
 // Local implements StatePersister and stores the broker state
 // in a JSON file in the file system.
+//
+// The file is replaced atomically so that a crash never leaves a partially
+// written state behind. An advisory lock on a file next to it serializes
+// the broker processes sharing the state.
 type local struct {
 	stateFilePath string
 	lock          sync.Mutex
 }
 
+func NewLocalPersister(path string) StatePersister {
+	return &local{
+		stateFilePath: path,
+	}
+}
+
+// OpenLocalPersister returns the local persister after making sure the
+// state can be loaded, so that the broker does not start over with
+// an empty state when the file is unreadable.
+func OpenLocalPersister(path string) (StatePersister, error) {
+	l := NewLocalPersister(path)
+	if _, err := l.Load(); err != nil {
+		return nil, fmt.Errorf("the broker state %s cannot be loaded: %s", path, err)
+	}
+	return l, nil
+}
+
 // Load loads the state from the local JSON file. If such file
 // does not exist (no Save has been made to date) it returns an empty state.
 func (l *local) Load() (*State, error) {
 	l.lock.Lock()
 	defer l.lock.Unlock()
 
+	var s *State
+	err := files.WithLock(l.stateFilePath, files.Shared, func() (err error) {
+		s, err = l.load()
+		return err
+	})
+	return s, err
+}
+
+// Save saves the state to the local JSON file. It creates it if it does not
+// exist.
+func (l *local) Save(s *State) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return files.WithLock(l.stateFilePath, files.Exclusive, func() error {
+		current, err := l.load()
+		if err != nil {
+			return err
+		}
+		if s.Version != current.Version {
+			return ErrConflict
+		}
+		return l.save(s, current.Version+1)
+	})
+}
+
+// Update holds the file lock from loading the state until saving it, so
+// other processes cannot change the state in between.
+func (l *local) Update(change func(*State) error) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return files.WithLock(l.stateFilePath, files.Exclusive, func() error {
+		s, err := l.load()
+		if err != nil {
+			return err
+		}
+		if err = change(s); err != nil {
+			return err
+		}
+		return l.save(s, s.Version+1)
+	})
+}
+
+func (l *local) load() (*State, error) {
+	bytes, err := ioutil.ReadFile(l.stateFilePath)
 	// Return an empty state if the file does not exist.
-	if _, err := os.Stat(l.stateFilePath); os.IsNotExist(err) {
+	if os.IsNotExist(err) {
 		return &State{}, nil
 	}
-
-	bytes, err := ioutil.ReadFile(l.stateFilePath)
+	if err != nil {
+		return nil, err
+	}
+	// A state restored from an older file is upgraded on the fly.
+	bytes, _, err = Migrate(bytes)
 	if err != nil {
 		return nil, err
 	}
@@ -42,36 +116,49 @@ func (l *local) Load() (*State, error) {
 	return &s, nil
 }
 
-// Save saves the state to the local JSON file. It creates it if it does not
-// exist.
-func (l *local) Save(s *State) error {
-	l.lock.Lock()
-	defer l.lock.Unlock()
-
-	stateFileFolder, err := filepath.Abs(filepath.Dir(l.stateFilePath))
+// save writes the state with the given version, keeping the previous one
+// as a backup.
+func (l *local) save(s *State, version int64) error {
+	saved := *s
+	saved.Version = version
+	saved.SchemaVersion = SchemaVersion()
+	bytes, err := json.Marshal(saved)
 	if err != nil {
 		return err
 	}
-
-	err = os.MkdirAll(stateFileFolder, stateFileMask)
-	if err != nil {
+	if err = l.backup(); err != nil {
 		return err
 	}
-
-	bytes, err := json.Marshal(s)
-	if err != nil {
+	if err = files.WriteAtomically(l.stateFilePath, bytes); err != nil {
 		return err
 	}
+	s.Version = version
+	s.SchemaVersion = saved.SchemaVersion
+	return nil
+}
 
-	err = ioutil.WriteFile(l.stateFilePath, bytes, stateFileMask)
+// backup shifts the backups by one and copies the current state
+// to the first one.
+func (l *local) backup() error {
+	if BackupCount < 1 {
+		return nil
+	}
+	current, err := ioutil.ReadFile(l.stateFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	return nil
+	for i := BackupCount - 1; i >= 1; i-- {
+		err := os.Rename(l.backupPath(i), l.backupPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return files.WriteAtomically(l.backupPath(1), current)
 }
 
-func NewLocalPersister(path string) StatePersister {
-	return &local{
-		stateFilePath: path,
-	}
+func (l *local) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", l.stateFilePath, i)
 }
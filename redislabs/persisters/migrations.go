@@ -0,0 +1,138 @@
+package persisters
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/files"
+)
+
+// Migration upgrades a state document from the previous schema version
+// to Version. It works on the decoded JSON so that it does not depend on
+// the current State type.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(doc map[string]interface{}) error
+}
+
+// Migrations are applied in order to the documents of older schema
+// versions. A change to the state layout appends a migration here.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Record the schema version, the layout is unchanged",
+		Up:          func(doc map[string]interface{}) error { return nil },
+	},
+	{
+		// A broker that does not know the bindings would drop them on save.
+		Version:     2,
+		Description: "Record the bindings, none are known before",
+		Up:          func(doc map[string]interface{}) error { return nil },
+	},
+	{
+		// A plain text password could read like a sealed one. The
+		// passwords sealed before are told apart when they are opened,
+		// which takes the keys.
+		Version:     3,
+		Description: "Record the key of the sealed passwords instead of prefixing them",
+		Up:          func(doc map[string]interface{}) error { return nil },
+	},
+}
+
+const schemaVersionKey = "schema_version"
+
+// SchemaVersion returns the schema version the broker writes.
+func SchemaVersion() int {
+	if len(Migrations) == 0 {
+		return 0
+	}
+	return Migrations[len(Migrations)-1].Version
+}
+
+// Migrate upgrades the state document to the current schema version and
+// returns it with the version it has been upgraded from. A document of
+// the current version is returned as it is.
+func Migrate(data []byte) ([]byte, int, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	doc := map[string]interface{}{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, 0, err
+	}
+
+	from := 0
+	if v, ok := doc[schemaVersionKey].(json.Number); ok {
+		n, err := v.Int64()
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid state schema version %s", v)
+		}
+		from = int(n)
+	}
+	current := SchemaVersion()
+	if from > current {
+		return nil, from, fmt.Errorf("the state has schema version %d, this broker only supports up to %d", from, current)
+	}
+	if from == current {
+		return data, from, nil
+	}
+
+	for _, m := range Migrations {
+		if m.Version <= from {
+			continue
+		}
+		if err := m.Up(doc); err != nil {
+			return nil, from, fmt.Errorf("failed to migrate the state to schema version %d: %s", m.Version, err)
+		}
+		doc[schemaVersionKey] = m.Version
+	}
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return nil, from, err
+	}
+	return migrated, from, nil
+}
+
+// MigrateFile upgrades the state file to the current schema version. The
+// original file is kept as <path>.schema-v<version> before it is replaced.
+// With dryRun the file is left untouched and the migrated state is written
+// to out instead. It returns the versions migrated from and to.
+func MigrateFile(path string, dryRun bool, out io.Writer) (int, int, error) {
+	from, to := 0, SchemaVersion()
+	err := files.WithLock(path, files.Exclusive, func() error {
+		original, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			from = to
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var migrated []byte
+		migrated, from, err = Migrate(original)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			var indented bytes.Buffer
+			if err = json.Indent(&indented, migrated, "", "  "); err != nil {
+				return err
+			}
+			indented.WriteString("\n")
+			_, err = indented.WriteTo(out)
+			return err
+		}
+		if from == to {
+			return nil
+		}
+		if err = files.WriteAtomically(fmt.Sprintf("%s.schema-v%d", path, from), original); err != nil {
+			return err
+		}
+		return files.WriteAtomically(path, migrated)
+	})
+	return from, to, err
+}
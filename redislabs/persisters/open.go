@@ -0,0 +1,59 @@
+package persisters
+
+import (
+	"database/sql"
+	"fmt"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+)
+
+// Open returns the persister of the configured backend once the state
+// has been loaded, so that a broker does not start without it. The local
+// backend keeps the state at localPath, upgrading its schema first.
+func Open(conf config.StateConfig, localPath string, logger lager.Logger) (StatePersister, error) {
+	var persister StatePersister
+	switch conf.Backend {
+	case "redis":
+		persister = NewRedisPersister(conf.Redis)
+		if _, err := persister.Load(); err != nil {
+			return nil, err
+		}
+	case "sql":
+		db, err := sql.Open(conf.SQL.Driver, conf.SQL.DSN)
+		if err != nil {
+			return nil, fmt.Errorf("%s, the broker has to be built with -tags %s", err, conf.SQL.Driver)
+		}
+		if persister, err = NewSQLPersister(db, conf.SQL.Driver); err != nil {
+			return nil, err
+		}
+	default:
+		from, to, err := MigrateFile(localPath, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		if from != to {
+			logger.Info("Migrated the broker state", lager.Data{
+				"from-schema-version": from,
+				"to-schema-version":   to,
+			})
+		}
+		if persister, err = OpenLocalPersister(localPath); err != nil {
+			return nil, err
+		}
+	}
+	if len(conf.Encryption.Keys) == 0 {
+		return persister, nil
+	}
+	return encrypt(persister, conf.Encryption)
+}
+
+// encrypt wraps the persister to encrypt the credentials. The stored
+// ones are sealed with the current key by Reencrypt.
+func encrypt(persister StatePersister, conf config.EncryptionConfig) (StatePersister, error) {
+	keys, err := LoadKeys(conf.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptingPersister(persister, keys)
+}
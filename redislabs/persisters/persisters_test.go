@@ -1,12 +1,20 @@
 package persisters_test
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"sync"
 
+	"code.cloudfoundry.org/lager"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
 	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/testing"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -47,5 +55,502 @@ var _ = Describe("Persisters", func() {
 				Expect(loaded).To(Equal(&state))
 			})
 		})
+
+		Context("Given concurrent updates", func() {
+			var (
+				tmpStateDir string
+				stateFile   string
+			)
+
+			BeforeEach(func() {
+				var err error
+				tmpStateDir, err = ioutil.TempDir("", "redislabs-state-test")
+				Expect(err).NotTo(HaveOccurred())
+				stateFile = path.Join(tmpStateDir, "state.json")
+				Expect(persisters.NewLocalPersister(stateFile).Save(&state)).To(Succeed())
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(tmpStateDir)
+			})
+
+			It("Starts over with the state another process has saved in the meantime", func() {
+				local := persisters.NewLocalPersister(stateFile)
+				other := persisters.NewLocalPersister(stateFile)
+				_, err := local.Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(other.Update(func(s *persisters.State) error {
+					s.AvailableInstances = append(s.AvailableInstances, persisters.ServiceInstance{ID: "other-id"})
+					return nil
+				})).To(Succeed())
+
+				err = local.Update(func(s *persisters.State) error {
+					s.AvailableInstances = append(s.AvailableInstances, persisters.ServiceInstance{ID: "new-id"})
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				loaded, err := local.Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(loaded.Version).To(Equal(int64(3)))
+				ids := []string{}
+				for _, instance := range loaded.AvailableInstances {
+					ids = append(ids, instance.ID)
+				}
+				Expect(ids).To(Equal([]string{"test-id", "other-id", "new-id"}))
+			})
+
+			It("Serializes the updates of processes sharing the file", func() {
+				var wg sync.WaitGroup
+				for p := 0; p < 2; p++ {
+					wg.Add(1)
+					go func(p int) {
+						defer GinkgoRecover()
+						defer wg.Done()
+						// Every process opens the file on its own.
+						local := persisters.NewLocalPersister(stateFile)
+						for i := 0; i < 10; i++ {
+							Expect(local.Update(func(s *persisters.State) error {
+								id := fmt.Sprintf("instance-%d-%d", p, i)
+								s.AvailableInstances = append(s.AvailableInstances, persisters.ServiceInstance{ID: id})
+								return nil
+							})).To(Succeed())
+						}
+					}(p)
+				}
+				wg.Wait()
+
+				loaded, err := persisters.NewLocalPersister(stateFile).Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(loaded.AvailableInstances).To(HaveLen(21))
+				Expect(loaded.Version).To(Equal(int64(21)))
+			})
+
+			It("Leaves the state as it is if the change fails", func() {
+				local := persisters.NewLocalPersister(stateFile)
+				failure := errors.New("invalid change")
+				err := local.Update(func(s *persisters.State) error {
+					s.AvailableInstances = nil
+					return failure
+				})
+				Expect(err).To(Equal(failure))
+
+				loaded, err := local.Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(loaded.AvailableInstances).To(HaveLen(1))
+			})
+		})
+
+		Context("Given a state file", func() {
+			var (
+				tmpStateDir string
+				stateFile   string
+				local       persisters.StatePersister
+			)
+
+			BeforeEach(func() {
+				var err error
+				tmpStateDir, err = ioutil.TempDir("", "redislabs-state-test")
+				Expect(err).NotTo(HaveOccurred())
+				stateFile = path.Join(tmpStateDir, "state.json")
+				local = persisters.NewLocalPersister(stateFile)
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(tmpStateDir)
+			})
+
+			It("Is readable by the owner only", func() {
+				Expect(local.Save(&state)).To(Succeed())
+				info, err := os.Stat(stateFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			})
+
+			It("Keeps the last states as backups", func() {
+				for i := 0; i < persisters.BackupCount+2; i++ {
+					Expect(local.Save(&state)).To(Succeed())
+				}
+				backup, err := persisters.NewLocalPersister(stateFile + ".1").Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(backup.Version).To(Equal(state.Version - 1))
+
+				oldest, err := persisters.NewLocalPersister(fmt.Sprintf("%s.%d", stateFile, persisters.BackupCount)).Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(oldest.Version).To(Equal(state.Version - int64(persisters.BackupCount)))
+				_, err = os.Stat(fmt.Sprintf("%s.%d", stateFile, persisters.BackupCount+1))
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+
+			It("Refuses to open an unreadable state", func() {
+				Expect(ioutil.WriteFile(stateFile, []byte(`{"AvailableInstances":[`), 0600)).To(Succeed())
+				_, err := persisters.OpenLocalPersister(stateFile)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("Opens a missing state as an empty one", func() {
+				opened, err := persisters.OpenLocalPersister(stateFile)
+				Expect(err).NotTo(HaveOccurred())
+				loaded, err := opened.Load()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(loaded.AvailableInstances).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Encrypting persister", func() {
+		var (
+			tmpStateDir string
+			local       persisters.StatePersister
+			oldKey      = persisters.Key{ID: "old", Secret: bytes.Repeat([]byte{1}, 32)}
+			newKey      = persisters.Key{ID: "new", Secret: bytes.Repeat([]byte{2}, 32)}
+		)
+
+		BeforeEach(func() {
+			var err error
+			tmpStateDir, err = ioutil.TempDir("", "redislabs-state-test")
+			Expect(err).NotTo(HaveOccurred())
+			local = persisters.NewLocalPersister(path.Join(tmpStateDir, "state.json"))
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpStateDir)
+		})
+
+		encrypting := func(keys ...persisters.Key) persisters.StatePersister {
+			p, err := persisters.NewEncryptingPersister(local, keys)
+			Expect(err).NotTo(HaveOccurred())
+			return p
+		}
+
+		It("Stores the passwords encrypted", func() {
+			Expect(encrypting(oldKey).Save(&state)).To(Succeed())
+
+			stored, err := local.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored.AvailableInstances[0].PasswordKey).To(Equal("old"))
+			Expect(stored.AvailableInstances[0].Credentials.Password).NotTo(ContainSubstring("passw0rd"))
+			Expect(stored.AvailableInstances[0].Credentials.UID).To(Equal(1))
+
+			loaded, err := encrypting(oldKey).Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances[0].Credentials.Password).To(Equal("passw0rd"))
+			Expect(state.AvailableInstances[0].Credentials.Password).To(Equal("passw0rd"))
+		})
+
+		It("Re-encrypts the state with a new key while the old one still decrypts", func() {
+			Expect(encrypting(oldKey).Save(&state)).To(Succeed())
+
+			rotated := encrypting(newKey, oldKey)
+			Expect(persisters.Reencrypt(rotated)).To(Equal(1))
+			stored, err := local.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored.AvailableInstances[0].PasswordKey).To(Equal("new"))
+
+			loaded, err := encrypting(newKey).Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances[0].Credentials.Password).To(Equal("passw0rd"))
+
+			_, err = encrypting(oldKey).Load()
+			Expect(err).To(MatchError(ContainSubstring(persisters.ErrUnknownKey.Error())))
+		})
+
+		It("Seals the passwords stored in plain text", func() {
+			Expect(local.Save(&state)).To(Succeed())
+			p := encrypting(oldKey)
+			loaded, err := p.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances[0].Credentials.Password).To(Equal("passw0rd"))
+
+			Expect(persisters.Reencrypt(p)).To(Equal(1))
+			stored, err := local.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored.AvailableInstances[0].PasswordKey).To(Equal("old"))
+		})
+
+		It("Leaves the state as it is when every password is sealed with the first key", func() {
+			Expect(encrypting(newKey).Save(&state)).To(Succeed())
+			before, err := ioutil.ReadFile(path.Join(tmpStateDir, "state.json"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(persisters.Reencrypt(encrypting(newKey, oldKey))).To(Equal(0))
+			after, err := ioutil.ReadFile(path.Join(tmpStateDir, "state.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(after).To(Equal(before))
+			_, err = os.Stat(path.Join(tmpStateDir, "state.json.1"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("Does not change the state on open", func() {
+			Expect(local.Save(&state)).To(Succeed())
+			before, err := ioutil.ReadFile(path.Join(tmpStateDir, "state.json"))
+			Expect(err).NotTo(HaveOccurred())
+
+			keyFile := path.Join(tmpStateDir, "key")
+			Expect(ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(newKey.Secret)), 0600)).To(Succeed())
+			_, err = persisters.Open(config.StateConfig{
+				Encryption: config.EncryptionConfig{Keys: []config.KeyConfig{{ID: "new", File: keyFile}}},
+			}, path.Join(tmpStateDir, "state.json"), lager.NewLogger("test"))
+			Expect(err).NotTo(HaveOccurred())
+
+			after, err := ioutil.ReadFile(path.Join(tmpStateDir, "state.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(after).To(Equal(before))
+		})
+
+		It("Refuses to re-encrypt a state that is not encrypted", func() {
+			_, err := persisters.Reencrypt(local)
+			Expect(err).To(Equal(persisters.ErrNotEncrypting))
+		})
+
+		It("Seals a plain text password that reads like a sealed one", func() {
+			state.AvailableInstances[0].Credentials.Password = "aesgcm:old:cGFzc3cwcmQ="
+			Expect(encrypting(oldKey).Save(&state)).To(Succeed())
+
+			stored, err := local.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored.AvailableInstances[0].PasswordKey).To(Equal("old"))
+			Expect(stored.AvailableInstances[0].Credentials.Password).NotTo(Equal("aesgcm:old:cGFzc3cwcmQ="))
+
+			loaded, err := encrypting(oldKey).Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances[0].Credentials.Password).To(Equal("aesgcm:old:cGFzc3cwcmQ="))
+			Expect(loaded.AvailableInstances[0].PasswordKey).To(BeEmpty())
+		})
+
+		It("Opens the passwords sealed before the key has been recorded", func() {
+			Expect(encrypting(oldKey).Save(&state)).To(Succeed())
+			stored, err := local.Load()
+			Expect(err).NotTo(HaveOccurred())
+			sealed := stored.AvailableInstances[0].Credentials.Password
+			legacy := fmt.Sprintf(`{"AvailableInstances":[{"ID":"test-id","Credentials":{"UID":1,"Password":"aesgcm:old:%s"}}],"schema_version":2}`, sealed)
+			Expect(ioutil.WriteFile(path.Join(tmpStateDir, "state.json"), []byte(legacy), 0600)).To(Succeed())
+
+			loaded, err := encrypting(oldKey).Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances[0].Credentials.Password).To(Equal("passw0rd"))
+
+			rotated := encrypting(newKey, oldKey)
+			Expect(persisters.Reencrypt(rotated)).To(Equal(1))
+			stored, err = local.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored.AvailableInstances[0].PasswordKey).To(Equal("new"))
+			loaded, err = encrypting(newKey).Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances[0].Credentials.Password).To(Equal("passw0rd"))
+		})
+
+		It("Takes a password stored before the keys were recorded as plain text unless it opens with the key it names", func() {
+			legacy := `{"AvailableInstances":[` +
+				`{"ID":"test-id","Credentials":{"UID":1,"Password":"aesgcm:old:cGFzc3cwcmQ="}},` +
+				`{"ID":"other-id","Credentials":{"UID":2,"Password":"aesgcm:unknown:cGFzc3cwcmQ="}},` +
+				`{"ID":"third-id","Credentials":{"UID":3,"Password":"aesgcm:old"}}` +
+				`],"schema_version":2}`
+			Expect(ioutil.WriteFile(path.Join(tmpStateDir, "state.json"), []byte(legacy), 0600)).To(Succeed())
+
+			p := encrypting(oldKey)
+			loaded, err := p.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances[0].Credentials.Password).To(Equal("aesgcm:old:cGFzc3cwcmQ="))
+			Expect(loaded.AvailableInstances[1].Credentials.Password).To(Equal("aesgcm:unknown:cGFzc3cwcmQ="))
+			Expect(loaded.AvailableInstances[2].Credentials.Password).To(Equal("aesgcm:old"))
+
+			Expect(persisters.Reencrypt(p)).To(Equal(3))
+			loaded, err = p.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances[0].Credentials.Password).To(Equal("aesgcm:old:cGFzc3cwcmQ="))
+			Expect(loaded.AvailableInstances[1].Credentials.Password).To(Equal("aesgcm:unknown:cGFzc3cwcmQ="))
+			Expect(loaded.AvailableInstances[2].Credentials.Password).To(Equal("aesgcm:old"))
+		})
+
+		It("Rejects a password moved to another instance", func() {
+			Expect(encrypting(oldKey).Save(&state)).To(Succeed())
+			stored, err := local.Load()
+			Expect(err).NotTo(HaveOccurred())
+			stored.AvailableInstances[0].ID = "another-id"
+			Expect(local.Save(stored)).To(Succeed())
+
+			_, err = encrypting(oldKey).Load()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Loads the keys from files and environment variables", func() {
+			keyFile := path.Join(tmpStateDir, "key")
+			Expect(ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(newKey.Secret)+"\n"), 0600)).To(Succeed())
+			os.Setenv("REDISLABS_TEST_STATE_KEY", base64.StdEncoding.EncodeToString(oldKey.Secret))
+			defer os.Unsetenv("REDISLABS_TEST_STATE_KEY")
+
+			keys, err := persisters.LoadKeys([]config.KeyConfig{
+				{ID: "new", File: keyFile},
+				{ID: "old", Env: "REDISLABS_TEST_STATE_KEY"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(Equal([]persisters.Key{newKey, oldKey}))
+		})
+
+		It("Rejects keys of the wrong size", func() {
+			_, err := persisters.NewEncryptingPersister(local, []persisters.Key{{ID: "short", Secret: []byte("short")}})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Schema migrations", func() {
+		var (
+			tmpStateDir string
+			stateFile   string
+			migrations  []persisters.Migration
+		)
+
+		// A document written before the schema version was recorded.
+		legacy := `{"AvailableInstances":[{"ID":"test-id","Credentials":{"UID":1,"Port":11909,"IPList":["10.0.0.1"],"Password":"passw0rd"}}]}`
+
+		BeforeEach(func() {
+			var err error
+			tmpStateDir, err = ioutil.TempDir("", "redislabs-state-test")
+			Expect(err).NotTo(HaveOccurred())
+			stateFile = path.Join(tmpStateDir, "state.json")
+			Expect(ioutil.WriteFile(stateFile, []byte(legacy), 0600)).To(Succeed())
+
+			migrations = persisters.Migrations
+			persisters.Migrations = append(append([]persisters.Migration{}, migrations...), persisters.Migration{
+				Version:     persisters.SchemaVersion() + 1,
+				Description: "Assign the instances without a plan to the default one",
+				Up: func(doc map[string]interface{}) error {
+					for _, instance := range doc["AvailableInstances"].([]interface{}) {
+						instance.(map[string]interface{})["PlanID"] = "default-plan"
+					}
+					return nil
+				},
+			})
+		})
+
+		AfterEach(func() {
+			persisters.Migrations = migrations
+			os.RemoveAll(tmpStateDir)
+		})
+
+		It("Upgrades an older document step by step on load", func() {
+			loaded, err := persisters.NewLocalPersister(stateFile).Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.SchemaVersion).To(Equal(persisters.SchemaVersion()))
+			Expect(loaded.AvailableInstances[0].PlanID).To(Equal("default-plan"))
+			Expect(loaded.AvailableInstances[0].Credentials.Password).To(Equal("passw0rd"))
+		})
+
+		It("Keeps the original file when migrating it", func() {
+			from, to, err := persisters.MigrateFile(stateFile, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(from).To(Equal(0))
+			Expect(to).To(Equal(persisters.SchemaVersion()))
+
+			backup, err := ioutil.ReadFile(stateFile + ".schema-v0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(backup)).To(Equal(legacy))
+			migrated, err := ioutil.ReadFile(stateFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(migrated)).To(ContainSubstring(fmt.Sprintf(`"schema_version":%d`, to)))
+
+			from, _, err = persisters.MigrateFile(stateFile, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(from).To(Equal(to))
+		})
+
+		It("Prints the migrated state on a dry run without changing the file", func() {
+			out := &bytes.Buffer{}
+			_, _, err := persisters.MigrateFile(stateFile, true, out)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(out.String()).To(ContainSubstring(`"PlanID": "default-plan"`))
+
+			original, err := ioutil.ReadFile(stateFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(original)).To(Equal(legacy))
+			_, err = os.Stat(stateFile + ".schema-v0")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("Refuses a document of a newer schema version", func() {
+			newer := fmt.Sprintf(`{"AvailableInstances":[],"schema_version":%d}`, persisters.SchemaVersion()+1)
+			Expect(ioutil.WriteFile(stateFile, []byte(newer), 0600)).To(Succeed())
+			_, err := persisters.NewLocalPersister(stateFile).Load()
+			Expect(err).To(MatchError(ContainSubstring("only supports up to")))
+		})
+	})
+
+	Describe("Redis persister", func() {
+		var (
+			server *testing.RedisServer
+			conf   config.RedisStateConfig
+		)
+
+		BeforeEach(func() {
+			server = testing.NewRedisServer("redis-secret")
+			conf = config.RedisStateConfig{
+				Address:  server.Address(),
+				Password: "redis-secret",
+				DB:       2,
+			}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("Saves the state and then loads it back", func() {
+			redis := persisters.NewRedisPersister(conf)
+			empty, err := redis.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(empty.AvailableInstances).To(BeEmpty())
+
+			Expect(redis.Save(&state)).To(Succeed())
+			loaded, err := persisters.NewRedisPersister(conf).Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded).To(Equal(&state))
+
+			_, ok := server.Get(2, persisters.DefaultRedisKey)
+			Expect(ok).To(BeTrue())
+		})
+
+		It("Fails to connect with a wrong password", func() {
+			conf.Password = "wrong"
+			_, err := persisters.NewRedisPersister(conf).Load()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Starts over with the state another broker has saved in the meantime", func() {
+			redis := persisters.NewRedisPersister(conf)
+			other := persisters.NewRedisPersister(conf)
+			Expect(redis.Save(&state)).To(Succeed())
+
+			attempts := 0
+			err := redis.Update(func(s *persisters.State) error {
+				attempts++
+				if attempts == 1 {
+					Expect(other.Update(func(s *persisters.State) error {
+						s.AvailableInstances = append(s.AvailableInstances, persisters.ServiceInstance{ID: "other-id"})
+						return nil
+					})).To(Succeed())
+				}
+				s.AvailableInstances = append(s.AvailableInstances, persisters.ServiceInstance{ID: "new-id"})
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(attempts).To(Equal(2))
+
+			loaded, err := redis.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.Version).To(Equal(int64(3)))
+			Expect(loaded.AvailableInstances).To(HaveLen(3))
+			Expect(loaded.AvailableInstances[1].ID).To(Equal("other-id"))
+			Expect(loaded.AvailableInstances[2].ID).To(Equal("new-id"))
+		})
+
+		It("Gives up after too many conflicts", func() {
+			redis := persisters.NewRedisPersister(conf)
+			err := redis.Update(func(s *persisters.State) error {
+				server.Set(2, persisters.DefaultRedisKey, `{"AvailableInstances":[]}`)
+				return nil
+			})
+			Expect(err).To(Equal(persisters.ErrConflict))
+		})
 	})
 })
@@ -0,0 +1,265 @@
+// Package persisterstest holds the contract every StatePersister has to
+// meet, as Ginkgo specs a backend runs from its own suite.
+package persisterstest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Backend tells the conformance specs how to reach the persister under
+// test. The specs call Setup before and Teardown after every spec.
+type Backend struct {
+	Setup    func()
+	Teardown func()
+	// New returns a persister of the state set up, every call stands
+	// for another broker process sharing it.
+	New func() persisters.StatePersister
+	// Corrupt damages the stored state, the specs skip the corrupted
+	// data if it is not given.
+	Corrupt func()
+}
+
+var (
+	// LargeStateSize is the number of instances of the large state spec.
+	LargeStateSize = 2000
+	// Concurrency is the number of processes updating the state at once.
+	Concurrency = 8
+)
+
+// Conformance registers the specs of the contract for the backend.
+func Conformance(name string, backend Backend) bool {
+	return Context(name+" conformance", func() {
+		BeforeEach(func() {
+			if backend.Setup != nil {
+				backend.Setup()
+			}
+		})
+
+		AfterEach(func() {
+			if backend.Teardown != nil {
+				backend.Teardown()
+			}
+		})
+
+		It("Loads an empty state before anything is saved", func() {
+			state, err := backend.New().Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.AvailableInstances).To(BeEmpty())
+		})
+
+		It("Loads back exactly what has been saved", func() {
+			saved := &persisters.State{AvailableInstances: []persisters.ServiceInstance{
+				Instance("instance-1"),
+				{
+					ID: "instance-2",
+					Credentials: cluster.InstanceCredentials{
+						UID:      2,
+						Port:     12000,
+						IPList:   []string{"10.0.0.3", "10.0.0.4"},
+						Password: `p"a\ss:w0rd ✓`,
+					},
+					InstanceDetails: persisters.InstanceDetails{
+						PlanID:           "plan-2",
+						OrganizationGUID: "org-2",
+						SpaceGUID:        "space-2",
+					},
+				},
+			}, Bindings: []persisters.ServiceBinding{
+				{ID: "binding-1", InstanceID: "instance-1"},
+				{ID: "binding-2", InstanceID: "instance-1"},
+			}}
+			Expect(backend.New().Save(saved)).To(Succeed())
+
+			loaded, err := backend.New().Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances).To(ConsistOf(saved.AvailableInstances))
+			Expect(loaded.Bindings).To(ConsistOf(saved.Bindings))
+			Expect(loaded.Version).To(Equal(saved.Version))
+		})
+
+		It("Removes the bindings a change removes", func() {
+			p := backend.New()
+			Expect(p.Save(&persisters.State{
+				AvailableInstances: []persisters.ServiceInstance{Instance("instance-1")},
+				Bindings: []persisters.ServiceBinding{
+					{ID: "binding-1", InstanceID: "instance-1"},
+					{ID: "binding-2", InstanceID: "instance-1"},
+				},
+			})).To(Succeed())
+			Expect(p.Update(func(s *persisters.State) error {
+				s.Bindings = s.Bindings[1:]
+				return nil
+			})).To(Succeed())
+
+			loaded, err := backend.New().Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.Bindings).To(Equal([]persisters.ServiceBinding{
+				{ID: "binding-2", InstanceID: "instance-1"},
+			}))
+		})
+
+		It("Increments the version on every save", func() {
+			p := backend.New()
+			state := &persisters.State{}
+			Expect(p.Save(state)).To(Succeed())
+			first := state.Version
+			Expect(p.Update(func(s *persisters.State) error {
+				s.AvailableInstances = append(s.AvailableInstances, Instance("instance-1"))
+				return nil
+			})).To(Succeed())
+
+			loaded, err := p.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.Version).To(BeNumerically(">", first))
+		})
+
+		It("Refuses to save a state saved by someone else since it has been loaded", func() {
+			p := backend.New()
+			Expect(p.Save(&persisters.State{AvailableInstances: []persisters.ServiceInstance{Instance("instance-1")}})).To(Succeed())
+			stale, err := p.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backend.New().Update(func(s *persisters.State) error {
+				s.AvailableInstances = append(s.AvailableInstances, Instance("instance-2"))
+				return nil
+			})).To(Succeed())
+
+			stale.AvailableInstances = nil
+			Expect(p.Save(stale)).To(Equal(persisters.ErrConflict))
+			Expect(p.Save(&persisters.State{})).To(Equal(persisters.ErrConflict))
+
+			loaded, err := p.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances).To(HaveLen(2))
+			loaded.AvailableInstances = loaded.AvailableInstances[:1]
+			Expect(p.Save(loaded)).To(Succeed())
+		})
+
+		It("Leaves the state as it is if the change fails", func() {
+			p := backend.New()
+			Expect(p.Save(&persisters.State{AvailableInstances: []persisters.ServiceInstance{Instance("instance-1")}})).To(Succeed())
+
+			failure := fmt.Errorf("invalid change")
+			Expect(p.Update(func(s *persisters.State) error {
+				s.AvailableInstances = nil
+				return failure
+			})).To(Equal(failure))
+
+			loaded, err := p.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances).To(HaveLen(1))
+		})
+
+		It("Does not lose the updates of processes running at once", func() {
+			var wg sync.WaitGroup
+			for p := 0; p < Concurrency; p++ {
+				wg.Add(1)
+				go func(p int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					persister := backend.New()
+					for i := 0; i < 5; i++ {
+						Expect(persister.Update(func(s *persisters.State) error {
+							s.AvailableInstances = append(s.AvailableInstances, Instance(fmt.Sprintf("instance-%d-%d", p, i)))
+							return nil
+						})).To(Succeed())
+					}
+				}(p)
+			}
+			wg.Wait()
+
+			loaded, err := backend.New().Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances).To(HaveLen(Concurrency * 5))
+		})
+
+		It("Does not overwrite a change saved between loading and saving", func() {
+			// A backend either detects the conflict and starts over or
+			// holds the other process off until it is done.
+			loaded := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				<-loaded
+				Expect(backend.New().Update(func(s *persisters.State) error {
+					s.AvailableInstances = append(s.AvailableInstances, Instance("other"))
+					return nil
+				})).To(Succeed())
+			}()
+
+			var once sync.Once
+			Expect(backend.New().Update(func(s *persisters.State) error {
+				once.Do(func() { close(loaded) })
+				select {
+				case <-done:
+				case <-time.After(100 * time.Millisecond):
+				}
+				s.AvailableInstances = append(s.AvailableInstances, Instance("mine"))
+				return nil
+			})).To(Succeed())
+			<-done
+
+			state, err := backend.New().Load()
+			Expect(err).NotTo(HaveOccurred())
+			ids := []string{}
+			for _, instance := range state.AvailableInstances {
+				ids = append(ids, instance.ID)
+			}
+			Expect(ids).To(ConsistOf("other", "mine"))
+		})
+
+		It("Handles a large state", func() {
+			state := &persisters.State{}
+			for i := 0; i < LargeStateSize; i++ {
+				state.AvailableInstances = append(state.AvailableInstances, Instance(fmt.Sprintf("instance-%05d", i)))
+			}
+			p := backend.New()
+			Expect(p.Save(state)).To(Succeed())
+			Expect(p.Update(func(s *persisters.State) error {
+				s.AvailableInstances = append(s.AvailableInstances, Instance("one-more"))
+				return nil
+			})).To(Succeed())
+
+			loaded, err := backend.New().Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances).To(HaveLen(LargeStateSize + 1))
+		})
+
+		It("Fails to load corrupted data instead of returning an empty state", func() {
+			if backend.Corrupt == nil {
+				Skip("the backend cannot corrupt its data")
+			}
+			Expect(backend.New().Save(&persisters.State{AvailableInstances: []persisters.ServiceInstance{Instance("instance-1")}})).To(Succeed())
+			backend.Corrupt()
+
+			_, err := backend.New().Load()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+}
+
+// Instance returns an instance with every field set.
+func Instance(ID string) persisters.ServiceInstance {
+	return persisters.ServiceInstance{
+		ID: ID,
+		Credentials: cluster.InstanceCredentials{
+			UID:      1,
+			Port:     11909,
+			IPList:   []string{"10.0.0.1", "10.0.0.2"},
+			Password: "passw0rd",
+		},
+		InstanceDetails: persisters.InstanceDetails{
+			PlanID:           "plan-1",
+			OrganizationGUID: "org-1",
+			SpaceGUID:        "space-1",
+		},
+	}
+}
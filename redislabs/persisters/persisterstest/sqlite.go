@@ -0,0 +1,45 @@
+// +build cgo
+
+package persisterstest
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLDatabase is an SQLite database in a temporary folder. It uses "?"
+// placeholders like MySQL. The SQLite driver needs cgo, so the specs
+// using it are built with cgo only.
+type SQLDatabase struct {
+	*sql.DB
+	dir string
+}
+
+// NewSQLDatabase returns an empty database. Connections wait for the
+// locks of one another rather than fail, so that brokers sharing the
+// database can be run at once. The database should be removed via Close.
+func NewSQLDatabase() *SQLDatabase {
+	dir, err := ioutil.TempDir("", "redislabs-sql-test")
+	if err != nil {
+		panic(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "state.db")+"?_busy_timeout=10000")
+	if err != nil {
+		panic(err)
+	}
+	// Readers do not block the writer with write-ahead logging.
+	if _, err = db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		panic(err)
+	}
+	return &SQLDatabase{DB: db, dir: dir}
+}
+
+func (d *SQLDatabase) Close() error {
+	err := d.DB.Close()
+	os.RemoveAll(d.dir)
+	return err
+}
@@ -0,0 +1,188 @@
+package persisters
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/resp"
+)
+
+var (
+	// Defaults used unless the Redis key and timeout are configured.
+	DefaultRedisKey = "redislabs-broker:state"
+	RedisTimeout    = 5 // seconds
+)
+
+// redisPersister implements StatePersister and stores the broker state
+// as a JSON document in a Redis key, so that several brokers can share it.
+// Every save is a WATCH/MULTI/EXEC transaction that fails if another
+// broker has written the key since it has been read.
+type redisPersister struct {
+	opts resp.Options
+	key  string
+
+	lock sync.Mutex
+	idle *resp.Conn
+}
+
+func NewRedisPersister(conf config.RedisStateConfig) StatePersister {
+	key := conf.Key
+	if key == "" {
+		key = DefaultRedisKey
+	}
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = RedisTimeout
+	}
+	return &redisPersister{
+		opts: resp.Options{
+			Address:  conf.Address,
+			Password: conf.Password,
+			DB:       conf.DB,
+			TLS:      conf.TLS,
+			Timeout:  time.Duration(timeout) * time.Second,
+		},
+		key: key,
+	}
+}
+
+func (r *redisPersister) Load() (s *State, err error) {
+	conn, err := r.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release(conn, &err)
+
+	return r.load(conn)
+}
+
+func (r *redisPersister) Save(s *State) error {
+	saved, err := r.transaction(func(current *State) (*State, error) {
+		if s.Version != current.Version {
+			return nil, ErrConflict
+		}
+		copied := *s
+		return &copied, nil
+	})
+	if err != nil {
+		return err
+	}
+	s.Version = saved.Version
+	s.SchemaVersion = saved.SchemaVersion
+	return nil
+}
+
+func (r *redisPersister) Update(change func(*State) error) error {
+	_, err := r.transaction(func(current *State) (*State, error) {
+		return current, change(current)
+	})
+	return err
+}
+
+// transaction saves the state the change makes of the current one. It
+// starts over if the key has been written in the meantime.
+func (r *redisPersister) transaction(change func(*State) (*State, error)) (saved *State, err error) {
+	conn, err := r.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release(conn, &err)
+
+	for attempt := 0; attempt < MaxUpdateAttempts; attempt++ {
+		if _, err = conn.Do("WATCH", r.key); err != nil {
+			return nil, err
+		}
+		current, err := r.load(conn)
+		if err != nil {
+			return nil, err
+		}
+		next, err := change(current)
+		if err == ErrConflict {
+			// The connection is kept, without the WATCH.
+			if _, err = conn.Do("UNWATCH"); err != nil {
+				return nil, err
+			}
+			return nil, ErrConflict
+		}
+		if err != nil {
+			// The connection is dropped, along with the WATCH.
+			return nil, err
+		}
+		next.Version = current.Version + 1
+		next.SchemaVersion = SchemaVersion()
+		bytes, err := json.Marshal(next)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = conn.Do("MULTI"); err != nil {
+			return nil, err
+		}
+		if _, err = conn.Do("SET", r.key, string(bytes)); err != nil {
+			return nil, err
+		}
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			return next, nil
+		}
+		waitAfterConflict(attempt)
+	}
+	return nil, ErrConflict
+}
+
+func (r *redisPersister) load(conn *resp.Conn) (*State, error) {
+	reply, err := conn.Do("GET", r.key)
+	if err != nil {
+		return nil, err
+	}
+	// Return an empty state if nothing has been saved yet.
+	if reply == nil {
+		return &State{}, nil
+	}
+	document, ok := reply.(string)
+	if !ok {
+		return nil, resp.ErrProtocol
+	}
+	bytes, _, err := Migrate([]byte(document))
+	if err != nil {
+		return nil, err
+	}
+	s := State{}
+	if err = json.Unmarshal(bytes, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// conn returns the idle connection or dials a new one.
+func (r *redisPersister) conn() (*resp.Conn, error) {
+	r.lock.Lock()
+	conn := r.idle
+	r.idle = nil
+	r.lock.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+	return resp.Dial(r.opts)
+}
+
+// release keeps the connection for the next operation unless it has
+// failed, in which case its state is unknown.
+func (r *redisPersister) release(conn *resp.Conn, err *error) {
+	if *err != nil && *err != ErrConflict {
+		conn.Close()
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.idle == nil {
+		r.idle = conn
+		return
+	}
+	conn.Close()
+}
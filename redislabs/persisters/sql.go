@@ -0,0 +1,623 @@
+package persisters
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqlPersister implements StatePersister on top of database/sql. Every
+// instance is a row of its own with a version of its own: a change only
+// writes the rows it touches, and fails unless they still have the
+// versions it has loaded, so that brokers changing other instances do
+// not get in the way of one another. Every written row is logged in the
+// operations table, whose latest ID is the state version.
+type sqlPersister struct {
+	db     *sql.DB
+	driver string
+
+	// cache holds the instance rows loaded so far, a load only reads
+	// the ones whose version has changed since.
+	lock  sync.Mutex
+	cache map[string]versionedInstance
+}
+
+type versionedInstance struct {
+	ServiceInstance
+	version int64
+}
+
+// sqlMigration is a step of the database schema, applied once in order.
+type sqlMigration struct {
+	Version    int
+	Statements []string
+}
+
+var sqlMigrations = []sqlMigration{
+	{
+		Version: 1,
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS broker_state (id INTEGER PRIMARY KEY, version BIGINT NOT NULL)`,
+			`CREATE TABLE IF NOT EXISTS instances (
+				id VARCHAR(255) PRIMARY KEY,
+				uid INTEGER NOT NULL,
+				port INTEGER NOT NULL,
+				ip_list TEXT NOT NULL,
+				password TEXT NOT NULL,
+				plan_id VARCHAR(255) NOT NULL,
+				organization_guid VARCHAR(255) NOT NULL,
+				space_guid VARCHAR(255) NOT NULL
+			)`,
+		},
+	},
+	{
+		Version: 2,
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS bindings (
+				id VARCHAR(255) PRIMARY KEY,
+				instance_id VARCHAR(255) NOT NULL
+			)`,
+		},
+	},
+	{
+		// The single version row made every change conflict with every
+		// other one, brokers of older versions fail on it being gone.
+		Version: 3,
+		Statements: []string{
+			`ALTER TABLE instances ADD COLUMN version BIGINT NOT NULL DEFAULT 1`,
+			`CREATE TABLE IF NOT EXISTS operations (
+				id BIGSERIAL PRIMARY KEY,
+				object_type VARCHAR(16) NOT NULL,
+				object_id VARCHAR(255) NOT NULL,
+				action VARCHAR(16) NOT NULL,
+				created_at VARCHAR(64) NOT NULL
+			)`,
+			`DROP TABLE broker_state`,
+		},
+	},
+	{
+		// A plain text password could read like a sealed one. The
+		// passwords sealed before are told apart when they are opened,
+		// which takes the keys.
+		Version: 4,
+		Statements: []string{
+			`ALTER TABLE instances ADD COLUMN password_key VARCHAR(255) NOT NULL DEFAULT ''`,
+		},
+	},
+}
+
+const instanceColumns = "id, uid, port, ip_list, password, password_key, plan_id, organization_guid, space_guid, version"
+
+var (
+	// KeptOperations is the number of the latest operations kept in the
+	// operations table, older ones are removed as new ones are logged.
+	KeptOperations = 10000
+
+	// sqlBatchSize bounds the placeholders of a statement, SQLite takes
+	// 999 at most.
+	sqlBatchSize = 500
+)
+
+// NewSQLPersister returns a persister storing the state in the database,
+// whose schema it brings up to date first. The driver name tells the
+// SQL dialect: postgres takes $1 placeholders, mysql and sqlite take ?.
+func NewSQLPersister(db *sql.DB, driver string) (StatePersister, error) {
+	p := &sqlPersister{
+		db:     db,
+		driver: driver,
+		cache:  map[string]versionedInstance{},
+	}
+	if err := p.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate the state database: %s", err)
+	}
+	return p, nil
+}
+
+func (p *sqlPersister) Load() (*State, error) {
+	s, _, err := p.load()
+	return s, err
+}
+
+// load returns the state along with the versions of its instances. Only
+// the instance rows whose version differs from the cached one are read.
+func (p *sqlPersister) load() (*State, map[string]int64, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	s := &State{SchemaVersion: SchemaVersion()}
+	err = tx.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM operations`).Scan(&s.Version)
+	if err != nil {
+		return nil, nil, err
+	}
+	versions, err := p.instanceVersions(tx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.lock.Lock()
+	cached := p.cache
+	p.lock.Unlock()
+
+	stale := []string{}
+	for id, version := range versions {
+		if instance, ok := cached[id]; !ok || instance.version != version {
+			stale = append(stale, id)
+		}
+	}
+	fetched, err := p.readInstances(tx, stale)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The rows removed since their version has been read are left out.
+	current := map[string]versionedInstance{}
+	ids := []string{}
+	for id, version := range versions {
+		instance, ok := fetched[id]
+		if !ok {
+			if instance, ok = cached[id]; !ok || instance.version != version {
+				continue
+			}
+		}
+		current[id] = instance
+		ids = append(ids, id)
+	}
+	p.lock.Lock()
+	p.cache = current
+	p.lock.Unlock()
+
+	sort.Strings(ids)
+	loaded := map[string]int64{}
+	for _, id := range ids {
+		s.AvailableInstances = append(s.AvailableInstances, current[id].copy())
+		loaded[id] = current[id].version
+	}
+
+	if s.Bindings, err = p.readBindings(tx); err != nil {
+		return nil, nil, err
+	}
+	return s, loaded, nil
+}
+
+// instanceVersions returns the version of every instance row.
+func (p *sqlPersister) instanceVersions(tx *sql.Tx) (map[string]int64, error) {
+	rows, err := tx.Query(`SELECT id, version FROM instances`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := map[string]int64{}
+	for rows.Next() {
+		var (
+			id      string
+			version int64
+		)
+		if err = rows.Scan(&id, &version); err != nil {
+			return nil, err
+		}
+		versions[id] = version
+	}
+	return versions, rows.Err()
+}
+
+// readInstances reads the instance rows with the given IDs.
+func (p *sqlPersister) readInstances(tx *sql.Tx, ids []string) (map[string]versionedInstance, error) {
+	instances := map[string]versionedInstance{}
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > sqlBatchSize {
+			batch = ids[:sqlBatchSize]
+		}
+		ids = ids[len(batch):]
+
+		args := []interface{}{}
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+		rows, err := tx.Query(p.rebind(`SELECT `+instanceColumns+` FROM instances WHERE id IN (`+placeholders+`)`), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var (
+				instance versionedInstance
+				ipList   string
+			)
+			err = rows.Scan(
+				&instance.ID,
+				&instance.Credentials.UID,
+				&instance.Credentials.Port,
+				&ipList,
+				&instance.Credentials.Password,
+				&instance.PasswordKey,
+				&instance.PlanID,
+				&instance.OrganizationGUID,
+				&instance.SpaceGUID,
+				&instance.version,
+			)
+			if err == nil {
+				err = json.Unmarshal([]byte(ipList), &instance.Credentials.IPList)
+			}
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			instances[instance.ID] = instance
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return instances, nil
+}
+
+func (p *sqlPersister) readBindings(tx *sql.Tx) ([]ServiceBinding, error) {
+	rows, err := tx.Query(`SELECT id, instance_id FROM bindings ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var bindings []ServiceBinding
+	for rows.Next() {
+		var binding ServiceBinding
+		if err = rows.Scan(&binding.ID, &binding.InstanceID); err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings, rows.Err()
+}
+
+// copy returns the instance without sharing the IP list with the cache.
+func (i versionedInstance) copy() ServiceInstance {
+	instance := i.ServiceInstance
+	if instance.Credentials.IPList != nil {
+		instance.Credentials.IPList = append([]string{}, instance.Credentials.IPList...)
+	}
+	return instance
+}
+
+func (p *sqlPersister) Save(s *State) error {
+	saved, err := p.transaction(func(current *State) (*State, error) {
+		if s.Version != current.Version {
+			return nil, ErrConflict
+		}
+		copied := *s
+		return &copied, nil
+	})
+	if err != nil {
+		return err
+	}
+	s.Version = saved.Version
+	s.SchemaVersion = saved.SchemaVersion
+	return nil
+}
+
+func (p *sqlPersister) Update(change func(*State) error) error {
+	_, err := p.transaction(func(current *State) (*State, error) {
+		return current, change(current)
+	})
+	return err
+}
+
+// transaction writes the rows the change makes differ from the current
+// state. It starts over if any of them has been changed in the meantime.
+func (p *sqlPersister) transaction(change func(*State) (*State, error)) (*State, error) {
+	for attempt := 0; attempt < MaxUpdateAttempts; attempt++ {
+		current, versions, err := p.load()
+		if err != nil {
+			return nil, err
+		}
+		before := State{
+			AvailableInstances: append([]ServiceInstance{}, current.AvailableInstances...),
+			Bindings:           append([]ServiceBinding{}, current.Bindings...),
+		}
+		next, err := change(current)
+		if err != nil {
+			return nil, err
+		}
+		version, err := p.write(&before, versions, next)
+		if err != nil && err != ErrConflict && p.changedSince(&before, versions) {
+			// A row inserted by another broker fails the insert.
+			err = ErrConflict
+		}
+		if err == ErrConflict {
+			waitAfterConflict(attempt)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		next.Version = version
+		next.SchemaVersion = SchemaVersion()
+		return next, nil
+	}
+	return nil, ErrConflict
+}
+
+// write applies the difference between the states in a transaction and
+// returns the state version it results in.
+func (p *sqlPersister) write(before *State, versions map[string]int64, after *State) (int64, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	log := &operationLog{}
+	if err = p.writeInstances(tx, log, before.AvailableInstances, versions, after.AvailableInstances); err != nil {
+		return 0, err
+	}
+	if err = p.writeBindings(tx, log, before.Bindings, after.Bindings); err != nil {
+		return 0, err
+	}
+	version, err := p.logOperations(tx, log.operations)
+	if err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+func (p *sqlPersister) writeInstances(tx *sql.Tx, log *operationLog, before []ServiceInstance, versions map[string]int64, after []ServiceInstance) error {
+	existing := map[string]ServiceInstance{}
+	for _, instance := range before {
+		existing[instance.ID] = instance
+	}
+	kept := map[string]bool{}
+	for _, instance := range after {
+		kept[instance.ID] = true
+		old, ok := existing[instance.ID]
+		if ok && reflect.DeepEqual(old, instance) {
+			continue
+		}
+		ipList, err := json.Marshal(instance.Credentials.IPList)
+		if err != nil {
+			return err
+		}
+		values := []interface{}{
+			instance.Credentials.UID,
+			instance.Credentials.Port,
+			string(ipList),
+			instance.Credentials.Password,
+			instance.PasswordKey,
+			instance.PlanID,
+			instance.OrganizationGUID,
+			instance.SpaceGUID,
+		}
+		if ok {
+			values = append(values, versions[instance.ID]+1, instance.ID, versions[instance.ID])
+			err = expectRow(tx.Exec(p.rebind(`UPDATE instances SET uid = ?, port = ?, ip_list = ?, password = ?, password_key = ?, plan_id = ?, organization_guid = ?, space_guid = ?, version = ? WHERE id = ? AND version = ?`), values...))
+			log.add("instance", instance.ID, "update")
+		} else {
+			values = append(values, 1, instance.ID)
+			_, err = tx.Exec(p.rebind(`INSERT INTO instances (uid, port, ip_list, password, password_key, plan_id, organization_guid, space_guid, version, id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`), values...)
+			log.add("instance", instance.ID, "create")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, instance := range before {
+		if kept[instance.ID] {
+			continue
+		}
+		if err := expectRow(tx.Exec(p.rebind(`DELETE FROM instances WHERE id = ? AND version = ?`), instance.ID, versions[instance.ID])); err != nil {
+			return err
+		}
+		log.add("instance", instance.ID, "delete")
+	}
+	return nil
+}
+
+func (p *sqlPersister) writeBindings(tx *sql.Tx, log *operationLog, before, after []ServiceBinding) error {
+	existing := map[string]ServiceBinding{}
+	for _, binding := range before {
+		existing[binding.ID] = binding
+	}
+	kept := map[string]bool{}
+	for _, binding := range after {
+		kept[binding.ID] = true
+		old, ok := existing[binding.ID]
+		var err error
+		switch {
+		case ok && old == binding:
+			continue
+		case ok:
+			err = expectRow(tx.Exec(p.rebind(`UPDATE bindings SET instance_id = ? WHERE id = ? AND instance_id = ?`), binding.InstanceID, binding.ID, old.InstanceID))
+			log.add("binding", binding.ID, "update")
+		default:
+			_, err = tx.Exec(p.rebind(`INSERT INTO bindings (instance_id, id) VALUES (?, ?)`), binding.InstanceID, binding.ID)
+			log.add("binding", binding.ID, "create")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, binding := range before {
+		if kept[binding.ID] {
+			continue
+		}
+		if err := expectRow(tx.Exec(p.rebind(`DELETE FROM bindings WHERE id = ? AND instance_id = ?`), binding.ID, binding.InstanceID)); err != nil {
+			return err
+		}
+		log.add("binding", binding.ID, "delete")
+	}
+	return nil
+}
+
+// expectRow turns a statement that has not found its row into a conflict.
+func expectRow(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+type (
+	// operation is a row written by a change.
+	operation struct {
+		objectType string
+		objectID   string
+		action     string
+	}
+
+	operationLog struct {
+		operations []operation
+	}
+)
+
+func (l *operationLog) add(objectType string, objectID string, action string) {
+	l.operations = append(l.operations, operation{objectType, objectID, action})
+}
+
+// logOperations records the operations, drops the ones beyond
+// KeptOperations and returns the latest operation ID.
+func (p *sqlPersister) logOperations(tx *sql.Tx, operations []operation) (int64, error) {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, o := range operations {
+		_, err := tx.Exec(p.rebind(`INSERT INTO operations (object_type, object_id, action, created_at) VALUES (?, ?, ?, ?)`), o.objectType, o.objectID, o.action, now)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var latest int64
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM operations`).Scan(&latest); err != nil {
+		return 0, err
+	}
+	if len(operations) > 0 && latest > int64(KeptOperations) {
+		if _, err := tx.Exec(p.rebind(`DELETE FROM operations WHERE id <= ?`), latest-int64(KeptOperations)); err != nil {
+			return 0, err
+		}
+	}
+	return latest, nil
+}
+
+// changedSince tells whether the instances or the bindings differ from
+// the ones loaded with the given versions.
+func (p *sqlPersister) changedSince(before *State, versions map[string]int64) bool {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return false
+	}
+	defer tx.Rollback()
+
+	current, err := p.instanceVersions(tx)
+	if err != nil || !reflect.DeepEqual(current, versions) {
+		return err == nil
+	}
+	bindings, err := p.readBindings(tx)
+	if err != nil {
+		return false
+	}
+	return len(bindings) != len(before.Bindings) || (len(bindings) > 0 && !reflect.DeepEqual(bindings, before.Bindings))
+}
+
+// migrate applies the schema steps the database has not seen yet.
+// Brokers starting at once may race to apply a step, the ones that lose
+// find it applied and go on.
+func (p *sqlPersister) migrate() error {
+	if _, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	applied, err := p.schemaVersion()
+	if err != nil {
+		return err
+	}
+	for _, m := range sqlMigrations {
+		if m.Version <= applied {
+			continue
+		}
+		if err = p.applyMigration(m); err == nil {
+			continue
+		}
+		if applied, _ = p.schemaVersion(); applied < m.Version {
+			return fmt.Errorf("schema version %d: %s", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration records the step before it runs the statements, so that
+// a broker applying it at the same time fails on the version row.
+func (p *sqlPersister) applyMigration(m sqlMigration) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if _, err = tx.Exec(p.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), m.Version); err != nil {
+		return err
+	}
+	for _, statement := range m.Statements {
+		if _, err = tx.Exec(p.retype(statement)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *sqlPersister) schemaVersion() (int, error) {
+	rows, err := p.db.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	applied := 0
+	for rows.Next() {
+		var version int
+		if err = rows.Scan(&version); err != nil {
+			return 0, err
+		}
+		if version > applied {
+			applied = version
+		}
+	}
+	return applied, rows.Err()
+}
+
+// rebind turns the ? placeholders into $1, $2... for PostgreSQL.
+func (p *sqlPersister) rebind(query string) string {
+	if !p.postgres() {
+		return query
+	}
+	parts := strings.Split(query, "?")
+	rebound := parts[0]
+	for i, part := range parts[1:] {
+		rebound += fmt.Sprintf("$%d", i+1) + part
+	}
+	return rebound
+}
+
+// retype turns the PostgreSQL BIGSERIAL keys into the generated keys of
+// MySQL and SQLite.
+func (p *sqlPersister) retype(statement string) string {
+	switch {
+	case p.postgres():
+		return statement
+	case p.driver == "mysql":
+		return strings.Replace(statement, "BIGSERIAL PRIMARY KEY", "BIGINT AUTO_INCREMENT PRIMARY KEY", -1)
+	}
+	return strings.Replace(statement, "BIGSERIAL PRIMARY KEY", "INTEGER PRIMARY KEY AUTOINCREMENT", -1)
+}
+
+func (p *sqlPersister) postgres() bool {
+	return p.driver == "postgres" || p.driver == "pgx"
+}
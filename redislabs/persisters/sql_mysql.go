@@ -0,0 +1,6 @@
+// +build mysql
+
+package persisters
+
+// Built with -tags mysql the sql state backend can use the mysql driver.
+import _ "github.com/go-sql-driver/mysql"
@@ -0,0 +1,7 @@
+// +build postgres
+
+package persisters
+
+// Built with -tags postgres the sql state backend can use
+// the postgres driver.
+import _ "github.com/lib/pq"
@@ -0,0 +1,15 @@
+// +build sqlite
+
+package persisters
+
+import (
+	"database/sql"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Built with -tags sqlite the sql state backend can use the sqlite
+// driver, which needs cgo.
+func init() {
+	sql.Register("sqlite", &sqlite3.SQLiteDriver{})
+}
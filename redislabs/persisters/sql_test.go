@@ -0,0 +1,278 @@
+// +build cgo
+
+package persisters_test
+
+import (
+	"sync"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters/persisterstest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// The SQL persister is tested against SQLite, which needs cgo.
+var _ = Describe("Persister conformance", func() {
+	var db *persisterstest.SQLDatabase
+	persisterstest.Conformance("SQL persister", persisterstest.Backend{
+		Setup: func() {
+			db = persisterstest.NewSQLDatabase()
+		},
+		Teardown: func() {
+			db.Close()
+		},
+		New: func() persisters.StatePersister {
+			p, err := persisters.NewSQLPersister(db.DB, "sqlite")
+			Expect(err).NotTo(HaveOccurred())
+			return p
+		},
+		Corrupt: func() {
+			_, err := db.Exec("UPDATE instances SET ip_list = ?", "not json")
+			Expect(err).NotTo(HaveOccurred())
+		},
+	})
+})
+
+var _ = Describe("Persisters", func() {
+	var (
+		state persisters.State
+	)
+
+	BeforeEach(func() {
+		state = persisters.State{
+			AvailableInstances: []persisters.ServiceInstance{
+				{
+					ID: "test-id",
+					Credentials: cluster.InstanceCredentials{
+						UID:      1,
+						Port:     11909,
+						IPList:   []string{"10.0.0.1", "10.0.0.2"},
+						Password: "passw0rd",
+					},
+				},
+			},
+		}
+	})
+
+	Describe("SQL persister", func() {
+		var db *persisterstest.SQLDatabase
+
+		BeforeEach(func() {
+			db = persisterstest.NewSQLDatabase()
+		})
+
+		AfterEach(func() {
+			db.Close()
+		})
+
+		newPersister := func() persisters.StatePersister {
+			p, err := persisters.NewSQLPersister(db.DB, "sqlite")
+			Expect(err).NotTo(HaveOccurred())
+			return p
+		}
+
+		It("Keeps the instances of a database of the previous schema", func() {
+			for _, statement := range []string{
+				`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY)`,
+				`INSERT INTO schema_migrations (version) VALUES (1), (2)`,
+				`CREATE TABLE broker_state (id INTEGER PRIMARY KEY, version BIGINT NOT NULL)`,
+				`INSERT INTO broker_state (id, version) VALUES (1, 7)`,
+				`CREATE TABLE instances (id VARCHAR(255) PRIMARY KEY, uid INTEGER NOT NULL, port INTEGER NOT NULL, ip_list TEXT NOT NULL,
+					password TEXT NOT NULL, plan_id VARCHAR(255) NOT NULL, organization_guid VARCHAR(255) NOT NULL, space_guid VARCHAR(255) NOT NULL)`,
+				`INSERT INTO instances VALUES ('test-id', 1, 11909, '["10.0.2.4"]', 'pass', 'plan', 'org', 'space')`,
+				`INSERT INTO instances VALUES ('x-sealed-id', 2, 11910, '[]', 'aesgcm:old:c2VhbGVk', 'plan', 'org', 'space')`,
+				`CREATE TABLE bindings (id VARCHAR(255) PRIMARY KEY, instance_id VARCHAR(255) NOT NULL)`,
+			} {
+				_, err := db.Exec(statement)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			p := newPersister()
+			Expect(p.Update(func(s *persisters.State) error {
+				Expect(s.AvailableInstances).To(HaveLen(2))
+				s.AvailableInstances[0].PlanID = "larger-plan"
+				return nil
+			})).To(Succeed())
+			loaded, err := newPersister().Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances[0].PlanID).To(Equal("larger-plan"))
+			Expect(loaded.AvailableInstances[0].Credentials.IPList).To(Equal([]string{"10.0.2.4"}))
+			// The keys tell the sealed passwords apart when they are opened.
+			Expect(loaded.AvailableInstances[1].PasswordKey).To(BeEmpty())
+			Expect(loaded.AvailableInstances[1].Credentials.Password).To(Equal("aesgcm:old:c2VhbGVk"))
+		})
+
+		It("Lets brokers starting at once bring the schema up to date", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					newPersister()
+				}()
+			}
+			wg.Wait()
+
+			loaded, err := newPersister().Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.Version).To(Equal(int64(0)))
+		})
+
+		It("Saves the state and then loads it back", func() {
+			p := newPersister()
+			empty, err := p.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(empty.AvailableInstances).To(BeEmpty())
+
+			Expect(p.Save(&state)).To(Succeed())
+			loaded, err := newPersister().Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded).To(Equal(&state))
+		})
+
+		It("Writes only the rows a change touches", func() {
+			p := newPersister()
+			Expect(p.Save(&state)).To(Succeed())
+			Expect(p.Update(func(s *persisters.State) error {
+				s.AvailableInstances[0].PlanID = "larger-plan"
+				s.AvailableInstances = append(s.AvailableInstances, persisters.ServiceInstance{ID: "new-id"})
+				return nil
+			})).To(Succeed())
+
+			var planID string
+			Expect(db.QueryRow("SELECT plan_id FROM instances WHERE id = ?", "test-id").Scan(&planID)).To(Succeed())
+			Expect(planID).To(Equal("larger-plan"))
+
+			Expect(p.Update(func(s *persisters.State) error {
+				left := []persisters.ServiceInstance{}
+				for _, instance := range s.AvailableInstances {
+					if instance.ID != "test-id" {
+						left = append(left, instance)
+					}
+				}
+				s.AvailableInstances = left
+				return nil
+			})).To(Succeed())
+			loaded, err := p.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances).To(HaveLen(1))
+			Expect(loaded.AvailableInstances[0].ID).To(Equal("new-id"))
+			Expect(loaded.Version).To(Equal(int64(4)))
+
+			rows, err := db.Query("SELECT object_type, object_id, action FROM operations ORDER BY id")
+			Expect(err).NotTo(HaveOccurred())
+			defer rows.Close()
+			operations := []string{}
+			for rows.Next() {
+				var objectType, objectID, action string
+				Expect(rows.Scan(&objectType, &objectID, &action)).To(Succeed())
+				operations = append(operations, objectType+" "+objectID+" "+action)
+			}
+			Expect(operations).To(Equal([]string{
+				"instance test-id create",
+				"instance test-id update",
+				"instance new-id create",
+				"instance test-id delete",
+			}))
+		})
+
+		It("Starts over when another broker has changed the same instance in the meantime", func() {
+			p := newPersister()
+			other := newPersister()
+			Expect(p.Save(&state)).To(Succeed())
+			attempts := 0
+			err := p.Update(func(s *persisters.State) error {
+				attempts++
+				if attempts == 1 {
+					Expect(other.Update(func(s *persisters.State) error {
+						s.AvailableInstances[0].SpaceGUID = "other-space"
+						return nil
+					})).To(Succeed())
+				}
+				s.AvailableInstances[0].PlanID = "larger-plan"
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(attempts).To(Equal(2))
+
+			loaded, err := newPersister().Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances[0].SpaceGUID).To(Equal("other-space"))
+			Expect(loaded.AvailableInstances[0].PlanID).To(Equal("larger-plan"))
+		})
+
+		It("Does not start over when another broker has changed other instances", func() {
+			p := newPersister()
+			other := newPersister()
+			Expect(p.Save(&state)).To(Succeed())
+			attempts := 0
+			err := p.Update(func(s *persisters.State) error {
+				attempts++
+				if attempts == 1 {
+					Expect(other.Update(func(s *persisters.State) error {
+						s.AvailableInstances = append(s.AvailableInstances, persisters.ServiceInstance{ID: "other-id"})
+						return nil
+					})).To(Succeed())
+				}
+				s.AvailableInstances[0].PlanID = "larger-plan"
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(attempts).To(Equal(1))
+
+			loaded, err := newPersister().Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances).To(HaveLen(2))
+			Expect(loaded.AvailableInstances[0].ID).To(Equal("other-id"))
+			Expect(loaded.AvailableInstances[1].PlanID).To(Equal("larger-plan"))
+		})
+
+		It("Starts over when another broker has recorded the same instance in the meantime", func() {
+			p := newPersister()
+			other := newPersister()
+			attempts := 0
+			err := p.Update(func(s *persisters.State) error {
+				attempts++
+				if attempts == 1 {
+					Expect(other.Save(&state)).To(Succeed())
+				}
+				for _, instance := range s.AvailableInstances {
+					if instance.ID == "test-id" {
+						return nil
+					}
+				}
+				s.AvailableInstances = append(s.AvailableInstances, persisters.ServiceInstance{ID: "test-id"})
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(attempts).To(Equal(2))
+
+			loaded, err := newPersister().Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances).To(Equal(state.AvailableInstances))
+		})
+
+		It("Reads only the instances changed since the last load", func() {
+			p := newPersister()
+			Expect(p.Save(&state)).To(Succeed())
+			_, err := p.Load()
+			Expect(err).NotTo(HaveOccurred())
+
+			// A row changed without its version is taken from the cache.
+			_, err = db.Exec("UPDATE instances SET plan_id = ? WHERE id = ?", "edited-plan", "test-id")
+			Expect(err).NotTo(HaveOccurred())
+			loaded, err := p.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances[0].PlanID).To(Equal(state.AvailableInstances[0].PlanID))
+
+			_, err = db.Exec("UPDATE instances SET version = version + 1 WHERE id = ?", "test-id")
+			Expect(err).NotTo(HaveOccurred())
+			loaded, err = p.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loaded.AvailableInstances[0].PlanID).To(Equal("edited-plan"))
+		})
+	})
+})
@@ -1,20 +1,81 @@
 package persisters
 
-import "github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+)
 
 // StatePersister is responsible for saving & retrieving
 // the broker state, the information about available service
 // instances and their parameters.
 type StatePersister interface {
+	// Save saves the state unless it has been saved since the state
+	// has been loaded, in which case it returns ErrConflict. A state
+	// never saved has version 0.
 	Save(s *State) error
 	Load() (*State, error)
+	// Update loads the state, applies the change and saves the result
+	// unless the state has been saved in the meantime, in which case
+	// it starts over with the new state. The state is left as it is
+	// if the change returns an error.
+	Update(change func(*State) error) error
 }
 
 type State struct {
 	AvailableInstances []ServiceInstance
+	// Bindings lists the bindings made since they have been recorded,
+	// older ones are not known.
+	Bindings []ServiceBinding `json:",omitempty"`
+	// Version is incremented by every save. Update relies on it
+	// to detect concurrent changes.
+	Version int64
+	// SchemaVersion is the layout of the stored state, see Migrations.
+	SchemaVersion int `json:"schema_version"`
 }
 
 type ServiceInstance struct {
 	ID          string
 	Credentials cluster.InstanceCredentials
+	// PasswordKey is the ID of the key the password is sealed with,
+	// a password stored in plain text has none.
+	PasswordKey string `json:",omitempty"`
+	InstanceDetails
+}
+
+// ServiceBinding is a binding of an instance. Its credentials are the
+// ones of the instance.
+type ServiceBinding struct {
+	ID         string
+	InstanceID string
+}
+
+// InstanceDetails tell whom an instance belongs to and which plan
+// it has been provisioned with.
+type InstanceDetails struct {
+	PlanID           string
+	OrganizationGUID string
+	SpaceGUID        string
+}
+
+var (
+	// ErrConflict is returned when the state has been saved by someone
+	// else since it has been loaded.
+	ErrConflict = errors.New("the broker state has been changed concurrently")
+
+	// MaxUpdateAttempts bounds how many times Update starts over after
+	// a conflict.
+	MaxUpdateAttempts = 10
+
+	// ConflictBackoff is the longest wait after the first conflict, it
+	// grows with the attempts.
+	ConflictBackoff = 10 * time.Millisecond
+)
+
+// waitAfterConflict waits a random while so that the processes in
+// conflict do not collide again right away.
+func waitAfterConflict(attempt int) {
+	time.Sleep(time.Duration(rand.Int63n(int64(attempt+1) * int64(ConflictBackoff))))
 }
@@ -0,0 +1,172 @@
+package recovery
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+)
+
+type (
+	// Skipped is a cluster database that cannot be turned into an
+	// instance.
+	Skipped struct {
+		UID    int
+		Name   string
+		Reason string
+	}
+
+	// Result lists what the cluster databases tell about the instances.
+	Result struct {
+		// Instances are rebuilt from the databases named the way the
+		// broker names them. The organization and space are not known,
+		// the plan is the one whose settings match the database.
+		Instances []persisters.ServiceInstance
+		Skipped   []Skipped
+	}
+)
+
+// The broker names a database <prefix>-<instance ID> and the platform
+// uses GUIDs as instance IDs.
+var instanceName = regexp.MustCompile(`^.+-([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`)
+
+// Rebuild reconstructs the instances from the databases of the cluster.
+func Rebuild(ctx context.Context, api apiclient.Client, conf config.Config, logger lager.Logger) (Result, error) {
+	databases, err := api.ListDatabases(ctx)
+	if err != nil {
+		logger.Error("Failed to list the databases", err)
+		return Result{}, err
+	}
+	sort.Sort(byUID(databases))
+
+	result := Result{}
+	seen := map[string]int{}
+	for _, database := range databases {
+		match := instanceName.FindStringSubmatch(database.Name)
+		if match == nil {
+			result.Skipped = append(result.Skipped, Skipped{
+				UID:    database.UID,
+				Name:   database.Name,
+				Reason: "the name does not end with an instance ID",
+			})
+			continue
+		}
+		instanceID := strings.ToLower(match[1])
+		if uid, ok := seen[instanceID]; ok {
+			result.Skipped = append(result.Skipped, Skipped{
+				UID:    database.UID,
+				Name:   database.Name,
+				Reason: fmt.Sprintf("database %d has the same instance ID", uid),
+			})
+			continue
+		}
+		credentials, err := Credentials(database)
+		if err != nil {
+			result.Skipped = append(result.Skipped, Skipped{
+				UID:    database.UID,
+				Name:   database.Name,
+				Reason: err.Error(),
+			})
+			continue
+		}
+		seen[instanceID] = database.UID
+		result.Instances = append(result.Instances, persisters.ServiceInstance{
+			ID:          instanceID,
+			Credentials: credentials,
+			InstanceDetails: persisters.InstanceDetails{
+				PlanID: matchingPlan(database, conf.ServiceBroker.Plans),
+			},
+		})
+	}
+	return result, nil
+}
+
+// Apply adds the instances the state does not know, the ones it knows
+// are left as they are. It returns the number of instances added.
+func Apply(persister persisters.StatePersister, instances []persisters.ServiceInstance) (int, error) {
+	added := 0
+	err := persister.Update(func(state *persisters.State) error {
+		added = 0
+		known := map[string]bool{}
+		for _, instance := range state.AvailableInstances {
+			known[instance.ID] = true
+		}
+		for _, instance := range instances {
+			if !known[instance.ID] {
+				state.AvailableInstances = append(state.AvailableInstances, instance)
+				added++
+			}
+		}
+		return nil
+	})
+	return added, err
+}
+
+// Credentials returns the credentials of the database the way the broker
+// stores them on creation.
+func Credentials(database apiclient.Database) (cluster.InstanceCredentials, error) {
+	port := database.Port
+	if port == 0 {
+		parts := strings.Split(database.DNSAddress, ":")
+		if len(parts) == 2 {
+			port, _ = strconv.Atoi(parts[1])
+		}
+	}
+	if port == 0 {
+		return cluster.InstanceCredentials{}, fmt.Errorf("the database reports no port")
+	}
+	return cluster.InstanceCredentials{
+		UID:      database.UID,
+		Port:     port,
+		IPList:   database.IPList,
+		Password: database.Password,
+	}, nil
+}
+
+// Mismatch tells how the database differs from the plan settings, it
+// returns an empty string if the database is what the plan creates.
+func Mismatch(database apiclient.Database, settings config.ServiceInstanceConfig) string {
+	shards := settings.ShardCount
+	if shards < 1 {
+		shards = 1
+	}
+	switch {
+	case settings.MemoryLimit != database.MemorySize:
+		return fmt.Sprintf("the database has %d bytes of memory, the plan %d", database.MemorySize, settings.MemoryLimit)
+	case settings.Replication != database.Replication:
+		return fmt.Sprintf("the database has replication %t, the plan %t", database.Replication, settings.Replication)
+	case shards != int64(database.ShardsCount):
+		return fmt.Sprintf("the database has %d shards, the plan %d", database.ShardsCount, shards)
+	}
+	return ""
+}
+
+// matchingPlan returns the ID of the only plan whose settings match
+// the database, an empty one if there is no such plan.
+func matchingPlan(database apiclient.Database, plans []config.ServicePlanConfig) string {
+	found := ""
+	for _, plan := range plans {
+		if Mismatch(database, plan.ServiceInstanceConfig) != "" {
+			continue
+		}
+		if found != "" {
+			return ""
+		}
+		found = plan.ID
+	}
+	return found
+}
+
+type byUID []apiclient.Database
+
+func (d byUID) Len() int           { return len(d) }
+func (d byUID) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byUID) Less(i, j int) bool { return d[i].UID < d[j].UID }
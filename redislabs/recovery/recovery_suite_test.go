@@ -0,0 +1,13 @@
+package recovery_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRecovery(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Recovery Suite")
+}
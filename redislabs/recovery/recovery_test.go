@@ -0,0 +1,200 @@
+package recovery_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient/fakes"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+	brokerconfig "github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/recovery"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Recovery", func() {
+	const (
+		firstID  = "5d3e1a3c-0f5b-4a5e-9b1e-2f6f7f0c1a01"
+		secondID = "5d3e1a3c-0f5b-4a5e-9b1e-2f6f7f0c1a02"
+	)
+
+	var (
+		api    *fakes.FakeClient
+		conf   brokerconfig.Config
+		ctx    = context.Background()
+		logger = lager.NewLogger("test")
+	)
+
+	BeforeEach(func() {
+		conf = brokerconfig.Config{
+			ServiceBroker: brokerconfig.ServiceBrokerConfig{
+				Plans: []brokerconfig.ServicePlanConfig{
+					{
+						ID: "small-id",
+						ServiceInstanceConfig: brokerconfig.ServiceInstanceConfig{
+							MemoryLimit: 100,
+						},
+					},
+					{
+						ID: "large-id",
+						ServiceInstanceConfig: brokerconfig.ServiceInstanceConfig{
+							MemoryLimit: 400,
+							Replication: true,
+							ShardCount:  2,
+						},
+					},
+				},
+			},
+		}
+		api = &fakes.FakeClient{
+			Databases: map[int]apiclient.Database{
+				1: {
+					UID:         1,
+					Name:        "cf-" + firstID,
+					MemorySize:  100,
+					ShardsCount: 1,
+					Port:        11909,
+					IPList:      []string{"10.0.0.1"},
+					Password:    "first",
+				},
+				2: {
+					UID:         2,
+					Name:        "cache-" + secondID,
+					MemorySize:  400,
+					ShardsCount: 2,
+					Replication: true,
+					DNSAddress:  "redis-12000.cluster.local:12000",
+					IPList:      []string{"10.0.0.2"},
+					Password:    "second",
+				},
+				3: {UID: 3, Name: "created-by-hand", Port: 13000},
+			},
+		}
+	})
+
+	Describe("Rebuilding the instances", func() {
+		It("Reconstructs the instances of the databases named by the broker", func() {
+			result, err := recovery.Rebuild(ctx, api, conf, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Instances).To(Equal([]persisters.ServiceInstance{
+				{
+					ID: firstID,
+					Credentials: cluster.InstanceCredentials{
+						UID:      1,
+						Port:     11909,
+						IPList:   []string{"10.0.0.1"},
+						Password: "first",
+					},
+					InstanceDetails: persisters.InstanceDetails{PlanID: "small-id"},
+				},
+				{
+					ID: secondID,
+					Credentials: cluster.InstanceCredentials{
+						UID:      2,
+						Port:     12000,
+						IPList:   []string{"10.0.0.2"},
+						Password: "second",
+					},
+					InstanceDetails: persisters.InstanceDetails{PlanID: "large-id"},
+				},
+			}))
+		})
+
+		It("Skips the databases whose name has no instance ID", func() {
+			result, err := recovery.Rebuild(ctx, api, conf, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Skipped).To(HaveLen(1))
+			Expect(result.Skipped[0].UID).To(Equal(3))
+			Expect(result.Skipped[0].Name).To(Equal("created-by-hand"))
+		})
+
+		It("Skips a second database with the same instance ID", func() {
+			api.Databases[4] = apiclient.Database{UID: 4, Name: "copy-" + firstID, Port: 14000}
+			result, err := recovery.Rebuild(ctx, api, conf, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Instances).To(HaveLen(2))
+			Expect(result.Skipped).To(HaveLen(2))
+			Expect(result.Skipped[1].UID).To(Equal(4))
+		})
+
+		It("Leaves the plan empty unless exactly one plan matches", func() {
+			conf.ServiceBroker.Plans = append(conf.ServiceBroker.Plans, brokerconfig.ServicePlanConfig{
+				ID: "other-small-id",
+				ServiceInstanceConfig: brokerconfig.ServiceInstanceConfig{
+					MemoryLimit: 100,
+					ShardCount:  1,
+				},
+			})
+			result, err := recovery.Rebuild(ctx, api, conf, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Instances[0].PlanID).To(BeEmpty())
+			Expect(result.Instances[1].PlanID).To(Equal("large-id"))
+		})
+
+		It("Fails if the databases cannot be listed", func() {
+			api.DatabasesError = errors.New("unavailable")
+			_, err := recovery.Rebuild(ctx, api, conf, logger)
+			Expect(err).To(MatchError("unavailable"))
+		})
+	})
+
+	Describe("Applying the instances", func() {
+		var (
+			persister   persisters.StatePersister
+			tmpStateDir string
+		)
+
+		BeforeEach(func() {
+			var err error
+			tmpStateDir, err = ioutil.TempDir("", "redislabs-recovery-test")
+			Expect(err).NotTo(HaveOccurred())
+			persister = persisters.NewLocalPersister(path.Join(tmpStateDir, "state.json"))
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpStateDir)
+		})
+
+		It("Writes the instances to an empty state", func() {
+			result, err := recovery.Rebuild(ctx, api, conf, logger)
+			Expect(err).NotTo(HaveOccurred())
+			added, err := recovery.Apply(persister, result.Instances)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(added).To(Equal(2))
+
+			state, err := persister.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.AvailableInstances).To(Equal(result.Instances))
+		})
+
+		It("Keeps the instances the state knows", func() {
+			known := persisters.ServiceInstance{
+				ID:              firstID,
+				Credentials:     cluster.InstanceCredentials{UID: 1},
+				InstanceDetails: persisters.InstanceDetails{PlanID: "small-id", OrganizationGUID: "org"},
+			}
+			Expect(persister.Save(&persisters.State{
+				AvailableInstances: []persisters.ServiceInstance{known},
+			})).To(Succeed())
+
+			result, err := recovery.Rebuild(ctx, api, conf, logger)
+			Expect(err).NotTo(HaveOccurred())
+			added, err := recovery.Apply(persister, result.Instances)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(added).To(Equal(1))
+
+			state, err := persister.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.AvailableInstances).To(HaveLen(2))
+			Expect(state.AvailableInstances[0]).To(Equal(known))
+			Expect(state.AvailableInstances[1].ID).To(Equal(secondID))
+		})
+	})
+})
@@ -0,0 +1,118 @@
+package redact
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// Mask replaces the values of secret keys.
+const Mask = "[REDACTED]"
+
+// DefaultKeys are masked wherever they appear in a key name,
+// so "pass" covers "authentication_redis_pass" as well.
+var DefaultKeys = []string{"password", "pass", "secret", "token", "private_key", "api_key"}
+
+// Redactor masks the values of secret keys.
+type Redactor struct {
+	lock sync.RWMutex
+	keys []string
+}
+
+// New returns a redactor masking the default keys and the given ones.
+func New(keys ...string) *Redactor {
+	r := &Redactor{}
+	r.Add(DefaultKeys...)
+	r.Add(keys...)
+	return r
+}
+
+// Add makes the redactor mask the given keys too.
+func (r *Redactor) Add(keys ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, key := range keys {
+		r.keys = append(r.keys, strings.ToLower(key))
+	}
+}
+
+// IsSecret tells whether the values of the key are masked.
+func (r *Redactor) IsSecret(key string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	key = strings.ToLower(key)
+	for _, secret := range r.keys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// Value returns a copy of the value as it would be serialized to JSON,
+// with the secret keys masked at any depth.
+func (r *Redactor) Value(value interface{}) interface{} {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return Mask
+	}
+	var generic interface{}
+	if err = json.Unmarshal(bytes, &generic); err != nil {
+		return Mask
+	}
+	return r.redact(generic)
+}
+
+// Data returns a copy of the log data with the secret keys masked.
+func (r *Redactor) Data(data lager.Data) lager.Data {
+	redacted := lager.Data{}
+	for key, value := range data {
+		if r.IsSecret(key) {
+			redacted[key] = Mask
+		} else {
+			redacted[key] = r.Value(value)
+		}
+	}
+	return redacted
+}
+
+func (r *Redactor) redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, nested := range v {
+			if r.IsSecret(key) {
+				v[key] = Mask
+			} else {
+				v[key] = r.redact(nested)
+			}
+		}
+	case []interface{}:
+		for i, nested := range v {
+			v[i] = r.redact(nested)
+		}
+	}
+	return value
+}
+
+type sink struct {
+	sink     lager.Sink
+	redactor *Redactor
+}
+
+// NewSink masks the secret keys in the log data before it reaches
+// the given sink.
+func NewSink(s lager.Sink, redactor *Redactor) lager.Sink {
+	return &sink{
+		sink:     s,
+		redactor: redactor,
+	}
+}
+
+func (s *sink) Log(log lager.LogFormat) {
+	log.Data = s.redactor.Data(log.Data)
+	s.sink.Log(log)
+}
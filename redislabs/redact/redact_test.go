@@ -0,0 +1,123 @@
+package redact_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+	brokerconfig "github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/httpclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/instancebinders"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/redact"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const secret = "s3cr3t-value"
+
+var _ = Describe("Redaction", func() {
+	var (
+		sink   *lagertest.TestSink
+		logger lager.Logger
+		ctx    = context.Background()
+	)
+
+	BeforeEach(func() {
+		sink = lagertest.NewTestSink()
+		logger = lager.NewLogger("test")
+		logger.RegisterSink(redact.NewSink(sink, redact.New("apikey")))
+	})
+
+	It("Masks secret keys at any depth", func() {
+		logger.Info("nested", lager.Data{
+			"Password": secret,
+			"settings": map[string]interface{}{
+				"authentication_redis_pass": secret,
+				"users": []interface{}{
+					map[string]interface{}{"name": "admin", "access_token": secret},
+				},
+			},
+			"credentials": cluster.InstanceCredentials{UID: 1, Password: secret},
+			"apiKey":      secret,
+		})
+		Expect(sink.Buffer().Contents()).NotTo(ContainSubstring(secret))
+
+		data := sink.Logs()[0].Data
+		Expect(data["Password"]).To(Equal(redact.Mask))
+		Expect(data["credentials"]).To(HaveKeyWithValue("UID", BeEquivalentTo(1)))
+		Expect(data["settings"]).To(HaveKeyWithValue("authentication_redis_pass", redact.Mask))
+	})
+
+	It("Keeps the error message and the other data", func() {
+		logger.Error("failed", errors.New("boom"), lager.Data{"UID": 3})
+		log := sink.Logs()[0]
+		Expect(log.Message).To(Equal("test.failed"))
+		Expect(log.Data).To(HaveKeyWithValue("error", "boom"))
+		Expect(log.Data).To(HaveKeyWithValue("UID", BeEquivalentTo(3)))
+	})
+
+	Describe("No secret reaches a sink", func() {
+		var (
+			proxy testing.HTTPProxy
+			conf  brokerconfig.Config
+		)
+
+		BeforeEach(func() {
+			proxy = testing.NewHTTPProxy()
+			proxy.RegisterEndpointHandler("/v1/bdbs", func(w http.ResponseWriter, r *http.Request) interface{} {
+				w.WriteHeader(http.StatusBadRequest)
+				return map[string]interface{}{"description": "rejected"}
+			})
+			conf = brokerconfig.Config{
+				Cluster: brokerconfig.ClusterConfig{
+					Address: proxy.URL(),
+					Auth:    brokerconfig.AuthConfig{Username: "admin", Password: secret},
+				},
+			}
+		})
+
+		AfterEach(func() {
+			proxy.Close()
+		})
+
+		It("Masks the database password in the cluster requests", func() {
+			settings := apiclient.DatabaseSettings{Name: "db", Password: secret}
+			_, err := apiclient.New(conf, logger, nil).CreateDatabase(ctx, settings)
+			Expect(err).To(HaveOccurred())
+
+			client := httpclient.New("admin", secret, proxy.URL(), httpclient.DefaultRetryPolicy, httpclient.DefaultBreakerPolicy, logger)
+			client.Post(ctx, "/v1/bdbs", httpclient.HTTPPayload(`{"authentication_redis_pass":"`+secret+`"}`))
+
+			Expect(sink.Logs()).NotTo(BeEmpty())
+			Expect(sink.Buffer().Contents()).NotTo(ContainSubstring(secret))
+		})
+
+		It("Does not log the credentials of a binding", func() {
+			tmpStateDir, err := ioutil.TempDir("", "redislabs-state-test")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tmpStateDir)
+
+			persister := persisters.NewLocalPersister(path.Join(tmpStateDir, "state.json"))
+			Expect(persister.Save(&persisters.State{
+				AvailableInstances: []persisters.ServiceInstance{
+					{ID: "instance", Credentials: cluster.InstanceCredentials{UID: 1, Password: secret}},
+				},
+			})).To(Succeed())
+
+			_, err = instancebinders.NewDefault(conf, logger).Bind(ctx, "instance", "binding", persister)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sink.Logs()).NotTo(BeEmpty())
+			Expect(sink.Buffer().Contents()).NotTo(ContainSubstring(secret))
+		})
+	})
+})
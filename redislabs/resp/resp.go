@@ -0,0 +1,168 @@
+// Package resp is a minimal client of the Redis serialization protocol,
+// enough for the broker to keep its state in a Redis database.
+package resp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+type (
+	// Error is an error reply of the server.
+	Error string
+
+	// Conn is a connection to a Redis server. It is not safe for
+	// concurrent use.
+	Conn struct {
+		conn    net.Conn
+		reader  *bufio.Reader
+		writer  *bufio.Writer
+		timeout time.Duration
+	}
+
+	// Options tell how to reach the server.
+	Options struct {
+		Address  string
+		Password string
+		DB       int
+		TLS      bool
+		Timeout  time.Duration
+	}
+)
+
+var ErrProtocol = errors.New("invalid RESP reply")
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Dial connects to the server, authenticates and selects the database.
+func Dial(opts Options) (*Conn, error) {
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if opts.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", opts.Address, &tls.Config{})
+	} else {
+		conn, err = dialer.Dial("tcp", opts.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		writer:  bufio.NewWriter(conn),
+		timeout: opts.Timeout,
+	}
+	if opts.Password != "" {
+		if _, err = c.Do("AUTH", opts.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if opts.DB != 0 {
+		if _, err = c.Do("SELECT", strconv.Itoa(opts.DB)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Do sends the command and returns the reply: a string for simple and bulk
+// strings, an int64 for integers, nil for null replies and []interface{}
+// for arrays. An error reply is returned as Error.
+func (c *Conn) Do(args ...string) (interface{}, error) {
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	if err := WriteCommand(c.writer, args...); err != nil {
+		return nil, err
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	reply, err := ReadReply(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(Error); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// WriteCommand writes the command as an array of bulk strings.
+func WriteCommand(w io.Writer, args ...string) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadReply reads a single value, arrays are read with their elements.
+func ReadReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrProtocol
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return Error(rest), nil
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = ReadReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, ErrProtocol
+}
@@ -0,0 +1,284 @@
+package testing
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/resp"
+)
+
+type (
+	// RedisServer is an in-process stand-in for Redis speaking RESP. It
+	// knows the string commands and the transactions, enough for the
+	// broker state.
+	RedisServer struct {
+		listener net.Listener
+		password string
+
+		lock sync.Mutex
+		// data is per database, versions count the writes of a key so
+		// that a WATCH can tell whether it has been modified.
+		data     map[int]map[string]string
+		versions map[string]int
+		conns    map[net.Conn]bool
+		wg       sync.WaitGroup
+	}
+
+	redisSession struct {
+		db            int
+		authenticated bool
+		watched       map[string]int
+		queued        [][]string
+		inMulti       bool
+		dirty         bool
+	}
+)
+
+// NewRedisServer starts a server on a local port. A non-empty password
+// has to be given with AUTH. The server should be shutdown via Close.
+func NewRedisServer(password string) *RedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &RedisServer{
+		listener: listener,
+		password: password,
+		data:     map[int]map[string]string{},
+		versions: map[string]int{},
+		conns:    map[net.Conn]bool{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+func (s *RedisServer) Address() string {
+	return s.listener.Addr().String()
+}
+
+// Get returns the value of the key in the database.
+func (s *RedisServer) Get(db int, key string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	value, ok := s.data[db][key]
+	return value, ok
+}
+
+// Set writes the key the way another client would.
+func (s *RedisServer) Set(db int, key string, value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.set(db, key, value)
+}
+
+func (s *RedisServer) Close() {
+	s.listener.Close()
+	s.lock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+}
+
+func (s *RedisServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns[conn] = true
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *RedisServer) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	session := &redisSession{authenticated: s.password == ""}
+	for {
+		value, err := resp.ReadReply(reader)
+		if err != nil {
+			return
+		}
+		values, ok := value.([]interface{})
+		if !ok || len(values) == 0 {
+			writeReply(writer, resp.Error("ERR invalid command"))
+		} else {
+			args := make([]string, len(values))
+			for i, v := range values {
+				args[i], _ = v.(string)
+			}
+			writeReply(writer, s.command(session, args))
+		}
+		if err = writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// command runs a command of the session and returns the reply.
+func (s *RedisServer) command(session *redisSession, args []string) interface{} {
+	name := strings.ToUpper(args[0])
+	if name == "AUTH" {
+		if len(args) != 2 || args[1] != s.password {
+			return resp.Error("WRONGPASS invalid password")
+		}
+		session.authenticated = true
+		return "OK"
+	}
+	if !session.authenticated {
+		return resp.Error("NOAUTH Authentication required.")
+	}
+
+	if session.inMulti {
+		switch name {
+		case "EXEC":
+			return s.exec(session)
+		case "DISCARD":
+			session.inMulti, session.queued, session.watched = false, nil, nil
+			return "OK"
+		case "WATCH", "MULTI":
+			session.dirty = true
+			return resp.Error("ERR " + name + " inside MULTI is not allowed")
+		}
+		session.queued = append(session.queued, args)
+		return "QUEUED"
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch name {
+	case "PING":
+		return "PONG"
+	case "SELECT":
+		var db int
+		if len(args) != 2 {
+			return resp.Error("ERR wrong number of arguments")
+		}
+		if _, err := fmt.Sscanf(args[1], "%d", &db); err != nil {
+			return resp.Error("ERR invalid DB index")
+		}
+		session.db = db
+		return "OK"
+	case "WATCH":
+		if session.watched == nil {
+			session.watched = map[string]int{}
+		}
+		for _, key := range args[1:] {
+			session.watched[s.versionKey(session.db, key)] = s.versions[s.versionKey(session.db, key)]
+		}
+		return "OK"
+	case "UNWATCH":
+		session.watched = nil
+		return "OK"
+	case "MULTI":
+		session.inMulti, session.queued, session.dirty = true, nil, false
+		return "OK"
+	case "EXEC", "DISCARD":
+		return resp.Error("ERR " + name + " without MULTI")
+	}
+	return s.run(session.db, args)
+}
+
+// exec runs the queued commands unless a watched key has been modified.
+func (s *RedisServer) exec(session *redisSession) interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	queued, watched, dirty := session.queued, session.watched, session.dirty
+	session.inMulti, session.queued, session.watched = false, nil, nil
+	if dirty {
+		return resp.Error("EXECABORT Transaction discarded because of previous errors.")
+	}
+	for key, version := range watched {
+		if s.versions[key] != version {
+			return nil
+		}
+	}
+	replies := []interface{}{}
+	for _, args := range queued {
+		replies = append(replies, s.run(session.db, args))
+	}
+	return replies
+}
+
+// run executes a data command, the lock is held.
+func (s *RedisServer) run(db int, args []string) interface{} {
+	name := strings.ToUpper(args[0])
+	switch {
+	case name == "GET" && len(args) == 2:
+		value, ok := s.data[db][args[1]]
+		if !ok {
+			return nil
+		}
+		return value
+	case name == "SET" && len(args) == 3:
+		s.set(db, args[1], args[2])
+		return "OK"
+	case name == "DEL" && len(args) > 1:
+		deleted := int64(0)
+		for _, key := range args[1:] {
+			if _, ok := s.data[db][key]; ok {
+				delete(s.data[db], key)
+				s.versions[s.versionKey(db, key)]++
+				deleted++
+			}
+		}
+		return deleted
+	case name == "GET" || name == "SET" || name == "DEL":
+		return resp.Error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+	}
+	return resp.Error("ERR unknown command '" + args[0] + "'")
+}
+
+func (s *RedisServer) set(db int, key string, value string) {
+	if s.data[db] == nil {
+		s.data[db] = map[string]string{}
+	}
+	s.data[db][key] = value
+	s.versions[s.versionKey(db, key)]++
+}
+
+func (s *RedisServer) versionKey(db int, key string) string {
+	return fmt.Sprintf("%d:%s", db, key)
+}
+
+func writeReply(w io.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		io.WriteString(w, "$-1\r\n")
+	case resp.Error:
+		fmt.Fprintf(w, "-%s\r\n", string(v))
+	case string:
+		if v == "OK" || v == "QUEUED" || v == "PONG" {
+			fmt.Fprintf(w, "+%s\r\n", v)
+		} else {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+		}
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, value := range v {
+			writeReply(w, value)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// Output formats of a report.
+const (
+	FormatJSON  = "json"
+	FormatTable = "table"
+)
+
+// Write writes the report in the given format.
+func Write(w io.Writer, report Report, format string) error {
+	switch format {
+	case FormatJSON:
+		return WriteJSON(w, report)
+	case FormatTable:
+		return WriteTable(w, report)
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+func WriteJSON(w io.Writer, report Report) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// WriteTable writes the report as a table meant for humans, memory
+// is shown in megabytes.
+func WriteTable(w io.Writer, report Report) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	writeGroups(tw, "PLAN", report.Plans)
+	fmt.Fprintln(tw)
+	writeGroups(tw, "ORGANIZATION", report.Organizations)
+	fmt.Fprintln(tw)
+
+	c := report.Cluster
+	fmt.Fprintln(tw, "CLUSTER\tTOTAL MB\tAVAILABLE MB\tAVAILABLE SHARDS\tHEADROOM")
+	fmt.Fprintf(tw, "\t%s\t%s\t%d\t%d%%\n", megabytes(c.TotalMemory), megabytes(c.AvailableMemory), c.AvailableShards, c.Headroom)
+
+	if len(report.Missing) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "INSTANCES MISSING IN THE CLUSTER")
+		for _, id := range report.Missing {
+			fmt.Fprintln(tw, id)
+		}
+	}
+	return tw.Flush()
+}
+
+func writeGroups(w io.Writer, title string, groups []Group) {
+	fmt.Fprintf(w, "%s\tINSTANCES\tALLOCATED MB\tUSED MB\tSHARDS\n", title)
+	for _, g := range groups {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\n", g.Name, g.Instances, megabytes(g.AllocatedMemory), megabytes(g.UsedMemory), g.Shards)
+	}
+}
+
+func megabytes(bytes int64) string {
+	return fmt.Sprintf("%.1f", float64(bytes)/(1<<20))
+}
@@ -0,0 +1,56 @@
+package usage
+
+import (
+	"bytes"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+)
+
+type handler struct {
+	reporter *Reporter
+	logger   lager.Logger
+}
+
+// NewHandler serves the usage report. The format is chosen by the format
+// query parameter, JSON unless told otherwise. Authentication is left
+// to the caller.
+func NewHandler(reporter *Reporter, logger lager.Logger) http.Handler {
+	return &handler{
+		reporter: reporter,
+		logger:   logger,
+	}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = FormatJSON
+	}
+	if format != FormatJSON && format != FormatTable {
+		http.Error(w, "unknown format "+format, http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.reporter.Report(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err = Write(&buf, report, format); err != nil {
+		h.logger.Error("Failed to write the usage report", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if format == FormatJSON {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Write(buf.Bytes())
+}
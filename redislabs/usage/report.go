@@ -0,0 +1,162 @@
+package usage
+
+import (
+	"context"
+	"sort"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/capacity"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+)
+
+type (
+	// Group sums up the databases of the instances sharing a plan
+	// or an organization. Memory is measured in bytes.
+	Group struct {
+		Name      string `json:"name"`
+		Instances int    `json:"instances"`
+		// AllocatedMemory includes the memory of the replicas.
+		AllocatedMemory int64 `json:"allocated_memory"`
+		UsedMemory      int64 `json:"used_memory"`
+		// Shards includes the replica shards.
+		Shards int `json:"shards"`
+	}
+
+	// ClusterUsage describes what is left in the cluster. Memory is
+	// measured in bytes.
+	ClusterUsage struct {
+		TotalMemory int64 `json:"total_memory"`
+		// AvailableMemory excludes the headroom.
+		AvailableMemory int64 `json:"available_memory"`
+		AvailableShards int   `json:"available_shards"`
+		Headroom        int   `json:"headroom"` // percent
+	}
+
+	// Report is the cluster usage of the databases the broker manages.
+	Report struct {
+		Plans         []Group      `json:"plans"`
+		Organizations []Group      `json:"organizations"`
+		Cluster       ClusterUsage `json:"cluster"`
+		// Missing lists the instances whose databases the cluster
+		// does not know.
+		Missing []string `json:"missing,omitempty"`
+	}
+
+	// Reporter aggregates the instances in the broker state with
+	// the live cluster stats.
+	Reporter struct {
+		api       apiclient.Client
+		persister persisters.StatePersister
+		conf      config.Config
+		logger    lager.Logger
+	}
+)
+
+// Name of the group of instances whose plan or organization is not known.
+const unknownGroup = "unknown"
+
+func NewReporter(api apiclient.Client, persister persisters.StatePersister, conf config.Config, logger lager.Logger) *Reporter {
+	return &Reporter{
+		api:       api,
+		persister: persister,
+		conf:      conf,
+		logger:    logger,
+	}
+}
+
+// Report collects the usage of the instances in the broker state.
+func (r *Reporter) Report(ctx context.Context) (Report, error) {
+	state, err := r.persister.Load()
+	if err != nil {
+		r.logger.Error("Failed to load the broker state", err)
+		return Report{}, err
+	}
+	databases, err := r.api.ListDatabases(ctx)
+	if err != nil {
+		r.logger.Error("Failed to list the databases", err)
+		return Report{}, err
+	}
+	stats, err := r.api.GetDatabasesStats(ctx)
+	if err != nil {
+		r.logger.Error("Failed to get the database stats", err)
+		return Report{}, err
+	}
+	headroom := r.conf.Cluster.Capacity.Headroom
+	available, err := capacity.NewChecker(r.api, headroom, r.logger).Available(ctx)
+	if err != nil {
+		r.logger.Error("Failed to determine the cluster capacity", err)
+		return Report{}, err
+	}
+
+	databasesByUID := map[int]apiclient.Database{}
+	for _, database := range databases {
+		databasesByUID[database.UID] = database
+	}
+	planNames := map[string]string{}
+	for _, plan := range r.conf.ServiceBroker.Plans {
+		planNames[plan.ID] = plan.Name
+	}
+
+	report := Report{
+		Cluster: ClusterUsage{
+			TotalMemory:     available.TotalMemory,
+			AvailableMemory: available.Memory,
+			AvailableShards: available.Shards,
+			Headroom:        headroom,
+		},
+	}
+	plans := map[string]*Group{}
+	orgs := map[string]*Group{}
+	for _, instance := range state.AvailableInstances {
+		database, ok := databasesByUID[instance.Credentials.UID]
+		if !ok {
+			report.Missing = append(report.Missing, instance.ID)
+			continue
+		}
+		required := capacity.RequirementOfDatabase(database)
+		used := int64(stats[database.UID].UsedMemory)
+
+		plan := planNames[instance.PlanID]
+		if plan == "" {
+			plan = instance.PlanID
+		}
+		for _, g := range []*Group{group(plans, plan), group(orgs, instance.OrganizationGUID)} {
+			g.Instances++
+			g.AllocatedMemory += required.Memory
+			g.UsedMemory += used
+			g.Shards += required.Shards
+		}
+	}
+	report.Plans = sorted(plans)
+	report.Organizations = sorted(orgs)
+	return report, nil
+}
+
+func group(groups map[string]*Group, name string) *Group {
+	if name == "" {
+		name = unknownGroup
+	}
+	g, ok := groups[name]
+	if !ok {
+		g = &Group{Name: name}
+		groups[name] = g
+	}
+	return g
+}
+
+func sorted(groups map[string]*Group) []Group {
+	list := []Group{}
+	for _, g := range groups {
+		list = append(list, *g)
+	}
+	sort.Sort(byName(list))
+	return list
+}
+
+type byName []Group
+
+func (g byName) Len() int           { return len(g) }
+func (g byName) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+func (g byName) Less(i, j int) bool { return g[i].Name < g[j].Name }
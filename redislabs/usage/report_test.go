@@ -0,0 +1,157 @@
+package usage_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/apiclient/fakes"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/cluster"
+	brokerconfig "github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/persisters"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/usage"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Usage report", func() {
+	var (
+		api         *fakes.FakeClient
+		persister   persisters.StatePersister
+		tmpStateDir string
+		conf        brokerconfig.Config
+		ctx         = context.Background()
+		logger      = lager.NewLogger("test")
+	)
+
+	reporter := func() *usage.Reporter {
+		return usage.NewReporter(api, persister, conf, logger)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmpStateDir, err = ioutil.TempDir("", "redislabs-state-test")
+		Expect(err).NotTo(HaveOccurred())
+		persister = persisters.NewLocalPersister(path.Join(tmpStateDir, "state.json"))
+
+		instance := func(id string, UID int, plan string, org string) persisters.ServiceInstance {
+			return persisters.ServiceInstance{
+				ID:          id,
+				Credentials: cluster.InstanceCredentials{UID: UID},
+				InstanceDetails: persisters.InstanceDetails{
+					PlanID:           plan,
+					OrganizationGUID: org,
+				},
+			}
+		}
+		err = persister.Save(&persisters.State{
+			AvailableInstances: []persisters.ServiceInstance{
+				instance("a", 1, "small-id", "org-1"),
+				instance("b", 2, "large-id", "org-1"),
+				instance("c", 3, "small-id", "org-2"),
+				instance("d", 4, "small-id", "org-2"),
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		api = &fakes.FakeClient{
+			Databases: map[int]apiclient.Database{
+				1: {UID: 1, MemorySize: 100, ShardsCount: 1},
+				2: {UID: 2, MemorySize: 400, ShardsCount: 2, Replication: true},
+				3: {UID: 3, MemorySize: 100, ShardsCount: 1},
+			},
+			DatabasesStats: map[int]apiclient.DatabaseStats{
+				1: {UsedMemory: 10},
+				2: {UsedMemory: 40},
+				3: {UsedMemory: 30},
+			},
+			Nodes: []apiclient.Node{
+				{UID: 1, TotalMemory: 1000, ShardCount: 3, MaxRedisServers: 10},
+				{UID: 2, TotalMemory: 1000, ShardCount: 3, MaxRedisServers: 10},
+			},
+			NodesStats: map[int]apiclient.NodeStats{
+				1: {ProvisionalMemory: 600},
+				2: {ProvisionalMemory: 500},
+			},
+		}
+		conf = brokerconfig.Config{
+			Cluster: brokerconfig.ClusterConfig{
+				Capacity: brokerconfig.CapacityConfig{Headroom: 10},
+			},
+			ServiceBroker: brokerconfig.ServiceBrokerConfig{
+				Plans: []brokerconfig.ServicePlanConfig{
+					{ID: "small-id", Name: "small"},
+					{ID: "large-id", Name: "large"},
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpStateDir)
+	})
+
+	It("Aggregates the instances per plan and per organization", func() {
+		report, err := reporter().Report(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Plans).To(Equal([]usage.Group{
+			{Name: "large", Instances: 1, AllocatedMemory: 800, UsedMemory: 40, Shards: 4},
+			{Name: "small", Instances: 2, AllocatedMemory: 200, UsedMemory: 40, Shards: 2},
+		}))
+		Expect(report.Organizations).To(Equal([]usage.Group{
+			{Name: "org-1", Instances: 2, AllocatedMemory: 900, UsedMemory: 50, Shards: 5},
+			{Name: "org-2", Instances: 1, AllocatedMemory: 100, UsedMemory: 30, Shards: 1},
+		}))
+	})
+
+	It("Reports the cluster headroom and the instances missing in the cluster", func() {
+		report, err := reporter().Report(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Cluster).To(Equal(usage.ClusterUsage{
+			TotalMemory:     2000,
+			AvailableMemory: 900,
+			AvailableShards: 14,
+			Headroom:        10,
+		}))
+		Expect(report.Missing).To(Equal([]string{"d"}))
+	})
+
+	Describe("Serving the report", func() {
+		request := func(url string) *http.Request {
+			req, err := http.NewRequest("GET", url, nil)
+			Expect(err).NotTo(HaveOccurred())
+			return req
+		}
+
+		It("Responds with JSON by default", func() {
+			rec := httptest.NewRecorder()
+			usage.NewHandler(reporter(), logger).ServeHTTP(rec, request("/admin/usage"))
+			Expect(rec.Code).To(Equal(http.StatusOK))
+
+			report := usage.Report{}
+			Expect(json.Unmarshal(rec.Body.Bytes(), &report)).To(Succeed())
+			Expect(report.Plans).To(HaveLen(2))
+		})
+
+		It("Responds with a table when asked", func() {
+			rec := httptest.NewRecorder()
+			usage.NewHandler(reporter(), logger).ServeHTTP(rec, request("/admin/usage?format=table"))
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(MatchRegexp(`small\s+2\s+0\.0\s+0\.0\s+2`))
+			Expect(rec.Body.String()).To(ContainSubstring("INSTANCES MISSING IN THE CLUSTER"))
+		})
+
+		It("Rejects an unknown format", func() {
+			rec := httptest.NewRecorder()
+			usage.NewHandler(reporter(), logger).ServeHTTP(rec, request("/admin/usage?format=xml"))
+			Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+})
@@ -0,0 +1,98 @@
+package webhooks
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+type notifyingBroker struct {
+	brokerapi.ServiceBroker
+	dispatcher *Dispatcher
+	logger     lager.Logger
+}
+
+// NewBroker publishes an event for every lifecycle operation of the given
+// broker, or an operation.failed event if the operation fails. Deleting an
+// instance or a binding that is already gone publishes nothing, its
+// deletion has been published before.
+func NewBroker(broker brokerapi.ServiceBroker, dispatcher *Dispatcher, logger lager.Logger) brokerapi.ServiceBroker {
+	return &notifyingBroker{
+		ServiceBroker: broker,
+		dispatcher:    dispatcher,
+		logger:        logger,
+	}
+}
+
+func (b *notifyingBroker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	spec, err := b.ServiceBroker.Provision(ctx, instanceID, details, asyncAllowed)
+	event := NewEvent(InstanceCreated, instanceID)
+	event.PlanID = details.PlanID
+	event.OrganizationGUID = details.OrganizationGUID
+	event.SpaceGUID = details.SpaceGUID
+	b.publish(event, "provision", err)
+	return spec, err
+}
+
+func (b *notifyingBroker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	spec, err := b.ServiceBroker.Update(ctx, instanceID, details, asyncAllowed)
+	event := NewEvent(InstanceUpdated, instanceID)
+	event.PlanID = details.PlanID
+	if event.PlanID == "" {
+		event.PlanID = details.PreviousValues.PlanID
+	}
+	event.OrganizationGUID = details.PreviousValues.OrgID
+	event.SpaceGUID = details.PreviousValues.SpaceID
+	b.publish(event, "update", err)
+	return spec, err
+}
+
+func (b *notifyingBroker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	spec, err := b.ServiceBroker.Deprovision(ctx, instanceID, details, asyncAllowed)
+	if err == brokerapi.ErrInstanceDoesNotExist {
+		return spec, err
+	}
+	event := NewEvent(InstanceDeleted, instanceID)
+	event.PlanID = details.PlanID
+	b.publish(event, "deprovision", err)
+	return spec, err
+}
+
+func (b *notifyingBroker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails, asyncAllowed bool) (brokerapi.Binding, error) {
+	binding, err := b.ServiceBroker.Bind(ctx, instanceID, bindingID, details, asyncAllowed)
+	event := NewEvent(BindingCreated, instanceID)
+	event.BindingID = bindingID
+	event.PlanID = details.PlanID
+	b.publish(event, "bind", err)
+	return binding, err
+}
+
+func (b *notifyingBroker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails, asyncAllowed bool) (brokerapi.UnbindSpec, error) {
+	spec, err := b.ServiceBroker.Unbind(ctx, instanceID, bindingID, details, asyncAllowed)
+	if err == brokerapi.ErrBindingDoesNotExist {
+		return spec, err
+	}
+	event := NewEvent(BindingDeleted, instanceID)
+	event.BindingID = bindingID
+	event.PlanID = details.PlanID
+	b.publish(event, "unbind", err)
+	return spec, err
+}
+
+// publish turns the event into an operation.failed one if the operation
+// failed. A failure to queue it is logged but does not fail the
+// operation, which has already happened.
+func (b *notifyingBroker) publish(event Event, operation string, err error) {
+	if err != nil {
+		event.Type = OperationFailed
+		event.Operation = operation
+		event.Error = err.Error()
+	}
+	if err := b.dispatcher.Publish(event); err != nil {
+		b.logger.Error("Failed to queue a webhook event", err, lager.Data{
+			"event":       event.Type,
+			"instance-id": event.InstanceID,
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+)
+
+// Headers of a webhook request.
+const (
+	SignatureHeader = "X-Broker-Signature"
+	EventHeader     = "X-Broker-Event"
+	DeliveryHeader  = "X-Broker-Delivery"
+)
+
+var (
+	// RequestTimeout bounds a single delivery attempt.
+	RequestTimeout = 10 * time.Second
+	// A failed delivery is retried after InitialBackoff, doubling up
+	// to MaxBackoff, until it is older than MaxAge.
+	InitialBackoff = 10 * time.Second
+	MaxBackoff     = 10 * time.Minute
+	MaxAge         = 72 * time.Hour
+)
+
+// Dispatcher queues the events for the webhooks subscribed to them and
+// delivers them in the background.
+type Dispatcher struct {
+	hooks  []config.WebhookConfig
+	queue  *Queue
+	client *http.Client
+	logger lager.Logger
+	// workers holds a worker per webhook URL, so that a slow or failing
+	// webhook does not hold up the deliveries to the others.
+	workers map[string]*worker
+}
+
+// worker delivers the events of a single webhook in their order.
+type worker struct {
+	hook config.WebhookConfig
+	wake chan struct{}
+	// sending serializes the delivery rounds.
+	sending sync.Mutex
+}
+
+func NewDispatcher(hooks []config.WebhookConfig, queue *Queue, logger lager.Logger) *Dispatcher {
+	workers := map[string]*worker{}
+	for _, hook := range hooks {
+		if _, ok := workers[hook.URL]; ok {
+			continue
+		}
+		workers[hook.URL] = &worker{
+			hook: hook,
+			wake: make(chan struct{}, 1),
+		}
+	}
+	return &Dispatcher{
+		hooks:   hooks,
+		queue:   queue,
+		client:  &http.Client{Timeout: RequestTimeout},
+		logger:  logger,
+		workers: workers,
+	}
+}
+
+// Sign returns the signature of the body, the hex encoded HMAC-SHA256
+// with the shared secret prefixed with "sha256=".
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Publish queues the event for every webhook subscribed to it.
+func (d *Dispatcher) Publish(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	deliveries := []Delivery{}
+	for _, hook := range d.hooks {
+		if !subscribed(hook, event.Type) {
+			continue
+		}
+		deliveries = append(deliveries, Delivery{
+			ID:          newID(),
+			URL:         hook.URL,
+			EventType:   event.Type,
+			Body:        body,
+			Created:     event.Time,
+			NextAttempt: event.Time,
+		})
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	if err = d.queue.Push(deliveries...); err != nil {
+		return err
+	}
+	for _, delivery := range deliveries {
+		select {
+		case d.workers[delivery.URL].wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Run delivers the queued events until the context is done, every
+// webhook from a goroutine of its own.
+func (d *Dispatcher) Run(ctx context.Context) {
+	d.dropUnknown()
+	var wg sync.WaitGroup
+	for _, w := range d.workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			d.run(ctx, w)
+		}(w)
+	}
+	wg.Wait()
+}
+
+func (d *Dispatcher) run(ctx context.Context, w *worker) {
+	for {
+		d.deliver(ctx, w, time.Now())
+
+		wait := MaxBackoff
+		next, ok, err := d.queue.NextFor(w.hook.URL)
+		if err != nil {
+			d.logger.Error("Failed to load the webhook queue", err)
+		} else if ok {
+			wait = next.Sub(time.Now())
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-w.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Deliver attempts the deliveries due at the given time, to every
+// webhook at once. Successful ones and the ones given up on are removed
+// from the queue, the rest are scheduled for another attempt.
+func (d *Dispatcher) Deliver(ctx context.Context, now time.Time) {
+	d.dropUnknown()
+	var wg sync.WaitGroup
+	for _, w := range d.workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			d.deliver(ctx, w, now)
+		}(w)
+	}
+	wg.Wait()
+}
+
+// deliver attempts the deliveries to the webhook of the worker due at
+// the given time.
+func (d *Dispatcher) deliver(ctx context.Context, w *worker, now time.Time) {
+	w.sending.Lock()
+	defer w.sending.Unlock()
+
+	due, err := d.queue.DueFor(w.hook.URL, now)
+	if err != nil {
+		d.logger.Error("Failed to load the webhook queue", err)
+		return
+	}
+	for _, delivery := range due {
+		err := d.send(ctx, w.hook, delivery)
+		if err == nil {
+			d.remove(delivery)
+			continue
+		}
+		delivery.Attempts++
+		d.logger.Error("Failed to deliver a webhook event", err, lager.Data{
+			"event":    delivery.EventType,
+			"url":      delivery.URL,
+			"attempts": delivery.Attempts,
+		})
+		if now.Sub(delivery.Created) >= MaxAge {
+			d.logger.Error("Giving up on a webhook event", err, lager.Data{
+				"event": delivery.EventType,
+				"url":   delivery.URL,
+			})
+			d.remove(delivery)
+			continue
+		}
+		delivery.NextAttempt = now.Add(backoff(delivery.Attempts))
+		if err := d.queue.Update(delivery); err != nil {
+			d.logger.Error("Failed to save the webhook queue", err)
+		}
+	}
+}
+
+// dropUnknown removes the deliveries to the webhooks no longer configured,
+// no worker would ever send them.
+func (d *Dispatcher) dropUnknown() {
+	queued, err := d.queue.All()
+	if err != nil {
+		d.logger.Error("Failed to load the webhook queue", err)
+		return
+	}
+	for _, delivery := range queued {
+		if _, ok := d.workers[delivery.URL]; ok {
+			continue
+		}
+		d.logger.Info("Dropping an event for a webhook no longer configured", lager.Data{
+			"event": delivery.EventType,
+			"url":   delivery.URL,
+		})
+		d.remove(delivery)
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, hook config.WebhookConfig, delivery Delivery) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, delivery.Body))
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("the webhook responded with %s", res.Status)
+	}
+	return nil
+}
+
+func (d *Dispatcher) remove(delivery Delivery) {
+	if err := d.queue.Remove(delivery.ID); err != nil {
+		d.logger.Error("Failed to save the webhook queue", err)
+	}
+}
+
+func subscribed(hook config.WebhookConfig, eventType string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func backoff(attempts int) time.Duration {
+	wait := InitialBackoff
+	for i := 1; i < attempts && wait < MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > MaxBackoff {
+		wait = MaxBackoff
+	}
+	return wait
+}
@@ -0,0 +1,48 @@
+package webhooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Event types a webhook can subscribe to.
+const (
+	InstanceCreated = "instance.created"
+	InstanceUpdated = "instance.updated"
+	InstanceDeleted = "instance.deleted"
+	BindingCreated  = "binding.created"
+	BindingDeleted  = "binding.deleted"
+	OperationFailed = "operation.failed"
+)
+
+// Event is the JSON body sent to the webhooks.
+type Event struct {
+	ID               string    `json:"id"`
+	Type             string    `json:"type"`
+	Time             time.Time `json:"time"`
+	InstanceID       string    `json:"instance_id"`
+	BindingID        string    `json:"binding_id,omitempty"`
+	PlanID           string    `json:"plan_id,omitempty"`
+	OrganizationGUID string    `json:"organization_guid,omitempty"`
+	SpaceGUID        string    `json:"space_guid,omitempty"`
+	// Operation and Error are set for failed operations.
+	Operation string `json:"operation,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// NewEvent returns an event of the given type with a unique ID.
+func NewEvent(eventType string, instanceID string) Event {
+	return Event{
+		ID:         newID(),
+		Type:       eventType,
+		Time:       time.Now().UTC(),
+		InstanceID: instanceID,
+	}
+}
+
+func newID() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
@@ -0,0 +1,175 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/files"
+)
+
+type (
+	// Delivery is an event waiting to be sent to a webhook.
+	Delivery struct {
+		ID          string          `json:"id"`
+		URL         string          `json:"url"`
+		EventType   string          `json:"event_type"`
+		Body        json.RawMessage `json:"body"`
+		Created     time.Time       `json:"created"`
+		Attempts    int             `json:"attempts"`
+		NextAttempt time.Time       `json:"next_attempt"`
+	}
+
+	// Queue keeps the pending deliveries in a JSON file so that they
+	// survive a restart of the broker. Every change is made to the file
+	// under its lock, so broker processes may share the queue.
+	Queue struct {
+		path string
+		lock sync.Mutex
+	}
+)
+
+// OpenQueue returns the queue kept in the file at the given path after
+// making sure the file can be loaded. A missing file is an empty queue.
+func OpenQueue(path string) (*Queue, error) {
+	q := &Queue{path: path}
+	if _, err := q.Len(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queue) Push(deliveries ...Delivery) error {
+	return q.update(func(queued []Delivery) []Delivery {
+		return append(queued, deliveries...)
+	})
+}
+
+// All returns every queued delivery.
+func (q *Queue) All() ([]Delivery, error) {
+	return q.read()
+}
+
+// Due returns the deliveries to attempt at the given time.
+func (q *Queue) Due(now time.Time) ([]Delivery, error) {
+	return q.due(now, func(Delivery) bool { return true })
+}
+
+// DueFor returns the deliveries to the webhook at the given URL to
+// attempt at the given time.
+func (q *Queue) DueFor(url string, now time.Time) ([]Delivery, error) {
+	return q.due(now, func(d Delivery) bool { return d.URL == url })
+}
+
+func (q *Queue) due(now time.Time, match func(Delivery) bool) ([]Delivery, error) {
+	queued, err := q.read()
+	if err != nil {
+		return nil, err
+	}
+	due := []Delivery{}
+	for _, d := range queued {
+		if match(d) && !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	return due, nil
+}
+
+// NextFor returns the time of the earliest attempt to deliver to the
+// webhook at the given URL, false if none is queued.
+func (q *Queue) NextFor(url string) (time.Time, bool, error) {
+	queued, err := q.read()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	var next time.Time
+	found := false
+	for _, d := range queued {
+		if d.URL != url {
+			continue
+		}
+		if !found || d.NextAttempt.Before(next) {
+			next = d.NextAttempt
+		}
+		found = true
+	}
+	return next, found, nil
+}
+
+// Update replaces the delivery with the same ID.
+func (q *Queue) Update(delivery Delivery) error {
+	return q.update(func(queued []Delivery) []Delivery {
+		for i, d := range queued {
+			if d.ID == delivery.ID {
+				queued[i] = delivery
+			}
+		}
+		return queued
+	})
+}
+
+func (q *Queue) Remove(ID string) error {
+	return q.update(func(queued []Delivery) []Delivery {
+		left := []Delivery{}
+		for _, d := range queued {
+			if d.ID != ID {
+				left = append(left, d)
+			}
+		}
+		return left
+	})
+}
+
+func (q *Queue) Len() (int, error) {
+	queued, err := q.read()
+	return len(queued), err
+}
+
+// read loads the deliveries holding the shared lock of the file.
+func (q *Queue) read() ([]Delivery, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var queued []Delivery
+	err := files.WithLock(q.path, files.Shared, func() (err error) {
+		queued, err = q.load()
+		return err
+	})
+	return queued, err
+}
+
+// update applies the change to the deliveries in the file and replaces
+// it at once, so that a crash does not lose the deliveries saved before.
+func (q *Queue) update(change func([]Delivery) []Delivery) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return files.WithLock(q.path, files.Exclusive, func() error {
+		queued, err := q.load()
+		if err != nil {
+			return err
+		}
+		bytes, err := json.Marshal(change(queued))
+		if err != nil {
+			return err
+		}
+		return files.WriteAtomically(q.path, bytes)
+	})
+}
+
+func (q *Queue) load() ([]Delivery, error) {
+	queued := []Delivery{}
+	bytes, err := ioutil.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return queued, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(bytes, &queued); err != nil {
+		return nil, err
+	}
+	return queued, nil
+}
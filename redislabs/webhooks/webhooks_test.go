@@ -0,0 +1,253 @@
+package webhooks_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/config"
+	"github.com/RedisLabs/cf-redislabs-broker/redislabs/webhooks"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type received struct {
+	signature string
+	event     string
+	body      []byte
+}
+
+var _ = Describe("Webhooks", func() {
+	var (
+		tmpDir    string
+		queuePath string
+		server    *httptest.Server
+		lock      sync.Mutex
+		requests  []received
+		status    int
+		hooks     []config.WebhookConfig
+		logger    lager.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "redislabs-webhooks-test")
+		Expect(err).NotTo(HaveOccurred())
+		queuePath = path.Join(tmpDir, "webhooks.json")
+		requests = []received{}
+		status = http.StatusOK
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			lock.Lock()
+			defer lock.Unlock()
+			requests = append(requests, received{
+				signature: r.Header.Get(webhooks.SignatureHeader),
+				event:     r.Header.Get(webhooks.EventHeader),
+				body:      body,
+			})
+			w.WriteHeader(status)
+		}))
+		hooks = []config.WebhookConfig{{URL: server.URL, Secret: "shared-secret"}}
+		logger = lager.NewLogger("test")
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	newDispatcher := func() *webhooks.Dispatcher {
+		queue, err := webhooks.OpenQueue(queuePath)
+		Expect(err).NotTo(HaveOccurred())
+		return webhooks.NewDispatcher(hooks, queue, logger)
+	}
+
+	It("Signs the body with the shared secret", func() {
+		dispatcher := newDispatcher()
+		event := webhooks.NewEvent(webhooks.InstanceCreated, "instance-1")
+		Expect(dispatcher.Publish(event)).To(Succeed())
+		dispatcher.Deliver(context.Background(), time.Now())
+
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].event).To(Equal(webhooks.InstanceCreated))
+		Expect(requests[0].signature).To(Equal(webhooks.Sign("shared-secret", requests[0].body)))
+		Expect(requests[0].signature).NotTo(Equal(webhooks.Sign("another-secret", requests[0].body)))
+
+		var delivered webhooks.Event
+		Expect(json.Unmarshal(requests[0].body, &delivered)).To(Succeed())
+		Expect(delivered.ID).To(Equal(event.ID))
+		Expect(delivered.InstanceID).To(Equal("instance-1"))
+	})
+
+	It("Only delivers the events a webhook subscribed to", func() {
+		hooks[0].Events = []string{webhooks.InstanceDeleted}
+		dispatcher := newDispatcher()
+		Expect(dispatcher.Publish(webhooks.NewEvent(webhooks.InstanceCreated, "instance-1"))).To(Succeed())
+		Expect(dispatcher.Publish(webhooks.NewEvent(webhooks.InstanceDeleted, "instance-1"))).To(Succeed())
+		dispatcher.Deliver(context.Background(), time.Now())
+
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].event).To(Equal(webhooks.InstanceDeleted))
+	})
+
+	It("Keeps failed deliveries across restarts and retries them later", func() {
+		status = http.StatusServiceUnavailable
+		dispatcher := newDispatcher()
+		Expect(dispatcher.Publish(webhooks.NewEvent(webhooks.InstanceCreated, "instance-1"))).To(Succeed())
+		now := time.Now()
+		dispatcher.Deliver(context.Background(), now)
+		Expect(requests).To(HaveLen(1))
+
+		status = http.StatusOK
+		restarted := newDispatcher()
+		restarted.Deliver(context.Background(), now)
+		Expect(requests).To(HaveLen(1)) // backing off
+
+		restarted.Deliver(context.Background(), now.Add(webhooks.InitialBackoff))
+		Expect(requests).To(HaveLen(2))
+
+		queue, err := webhooks.OpenQueue(queuePath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(queue.Len()).To(Equal(0))
+	})
+
+	It("Delivers to every webhook independently of the others", func() {
+		release := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer slow.Close()
+		defer close(release)
+		hooks = append([]config.WebhookConfig{{URL: slow.URL, Secret: "shared-secret"}}, hooks...)
+		dispatcher := newDispatcher()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go dispatcher.Run(ctx)
+
+		Expect(dispatcher.Publish(webhooks.NewEvent(webhooks.InstanceCreated, "instance-1"))).To(Succeed())
+		Expect(dispatcher.Publish(webhooks.NewEvent(webhooks.InstanceDeleted, "instance-1"))).To(Succeed())
+		Eventually(func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(requests)
+		}).Should(Equal(2))
+	})
+
+	It("Gives up on deliveries older than the maximum age", func() {
+		status = http.StatusInternalServerError
+		dispatcher := newDispatcher()
+		Expect(dispatcher.Publish(webhooks.NewEvent(webhooks.InstanceCreated, "instance-1"))).To(Succeed())
+		dispatcher.Deliver(context.Background(), time.Now().Add(webhooks.MaxAge))
+
+		queue, err := webhooks.OpenQueue(queuePath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(queue.Len()).To(Equal(0))
+	})
+
+	It("Shares the queue with the broker processes using the same file", func() {
+		first, err := webhooks.OpenQueue(queuePath)
+		Expect(err).NotTo(HaveOccurred())
+		second, err := webhooks.OpenQueue(queuePath)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(first.Push(webhooks.Delivery{ID: "delivery-1"})).To(Succeed())
+		Expect(second.Push(webhooks.Delivery{ID: "delivery-2"})).To(Succeed())
+		Expect(first.Remove("delivery-2")).To(Succeed())
+
+		due, err := second.Due(time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(due).To(HaveLen(1))
+		Expect(due[0].ID).To(Equal("delivery-1"))
+	})
+
+	It("Refuses to open an unreadable queue", func() {
+		Expect(ioutil.WriteFile(queuePath, []byte("["), 0600)).To(Succeed())
+		_, err := webhooks.OpenQueue(queuePath)
+		Expect(err).To(HaveOccurred())
+	})
+
+	Describe("Notifying of the broker operations", func() {
+		var (
+			dispatcher *webhooks.Dispatcher
+			broker     *fakes.FakeServiceBroker
+			notifying  brokerapi.ServiceBroker
+		)
+
+		BeforeEach(func() {
+			dispatcher = newDispatcher()
+			broker = &fakes.FakeServiceBroker{InstanceLimit: 3}
+			notifying = webhooks.NewBroker(broker, dispatcher, logger)
+		})
+
+		delivered := func() []webhooks.Event {
+			dispatcher.Deliver(context.Background(), time.Now())
+			events := []webhooks.Event{}
+			for _, r := range requests {
+				var event webhooks.Event
+				Expect(json.Unmarshal(r.body, &event)).To(Succeed())
+				events = append(events, event)
+			}
+			return events
+		}
+
+		It("Publishes the lifecycle events", func() {
+			ctx := context.Background()
+			_, err := notifying.Provision(ctx, "instance-1", brokerapi.ProvisionDetails{
+				PlanID:           "plan-1",
+				OrganizationGUID: "org-1",
+				SpaceGUID:        "space-1",
+			}, false)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = notifying.Bind(ctx, "instance-1", "binding-1", brokerapi.BindDetails{PlanID: "plan-1"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = notifying.Unbind(ctx, "instance-1", "binding-1", brokerapi.UnbindDetails{PlanID: "plan-1"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = notifying.Deprovision(ctx, "instance-1", brokerapi.DeprovisionDetails{PlanID: "plan-1"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			events := delivered()
+			Expect(events).To(HaveLen(4))
+			Expect(events[0].Type).To(Equal(webhooks.InstanceCreated))
+			Expect(events[0].OrganizationGUID).To(Equal("org-1"))
+			Expect(events[0].SpaceGUID).To(Equal("space-1"))
+			Expect(events[1].Type).To(Equal(webhooks.BindingCreated))
+			Expect(events[1].BindingID).To(Equal("binding-1"))
+			Expect(events[2].Type).To(Equal(webhooks.BindingDeleted))
+			Expect(events[3].Type).To(Equal(webhooks.InstanceDeleted))
+		})
+
+		It("Publishes failed operations", func() {
+			broker.ProvisionError = errors.New("cluster unavailable")
+			_, err := notifying.Provision(context.Background(), "instance-1", brokerapi.ProvisionDetails{PlanID: "plan-1"}, false)
+			Expect(err).To(HaveOccurred())
+
+			events := delivered()
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].Type).To(Equal(webhooks.OperationFailed))
+			Expect(events[0].Operation).To(Equal("provision"))
+			Expect(events[0].Error).To(Equal("cluster unavailable"))
+		})
+
+		It("Publishes nothing for the instances and bindings already gone", func() {
+			ctx := context.Background()
+			_, err := notifying.Deprovision(ctx, "instance-1", brokerapi.DeprovisionDetails{PlanID: "plan-1"}, false)
+			Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+			broker.UnbindError = brokerapi.ErrBindingDoesNotExist
+			_, err = notifying.Unbind(ctx, "instance-1", "binding-1", brokerapi.UnbindDetails{PlanID: "plan-1"}, false)
+			Expect(err).To(Equal(brokerapi.ErrBindingDoesNotExist))
+
+			Expect(delivered()).To(BeEmpty())
+		})
+	})
+})